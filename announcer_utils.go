@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	apb "google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	backendEmbedded = "embedded"
+	backendGoBGP    = "gobgp"
+	backendFRR      = "frr"
+
+	defaultGoBGPAddress = "127.0.0.1:50051"
+
+	// defaultBackendTimeout limits every call to external BGP daemon so that
+	// a hung daemon does not block network and endpoint operations
+	defaultBackendTimeout = 10 * time.Second
+)
+
+// announcer is the BGP speaker which announces prefixes of this host to the network.
+type announcer interface {
+	// announce announces prefix with attributes of the network. Local AS is
+	// prepended to AS path prepend times.
+	announce(ctx context.Context, prefix *net.IPNet, options *networkOptions, prepend int) error
+	withdraw(ctx context.Context, prefix *net.IPNet) error
+	// isAnnounced tells if there is any path to prefix in the BGP table
+	isAnnounced(ctx context.Context, prefix *net.IPNet) bool
+	// receivedHostRoutes returns host routes which peers have sent, mapped to
+	// addresses of those peers
+	receivedHostRoutes(ctx context.Context) map[string][]string
+}
+
+var (
+	bgpBackend   = backendEmbedded
+	bgpAnnouncer announcer
+)
+
+// startAnnouncer starts the BGP backend selected with BGP_BACKEND. The embedded
+// GoBGP server is used by default, external daemons only announce our prefixes.
+func startAnnouncer() error {
+	if v := os.Getenv("BGP_BACKEND"); v != "" {
+		bgpBackend = v
+	}
+
+	switch bgpBackend {
+	case backendEmbedded:
+		if err := startBgpServer(); err != nil {
+			return err
+		}
+		bgpAnnouncer = &gobgpAnnouncer{api: &embeddedGoBGP{}}
+		return nil
+	case backendGoBGP, backendFRR:
+		if os.Getenv("INSTALL_ROUTES") == "true" {
+			return requireEmbeddedBgp("INSTALL_ROUTES")
+		}
+		if os.Getenv("BMP_COLLECTORS") != "" {
+			return requireEmbeddedBgp("BMP_COLLECTORS")
+		}
+		if os.Getenv("MRT_UPDATES") == "true" || os.Getenv("MRT_TABLE_INTERVAL") != "" {
+			return requireEmbeddedBgp("MRT dumps")
+		}
+	default:
+		return fmt.Errorf("Environment variable BGP_BACKEND value is invalid, supported values are %s, %s and %s\r\n", backendEmbedded, backendGoBGP, backendFRR)
+	}
+
+	routerID = os.Getenv("ROUTER_ID")
+	if routerID == "" || net.ParseIP(routerID) == nil {
+		return fmt.Errorf("Environment variable ROUTER_ID is required\r\n")
+	}
+	localAsInt, err := strconv.Atoi(os.Getenv("LOCAL_AS"))
+	if err != nil {
+		return fmt.Errorf("Environment variable LOCAL_AS value is invalid\r\n")
+	}
+	localAS = uint32(localAsInt)
+
+	if bgpBackend == backendFRR {
+		a, err := newFRRAnnouncer()
+		if err != nil {
+			return err
+		}
+		bgpAnnouncer = a
+		return nil
+	}
+
+	address := os.Getenv("GOBGP_ADDRESS")
+	if address == "" {
+		address = defaultGoBGPAddress
+	}
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("Cannot connect to gobgpd in %s: %v\r\n", address, err)
+	}
+	log.Infof("Using gobgpd in %s for BGP announcements", address)
+	bgpAnnouncer = &gobgpAnnouncer{api: &remoteGoBGP{client: apiGoBGP.NewGobgpApiClient(conn), timeout: defaultBackendTimeout}}
+	return nil
+}
+
+// requireEmbeddedBgp returns an error for features which need the embedded BGP server.
+func requireEmbeddedBgp(feature string) error {
+	if bgpBackend != backendEmbedded {
+		return fmt.Errorf("%s requires embedded BGP server but BGP_BACKEND is %s", feature, bgpBackend)
+	}
+	return nil
+}
+
+func prefixFamily(prefix *net.IPNet) apiGoBGP.Family_Afi {
+	if prefix.IP.To4() == nil {
+		return apiGoBGP.Family_AFI_IP6
+	}
+	return apiGoBGP.Family_AFI_IP
+}
+
+// newPath builds BGP path to prefix with attributes configured for the network.
+func newPath(prefix *net.IPNet, options *networkOptions, prepend int) *apiGoBGP.Path {
+	family := prefixFamily(prefix)
+	ones, _ := prefix.Mask.Size()
+
+	nlri, _ := apb.New(&apiGoBGP.IPAddressPrefix{
+		Prefix:    prefix.IP.String(),
+		PrefixLen: uint32(ones),
+	})
+	a1, _ := apb.New(&apiGoBGP.OriginAttribute{
+		Origin: 0,
+	})
+	a2, _ := apb.New(&apiGoBGP.NextHopAttribute{
+		NextHop: options.nextHop(family == apiGoBGP.Family_AFI_IP6),
+	})
+	asPath := []uint32{}
+	for i := 0; i < prepend; i++ {
+		asPath = append(asPath, localAS)
+	}
+	a3, _ := apb.New(&apiGoBGP.AsPathAttribute{
+		Segments: []*apiGoBGP.AsSegment{
+			{
+				Type:    2,
+				Numbers: asPath,
+			},
+		},
+	})
+	attrs := []*apb.Any{a1, a2, a3}
+	if options.MED != nil {
+		med, _ := apb.New(&apiGoBGP.MultiExitDiscAttribute{
+			Med: *options.MED,
+		})
+		attrs = append(attrs, med)
+	}
+	if communities := options.communityValues(); len(communities) > 0 {
+		c, _ := apb.New(&apiGoBGP.CommunitiesAttribute{
+			Communities: communities,
+		})
+		attrs = append(attrs, c)
+	}
+
+	return &apiGoBGP.Path{
+		Family: &apiGoBGP.Family{Afi: family, Safi: apiGoBGP.Family_SAFI_UNICAST},
+		Nlri:   nlri,
+		Pattrs: attrs,
+	}
+}
+
+// gobgpAPI is the part of GoBGP API which is needed for announcements. It is
+// implemented both by the embedded server and by gRPC client of remote gobgpd.
+type gobgpAPI interface {
+	AddPath(ctx context.Context, r *apiGoBGP.AddPathRequest) error
+	DeletePath(ctx context.Context, r *apiGoBGP.DeletePathRequest) error
+	ListPath(ctx context.Context, r *apiGoBGP.ListPathRequest, fn func(*apiGoBGP.Destination)) error
+	ListPeer(ctx context.Context, r *apiGoBGP.ListPeerRequest, fn func(*apiGoBGP.Peer)) error
+}
+
+type embeddedGoBGP struct{}
+
+func (e *embeddedGoBGP) AddPath(ctx context.Context, r *apiGoBGP.AddPathRequest) error {
+	_, err := bgpServer.AddPath(ctx, r)
+	return err
+}
+
+func (e *embeddedGoBGP) DeletePath(ctx context.Context, r *apiGoBGP.DeletePathRequest) error {
+	return bgpServer.DeletePath(ctx, r)
+}
+
+func (e *embeddedGoBGP) ListPath(ctx context.Context, r *apiGoBGP.ListPathRequest, fn func(*apiGoBGP.Destination)) error {
+	return bgpServer.ListPath(ctx, r, fn)
+}
+
+func (e *embeddedGoBGP) ListPeer(ctx context.Context, r *apiGoBGP.ListPeerRequest, fn func(*apiGoBGP.Peer)) error {
+	return bgpServer.ListPeer(ctx, r, fn)
+}
+
+type remoteGoBGP struct {
+	client  apiGoBGP.GobgpApiClient
+	timeout time.Duration
+}
+
+func (g *remoteGoBGP) AddPath(ctx context.Context, r *apiGoBGP.AddPathRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	_, err := g.client.AddPath(ctx, r)
+	return err
+}
+
+func (g *remoteGoBGP) DeletePath(ctx context.Context, r *apiGoBGP.DeletePathRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	_, err := g.client.DeletePath(ctx, r)
+	return err
+}
+
+func (g *remoteGoBGP) ListPath(ctx context.Context, r *apiGoBGP.ListPathRequest, fn func(*apiGoBGP.Destination)) error {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	stream, err := g.client.ListPath(ctx, r)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(resp.Destination)
+	}
+}
+
+func (g *remoteGoBGP) ListPeer(ctx context.Context, r *apiGoBGP.ListPeerRequest, fn func(*apiGoBGP.Peer)) error {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	stream, err := g.client.ListPeer(ctx, r)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(resp.Peer)
+	}
+}
+
+type gobgpAnnouncer struct {
+	api gobgpAPI
+}
+
+func (g *gobgpAnnouncer) announce(ctx context.Context, prefix *net.IPNet, options *networkOptions, prepend int) error {
+	return g.api.AddPath(ctx, &apiGoBGP.AddPathRequest{
+		Path: newPath(prefix, options, prepend),
+	})
+}
+
+func (g *gobgpAnnouncer) withdraw(ctx context.Context, prefix *net.IPNet) error {
+	return g.api.DeletePath(ctx, &apiGoBGP.DeletePathRequest{
+		TableType: apiGoBGP.TableType_GLOBAL,
+		Path:      newPath(prefix, defaultNetworkOptions(), 0),
+	})
+}
+
+func (g *gobgpAnnouncer) listPaths(ctx context.Context, prefix *net.IPNet) []*apiGoBGP.Path {
+	paths := []*apiGoBGP.Path{}
+	request := &apiGoBGP.ListPathRequest{
+		TableType: apiGoBGP.TableType_GLOBAL,
+		Family:    &apiGoBGP.Family{Afi: prefixFamily(prefix), Safi: apiGoBGP.Family_SAFI_UNICAST},
+		Prefixes:  []*apiGoBGP.TableLookupPrefix{{Prefix: prefix.String()}},
+	}
+	if err := g.api.ListPath(ctx, request, func(d *apiGoBGP.Destination) {
+		paths = append(paths, d.Paths...)
+	}); err != nil {
+		log.Errorf("listPaths: failed to list paths: %v", err)
+	}
+	return paths
+}
+
+func (g *gobgpAnnouncer) isAnnounced(ctx context.Context, prefix *net.IPNet) bool {
+	return len(g.listPaths(ctx, prefix)) > 0
+}
+
+// receivedHostRoutes reads Adj-RIB-In of every peer so that routes which import
+// policy rejects are included too.
+func (g *gobgpAnnouncer) receivedHostRoutes(ctx context.Context) map[string][]string {
+	neighbors := []string{}
+	if err := g.api.ListPeer(ctx, &apiGoBGP.ListPeerRequest{}, func(p *apiGoBGP.Peer) {
+		if p.Conf != nil {
+			neighbors = append(neighbors, p.Conf.NeighborAddress)
+		}
+	}); err != nil {
+		log.Errorf("receivedHostRoutes: failed to list peers: %v", err)
+	}
+
+	routes := make(map[string][]string)
+	for _, neighbor := range neighbors {
+		for _, afi := range []apiGoBGP.Family_Afi{apiGoBGP.Family_AFI_IP, apiGoBGP.Family_AFI_IP6} {
+			request := &apiGoBGP.ListPathRequest{
+				TableType: apiGoBGP.TableType_ADJ_IN,
+				Name:      neighbor,
+				Family:    &apiGoBGP.Family{Afi: afi, Safi: apiGoBGP.Family_SAFI_UNICAST},
+			}
+			if err := g.api.ListPath(ctx, request, func(d *apiGoBGP.Destination) {
+				addHostRoute(routes, d.Prefix, neighbor)
+			}); err != nil {
+				log.Debugf("receivedHostRoutes: failed to list paths from %s: %v", neighbor, err)
+			}
+		}
+	}
+	return routes
+}
+
+// addHostRoute records that peer has sent route to prefix, if it is a host route.
+func addHostRoute(routes map[string][]string, prefix, peer string) {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return
+	}
+	if ones, bits := ipnet.Mask.Size(); ones != bits {
+		return
+	}
+	routes[ipnet.String()] = append(routes[ipnet.String()], peer)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/libnetwork/netlabel"
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// hungGoBGP is gobgpd which never answers.
+type hungGoBGP struct {
+	apiGoBGP.GobgpApiClient
+}
+
+func (h *hungGoBGP) AddPath(ctx context.Context, r *apiGoBGP.AddPathRequest, opts ...grpc.CallOption) (*apiGoBGP.AddPathResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (h *hungGoBGP) DeletePath(ctx context.Context, r *apiGoBGP.DeletePathRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRemoteGoBGPTimeout(t *testing.T) {
+	a := &gobgpAnnouncer{api: &remoteGoBGP{client: &hungGoBGP{}, timeout: 100 * time.Millisecond}}
+	_, prefix, _ := net.ParseCIDR("10.0.0.1/32")
+
+	start := time.Now()
+	if err := a.announce(context.Background(), prefix, defaultNetworkOptions(), 0); err == nil {
+		t.Error("announce() succeeded without response")
+	}
+	if err := a.withdraw(context.Background(), prefix); err == nil {
+		t.Error("withdraw() succeeded without response")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("calls returned after %v, want timeouts", elapsed)
+	}
+}
+
+func TestStartAnnouncerExternal(t *testing.T) {
+	defer func() {
+		bgpBackend, bgpAnnouncer = backendEmbedded, nil
+		routerID, localAS = "", 0
+	}()
+	t.Setenv("BGP_BACKEND", backendGoBGP)
+	t.Setenv("ROUTER_ID", "192.0.2.254")
+	t.Setenv("LOCAL_AS", "65001")
+	t.Setenv("GOBGP_ADDRESS", "127.0.0.1:1")
+
+	// Features of the embedded server are refused instead of silently ignored
+	t.Setenv("INSTALL_ROUTES", "true")
+	if err := startAnnouncer(); err == nil {
+		t.Error("startAnnouncer() accepted INSTALL_ROUTES with gobgpd")
+	}
+	t.Setenv("INSTALL_ROUTES", "")
+	for _, option := range []string{optPeers, optRequirePeer} {
+		generic := map[string]interface{}{option: requirePeerJoin}
+		if _, err := parseNetworkOptions(map[string]interface{}{netlabel.GenericData: generic}); err == nil {
+			t.Errorf("parseNetworkOptions() accepted %s with BGP_BACKEND %s", option, bgpBackend)
+		}
+	}
+
+	if err := startAnnouncer(); err != nil {
+		t.Fatalf("startAnnouncer() error = %v", err)
+	}
+	g, ok := bgpAnnouncer.(*gobgpAnnouncer)
+	if !ok {
+		t.Fatalf("startAnnouncer() announcer = %T, want gobgpd client", bgpAnnouncer)
+	}
+	if remote, ok := g.api.(*remoteGoBGP); !ok || remote.timeout != defaultBackendTimeout {
+		t.Errorf("gobgpd client = %+v, want timeout %v", g.api, defaultBackendTimeout)
+	}
+	if localAS != 65001 || routerID != "192.0.2.254" {
+		t.Errorf("startAnnouncer() local AS %d, router ID %s", localAS, routerID)
+	}
+
+	t.Setenv("BGP_BACKEND", backendFRR)
+	t.Setenv("FRR_VTY_SOCKET", startFakeBgpd(t, &fakeBgpd{}))
+	if err := startAnnouncer(); err != nil {
+		t.Fatalf("startAnnouncer() with FRR error = %v", err)
+	}
+	if _, ok := bgpAnnouncer.(*frrAnnouncer); !ok {
+		t.Errorf("startAnnouncer() announcer = %T, want FRR", bgpAnnouncer)
+	}
+
+	t.Setenv("ROUTER_ID", "")
+	if err := startAnnouncer(); err == nil {
+		t.Error("startAnnouncer() succeeded without ROUTER_ID")
+	}
+	t.Setenv("BGP_BACKEND", "bird")
+	if err := startAnnouncer(); err == nil {
+		t.Error("startAnnouncer() accepted unknown backend")
+	}
+}
@@ -6,13 +6,11 @@ import (
 	"net"
 	"os"
 	"strconv"
-	"strings"
 
 	apiGoBGP "github.com/osrg/gobgp/v3/api"
 	loggerGoBGP "github.com/osrg/gobgp/v3/pkg/log"
 	serverGoBGP "github.com/osrg/gobgp/v3/pkg/server"
 	"github.com/vishvananda/netlink"
-	apb "google.golang.org/protobuf/types/known/anypb"
 )
 
 var (
@@ -21,7 +19,7 @@ var (
 	routerID  = ""
 )
 
-func startBgpServer(peerAddress string) error {
+func startBgpServer() error {
 	routerID = os.Getenv("ROUTER_ID")
 	if routerID == "" || net.ParseIP(routerID) == nil {
 		return fmt.Errorf("Environment variable ROUTER_ID is required\r\n")
@@ -39,15 +37,33 @@ func startBgpServer(peerAddress string) error {
 	}
 	localAS = uint32(localAsInt)
 
-	peerAsInt, err := strconv.Atoi(os.Getenv("PEER_AS"))
+	peers, err := parsePeers()
 	if err != nil {
-		return fmt.Errorf("Environment variable PEER_AS value is invalid\r\n")
+		return err
+	}
+	dynamic, err := parseDynamicNeighbors()
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 && len(dynamic) == 0 {
+		return fmt.Errorf("Environment variable PEER_ADDRESS, PEERS or DYNAMIC_NEIGHBORS is required\r\n")
+	}
+	if len(dynamic) > 0 && routerPort <= 0 {
+		return fmt.Errorf("Environment variable ROUTER_PORT must be a listening port with DYNAMIC_NEIGHBORS\r\n")
+	}
+
+	if err := loadInstallRoutesConfig(); err != nil {
+		return err
+	}
+
+	grpcOptions, err := grpcServerOptions()
+	if err != nil {
+		return err
 	}
-	peerAs := uint32(peerAsInt)
 
 	log.Infof("Starting BGP server")
 	bgpLogger := loggerGoBGP.NewDefaultLogger()
-	bgpServer = *serverGoBGP.NewBgpServer(serverGoBGP.LoggerOption(bgpLogger))
+	bgpServer = *serverGoBGP.NewBgpServer(append(grpcOptions, serverGoBGP.LoggerOption(bgpLogger))...)
 	go bgpServer.Serve()
 	err = bgpServer.StartBgp(context.Background(), &apiGoBGP.StartBgpRequest{
 		Global: &apiGoBGP.Global{
@@ -60,149 +76,177 @@ func startBgpServer(peerAddress string) error {
 		return err
 	}
 
-	n := &apiGoBGP.Peer{
-		Conf: &apiGoBGP.PeerConf{
-			NeighborAddress: peerAddress,
-			PeerAsn:         peerAs,
-		},
+	if err := watchPeerState(); err != nil {
+		return err
 	}
-	peerPassword := os.Getenv("PEER_PASSWORD")
-	if peerPassword != "" {
-		n.Conf.AuthPassword = peerPassword
+
+	for _, peer := range peers {
+		if err := bgpServer.AddPeer(context.Background(), &apiGoBGP.AddPeerRequest{
+			Peer: peer.apiPeer(),
+		}); err != nil {
+			return err
+		}
 	}
-	if err := bgpServer.AddPeer(context.Background(), &apiGoBGP.AddPeerRequest{
-		Peer: n,
-	}); err != nil {
+	bgpPeers = peers
+
+	if err := addDynamicNeighbors(dynamic); err != nil {
 		return err
 	}
 
-	return nil
+	if err := startBmp(); err != nil {
+		return err
+	}
+
+	if err := startMrt(); err != nil {
+		return err
+	}
+
+	return applyPolicies()
 }
 
-func addRoute(NetworkID, EndpointID, ipv4, ipv6 string) {
-	if running := waitContainerHealthy(NetworkID, EndpointID); running == false {
+func addRoute(NetworkID, EndpointID, ipv4, ipv6 string, options *networkOptions) {
+	// Prefixes which are never announced must not stay counted in the limits
+	if options.HealthMode != healthModeNone {
+		if running := waitContainerHealthy(NetworkID, EndpointID, options.HealthMode); running == false {
+			prefixLimits.releaseOwner(EndpointID)
+			return
+		}
+	}
+	if options.RequirePeer == requirePeerAnnounce && !waitPeerEstablished(NetworkID, EndpointID) {
+		prefixLimits.releaseOwner(EndpointID)
 		return
 	}
 
-	bridgeName := getBridgeNameByNetID(NetworkID)
-	bridge, err := netlink.LinkByName(bridgeName)
+	bridge, err := netlink.LinkByName(routeLinkName(NetworkID, EndpointID))
 	if err != nil {
 		log.Errorf("addRoute error: %v", err)
+		prefixLimits.releaseOwner(EndpointID)
 		return
 	}
+	routeOptions := options
+	if options.IPVSAddress != "" {
+		// Containers are real servers of IPVS virtual service and only its address is announced
+		o := *options
+		o.AnnounceMode = announceModeNone
+		routeOptions = &o
+	}
+	addresses := []net.IP{}
 	if ipv4 != "" {
-		ip, ipv4Dst, _ := net.ParseCIDR(ipv4)
+		// Container address can come from a bigger pool but each address is routed and advertised as /32
+		ip, _, _ := net.ParseCIDR(ipv4)
 		if ip.String() != "0.0.0.0" {
-			log.Infof("Adding IPv4 route to %s", ipv4Dst)
-			route := netlink.Route{Dst: ipv4Dst, LinkIndex: bridge.Attrs().Index}
-			netlink.RouteAdd(&route)
-
-			addBgpRoute(ip.String(), 32, apiGoBGP.Family_AFI_IP)
+			addLocalRoute(NetworkID, EndpointID, bridge, &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, apiGoBGP.Family_AFI_IP, routeOptions)
+			addresses = append(addresses, ip)
 		}
 	}
 	if ipv6 != "" {
-		ip, ipv6Dst, _ := net.ParseCIDR(ipv6)
-		log.Infof("Adding IPv6 route to %s", ipv6Dst)
-		route := netlink.Route{Dst: ipv6Dst, LinkIndex: bridge.Attrs().Index}
-		netlink.RouteAdd(&route)
+		ip, _, _ := net.ParseCIDR(ipv6)
+		addLocalRoute(NetworkID, EndpointID, bridge, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, apiGoBGP.Family_AFI_IP6, routeOptions)
+		addresses = append(addresses, ip)
+	}
 
-		addBgpRoute(ip.String(), 128, apiGoBGP.Family_AFI_IP6)
+	if options.SourceRouting {
+		if err := addReturnGateway(bridge); err != nil {
+			log.Errorf("addRoute error: %v", err)
+			return
+		}
+		table, err := lbServer.sourceRoutingTable(NetworkID)
+		if err != nil {
+			log.Errorf("addRoute error: %v", err)
+			return
+		}
+		if err := addSourceRouting(NetworkID, EndpointID, table, addresses); err != nil {
+			log.Errorf("addRoute error: %v", err)
+		}
 	}
-}
 
-func addBgpRoute(prefix string, mask int, ipFamily apiGoBGP.Family_Afi) error {
-	nlri, _ := apb.New(&apiGoBGP.IPAddressPrefix{
-		Prefix:    prefix,
-		PrefixLen: uint32(mask),
-	})
-	a1, _ := apb.New(&apiGoBGP.OriginAttribute{
-		Origin: 0,
-	})
-	a2, _ := apb.New(&apiGoBGP.NextHopAttribute{
-		NextHop: routerID,
-	})
-	a3, _ := apb.New(&apiGoBGP.AsPathAttribute{
-		Segments: []*apiGoBGP.AsSegment{
-			{
-				Type: 2,
-			},
-		},
-	})
-	attrs := []*apb.Any{a1, a2, a3}
-	_, err := bgpServer.AddPath(context.Background(), &apiGoBGP.AddPathRequest{
-		Path: &apiGoBGP.Path{
-			Family: &apiGoBGP.Family{Afi: ipFamily, Safi: apiGoBGP.Family_SAFI_UNICAST},
-			Nlri:   nlri,
-			Pattrs: attrs,
-		},
-	})
-	return err
+	if options.IPVSAddress != "" {
+		if err := localBalancer.addServer(NetworkID, EndpointID, addresses, options); err != nil {
+			log.Errorf("addRoute error: %v", err)
+		}
+	}
 }
 
-func delRoute(NetworkID, EndpointID string) {
-	bridgeName := getBridgeNameByNetID(NetworkID)
-	bridge, err := netlink.LinkByName(bridgeName)
-	if err != nil {
-		log.Errorf("delRoute error: %v", err)
+func addLocalRoute(NetworkID, EndpointID string, link netlink.Link, dst *net.IPNet, ipFamily apiGoBGP.Family_Afi, options *networkOptions) {
+	if err := checkPrefixAllowed(dst.String(), "addRoute"); err != nil {
+		log.Errorf("addRoute error: %v", err)
 		return
 	}
 
-	v4routes, err := netlink.RouteList(bridge, netlink.FAMILY_V4)
-	if err != nil {
-		log.Errorf("Failed to get local IPv4 routes: %v", err)
+	desiredRoutes.updates.Lock()
+	defer desiredRoutes.updates.Unlock()
+
+	if ipFamily == apiGoBGP.Family_AFI_IP {
+		log.Infof("Adding IPv4 route to %s", dst)
+	} else {
+		log.Infof("Adding IPv6 route to %s", dst)
 	}
-	for _, v4route := range v4routes {
-		v4dst := &v4route.Dst.IP
-		delBgpRoute(v4dst.String(), 32, apiGoBGP.Family_AFI_IP)
-		if err := netlink.RouteDel(&v4route); err != nil {
-			log.Errorf("Cannot remove local route to: %v , Error: %v", v4dst.String(), err)
+	if r := desiredRoutes.addNexthop(dst, EndpointID, link.Attrs().Name); r != nil {
+		// Another local endpoint already has this address, only nexthops of the route change
+		if links := desiredRoutes.links(r); len(links) == 1 {
+			log.Warnf("Multiple endpoints share %s on %s, use %s=%s to balance traffic between them", dst, links[0], optDataplane, dataplaneRouted)
 		}
+		if err := r.program(); err != nil {
+			log.Errorf("Cannot add nexthop %s to route %s: %v", link.Attrs().Name, dst, err)
+		}
+		return
+	}
+
+	r := &localRoute{networkID: NetworkID, nexthops: map[string]string{EndpointID: link.Attrs().Name}, dst: dst, family: ipFamily, options: options}
+	if err := r.program(); err != nil {
+		log.Errorf("Cannot add local route %s: %v", dst, err)
+	}
+	if err := setPrefixPeers(dst.String(), options.Peers); err != nil {
+		log.Errorf("Cannot select peers for %s, skipping BGP route: %v", dst, err)
+		r.withdrawn = true
+		r.peersPending = true
+		desiredRoutes.add(r)
+		return
 	}
-	v6routes, err := netlink.RouteList(bridge, netlink.FAMILY_V6)
+	if err := r.announce(); err != nil {
+		log.Errorf("Cannot announce BGP route %s: %v", dst, err)
+	}
+	desiredRoutes.add(r)
+}
+
+func addBgpRoute(prefix string, mask int, ipFamily apiGoBGP.Family_Afi, options *networkOptions) error {
+	_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", prefix, mask))
 	if err != nil {
-		log.Errorf("Failed to get local IPv6 routes: %v", err)
+		return err
 	}
-	for _, v6route := range v6routes {
-		v6dst := &v6route.Dst.IP
-		delBgpRoute(v6dst.String(), 128, apiGoBGP.Family_AFI_IP6)
-		if err := netlink.RouteDel(&v6route); err != nil {
-			log.Errorf("Cannot remove local route to: %v , Error: %v", v6dst.String(), err)
+	return bgpAnnouncer.announce(context.Background(), ipnet, options, 0)
+}
+
+func delRoute(NetworkID, EndpointID string) {
+	localBalancer.delServer(EndpointID)
+	delLocalRoutes(EndpointID)
+}
+
+// delLocalRoutes removes endpoint from nexthops of its local routes and withdraws
+// routes which were left without nexthops.
+func delLocalRoutes(EndpointID string) {
+	// Routes which other local endpoints share stay announced and only lose this
+	// endpoint as nexthop. Other routes on the same bridge are not touched at all.
+	desiredRoutes.updates.Lock()
+	defer desiredRoutes.updates.Unlock()
+	shared, orphaned := desiredRoutes.delNexthop(EndpointID)
+	for _, r := range shared {
+		log.Infof("Removing endpoint %s from nexthops of route %s", EndpointID, r.dst)
+		if err := r.program(); err != nil {
+			log.Errorf("Cannot remove nexthop from route %s: %v", r.dst, err)
 		}
 	}
+	for _, r := range orphaned {
+		removeRoute(r)
+	}
 }
 
 func delBgpRoute(prefix string, mask int, ipFamily apiGoBGP.Family_Afi) error {
-	nlri, _ := apb.New(&apiGoBGP.IPAddressPrefix{
-		Prefix:    prefix,
-		PrefixLen: uint32(mask),
-	})
-	a1, _ := apb.New(&apiGoBGP.OriginAttribute{
-		Origin: 0,
-	})
-	a2, _ := apb.New(&apiGoBGP.NextHopAttribute{
-		NextHop: routerID,
-	})
-	a3, _ := apb.New(&apiGoBGP.AsPathAttribute{
-		Segments: []*apiGoBGP.AsSegment{
-			{
-				Type: 2,
-			},
-		},
-	})
-	attrs := []*apb.Any{a1, a2, a3}
-	p1 := &apiGoBGP.Path{
-		Family: &apiGoBGP.Family{Afi: ipFamily, Safi: apiGoBGP.Family_SAFI_UNICAST},
-		Nlri:   nlri,
-		Pattrs: attrs,
-	}
-	err := bgpServer.DeletePath(context.Background(), &apiGoBGP.DeletePathRequest{
-		TableType: apiGoBGP.TableType_GLOBAL,
-		Path:      p1,
-	})
+	_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", prefix, mask))
 	if err != nil {
 		return err
 	}
-	return nil
+	return bgpAnnouncer.withdraw(context.Background(), ipnet)
 }
 
 func isPrefixAdvertised(ctx context.Context, prefix string) bool {
@@ -211,20 +255,24 @@ func isPrefixAdvertised(ctx context.Context, prefix string) bool {
 		return false
 	}
 
-	var counter int
-	callback := func(*apiGoBGP.Destination) { counter++ }
-	request := &apiGoBGP.ListPathRequest{
-		Family:   &apiGoBGP.Family{Afi: apiGoBGP.Family_AFI_IP, Safi: apiGoBGP.Family_SAFI_UNICAST},
-		Prefixes: []*apiGoBGP.TableLookupPrefix{{Prefix: prefix}},
-	}
-
-	if ipnet.IP.To4() == nil && strings.Contains(ipnet.IP.String(), ":") {
-		request.Family.Afi = apiGoBGP.Family_AFI_IP6
-	}
+	return bgpAnnouncer.isAnnounced(ctx, ipnet)
+}
 
-	bgpServer.ListPath(ctx, request, callback)
+// receivedHostRoutes returns host routes which BGP peers have sent us, meaning that
+// other hosts already announce those addresses.
+func receivedHostRoutes() map[string][]string {
+	return bgpAnnouncer.receivedHostRoutes(context.Background())
+}
 
-	return counter > 0
+// isAddressReceived returns function which tells if ip is in received host routes.
+func isAddressReceived(received map[string][]string) func(net.IP) bool {
+	return func(ip net.IP) bool {
+		if peers, ok := received[hostAddress(ip)]; ok {
+			log.Infof("Address %s is announced by %v", ip, peers)
+			return true
+		}
+		return false
+	}
 }
 
 func advertisePrefix(ctx context.Context, prefix string) error {
@@ -233,39 +281,7 @@ func advertisePrefix(ctx context.Context, prefix string) error {
 		return fmt.Errorf("advertisePrefix: failed to parse the prefix: %w", err)
 	}
 
-	mask, _ := ipnet.Mask.Size()
-	var family apiGoBGP.Family_Afi
-	if ipnet.IP.To4() == nil && strings.Contains(ipnet.IP.String(), ":") {
-		family = apiGoBGP.Family_AFI_IP6
-	} else {
-		family = apiGoBGP.Family_AFI_IP
-	}
-
-	nlri, _ := apb.New(&apiGoBGP.IPAddressPrefix{
-		Prefix:    ipnet.IP.String(),
-		PrefixLen: uint32(mask),
-	})
-	a1, _ := apb.New(&apiGoBGP.OriginAttribute{
-		Origin: 0,
-	})
-	a2, _ := apb.New(&apiGoBGP.NextHopAttribute{
-		NextHop: routerID,
-	})
-	a3, _ := apb.New(&apiGoBGP.AsPathAttribute{
-		Segments: []*apiGoBGP.AsSegment{
-			{
-				Type: 2,
-			},
-		},
-	})
-	attrs := []*apb.Any{a1, a2, a3}
-	if _, err := bgpServer.AddPath(ctx, &apiGoBGP.AddPathRequest{
-		Path: &apiGoBGP.Path{
-			Family: &apiGoBGP.Family{Afi: family, Safi: apiGoBGP.Family_SAFI_UNICAST},
-			Nlri:   nlri,
-			Pattrs: attrs,
-		},
-	}); err != nil {
+	if err := bgpAnnouncer.announce(ctx, ipnet, defaultNetworkOptions(), 0); err != nil {
 		return fmt.Errorf("advertisePrefix: failed to add the prefix: %w", err)
 	}
 
@@ -278,41 +294,7 @@ func withdrawPrefix(ctx context.Context, prefix string) error {
 		return fmt.Errorf("withdrawPrefix: failed to parse the prefix: %w", err)
 	}
 
-	mask, _ := ipnet.Mask.Size()
-	var family apiGoBGP.Family_Afi
-	if ipnet.IP.To4() == nil && strings.Contains(ipnet.IP.String(), ":") {
-		family = apiGoBGP.Family_AFI_IP6
-	} else {
-		family = apiGoBGP.Family_AFI_IP
-	}
-
-	nlri, _ := apb.New(&apiGoBGP.IPAddressPrefix{
-		Prefix:    ipnet.IP.String(),
-		PrefixLen: uint32(mask),
-	})
-	a1, _ := apb.New(&apiGoBGP.OriginAttribute{
-		Origin: 0,
-	})
-	a2, _ := apb.New(&apiGoBGP.NextHopAttribute{
-		NextHop: routerID,
-	})
-	a3, _ := apb.New(&apiGoBGP.AsPathAttribute{
-		Segments: []*apiGoBGP.AsSegment{
-			{
-				Type: 2,
-			},
-		},
-	})
-	attrs := []*apb.Any{a1, a2, a3}
-	p1 := &apiGoBGP.Path{
-		Family: &apiGoBGP.Family{Afi: family, Safi: apiGoBGP.Family_SAFI_UNICAST},
-		Nlri:   nlri,
-		Pattrs: attrs,
-	}
-	if err := bgpServer.DeletePath(ctx, &apiGoBGP.DeletePathRequest{
-		TableType: apiGoBGP.TableType_GLOBAL,
-		Path:      p1,
-	}); err != nil {
+	if err := bgpAnnouncer.withdraw(ctx, ipnet); err != nil {
 		return fmt.Errorf("withdrawPrefix: failed to delete the prefix: %w", err)
 	}
 
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+)
+
+const defaultBmpPort = 11019
+
+var bmpPolicies = map[string]apiGoBGP.AddBmpRequest_MonitoringPolicy{
+	"pre":   apiGoBGP.AddBmpRequest_PRE,
+	"post":  apiGoBGP.AddBmpRequest_POST,
+	"both":  apiGoBGP.AddBmpRequest_BOTH,
+	"local": apiGoBGP.AddBmpRequest_LOCAL,
+	"all":   apiGoBGP.AddBmpRequest_ALL,
+}
+
+// parseBmpCollector parses collector address in format host[:port]. IPv6 address
+// is given in brackets when port is set and may be in brackets without it too.
+func parseBmpCollector(collector string) (string, uint32, error) {
+	host, port := strings.TrimSuffix(strings.TrimPrefix(collector, "["), "]"), defaultBmpPort
+	if h, p, err := net.SplitHostPort(collector); err == nil {
+		host = h
+		if port, err = strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+			return "", 0, fmt.Errorf("invalid port in %s", collector)
+		}
+	}
+	if net.ParseIP(host) == nil {
+		return "", 0, fmt.Errorf("%s is not an IP address", host)
+	}
+	return host, uint32(port), nil
+}
+
+// startBmp makes the embedded BGP server stream its state to BMP collectors listed in
+// BMP_COLLECTORS. Loc-RIB monitoring (policy local or all) includes also the routes
+// which this host originates for containers and advertised networks.
+func startBmp() error {
+	collectors := splitList(os.Getenv("BMP_COLLECTORS"))
+	if len(collectors) == 0 {
+		return nil
+	}
+
+	policyName := "all"
+	if v := os.Getenv("BMP_POLICY"); v != "" {
+		policyName = strings.ToLower(v)
+	}
+	policy, ok := bmpPolicies[policyName]
+	if !ok {
+		return fmt.Errorf("Environment variable BMP_POLICY value is invalid, supported values are pre, post, both, local and all\r\n")
+	}
+
+	statisticsTimeout := 0
+	if v := os.Getenv("BMP_STATISTICS_INTERVAL"); v != "" {
+		var err error
+		if statisticsTimeout, err = strconv.Atoi(v); err != nil || statisticsTimeout < 0 {
+			return fmt.Errorf("Environment variable BMP_STATISTICS_INTERVAL value is invalid\r\n")
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	for _, collector := range collectors {
+		address, port, err := parseBmpCollector(collector)
+		if err != nil {
+			return fmt.Errorf("Environment variable BMP_COLLECTORS value is invalid, %v\r\n", err)
+		}
+		// GoBGP keeps reconnecting to collector in background so it does not need to be up yet
+		if err := bgpServer.AddBmp(context.Background(), &apiGoBGP.AddBmpRequest{
+			Address:           address,
+			Port:              port,
+			Policy:            policy,
+			StatisticsTimeout: int32(statisticsTimeout),
+			SysName:           hostname,
+			SysDescr:          "docker-bgp-lb",
+		}); err != nil {
+			return fmt.Errorf("startBmp: failed to add BMP collector %s: %w", collector, err)
+		}
+		log.Infof("Streaming BMP to %s:%d with policy %s", address, port, policyName)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+)
+
+const (
+	bmpMsgRouteMonitoring = 0
+	bmpMsgInitiation      = 4
+)
+
+func TestParseBmpCollector(t *testing.T) {
+	tests := []struct {
+		collector string
+		host      string
+		port      uint32
+		valid     bool
+	}{
+		{"192.0.2.1", "192.0.2.1", defaultBmpPort, true},
+		{"192.0.2.1:5000", "192.0.2.1", 5000, true},
+		{"2001:db8::1", "2001:db8::1", defaultBmpPort, true},
+		{"[2001:db8::1]", "2001:db8::1", defaultBmpPort, true},
+		{"[2001:db8::1]:5000", "2001:db8::1", 5000, true},
+		{"192.0.2.1:0", "", 0, false},
+		{"192.0.2.1:70000", "", 0, false},
+		{"collector.example.com", "", 0, false},
+	}
+	for _, tt := range tests {
+		host, port, err := parseBmpCollector(tt.collector)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseBmpCollector(%q) error = %v, want valid %v", tt.collector, err, tt.valid)
+			continue
+		}
+		if tt.valid && (host != tt.host || port != tt.port) {
+			t.Errorf("parseBmpCollector(%q) = %s, %d, want %s, %d", tt.collector, host, port, tt.host, tt.port)
+		}
+	}
+}
+
+// readBmpMessage reads one BMP message and returns its type.
+func readBmpMessage(r *bufio.Reader) (byte, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:5])-6)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	return header[5], nil
+}
+
+func TestStartBmp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	t.Setenv("BMP_COLLECTORS", listener.Addr().String())
+	t.Setenv("BMP_POLICY", "all")
+
+	startTestBgpServer(t)
+
+	if err := startBmp(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("BMP collector did not get connection: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	msgType, err := readBmpMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != bmpMsgInitiation {
+		t.Fatalf("first BMP message type = %d, want initiation", msgType)
+	}
+
+	_, prefix, _ := net.ParseCIDR("10.0.0.1/32")
+	if _, err := bgpServer.AddPath(context.Background(), &apiGoBGP.AddPathRequest{
+		Path: newPath(prefix, defaultNetworkOptions(), 0),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msgType, err := readBmpMessage(r)
+		if err != nil {
+			t.Fatalf("did not get route monitoring message: %v", err)
+		}
+		if msgType == bmpMsgRouteMonitoring {
+			return
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"crypto/md5"
 )
@@ -29,3 +30,23 @@ func generateMacAddressFromID(macAddressID string) string {
 
 	return strings.Join(macAddressString, ":")
 }
+
+var l4Protocols = map[string]uint16{
+	"tcp":  syscall.IPPROTO_TCP,
+	"udp":  syscall.IPPROTO_UDP,
+	"sctp": syscall.IPPROTO_SCTP,
+}
+
+// parseL4Port parses protocol and port given in format <protocol>:<port>.
+func parseL4Port(value string) (uint16, uint16, error) {
+	protocol, port, ok := strings.Cut(value, ":")
+	proto, known := l4Protocols[protocol]
+	if !ok || !known {
+		return 0, 0, fmt.Errorf("port %s must be in format tcp:<port>, udp:<port> or sctp:<port>", value)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return 0, 0, fmt.Errorf("port %s has invalid port number", value)
+	}
+	return proto, uint16(p), nil
+}
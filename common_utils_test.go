@@ -0,0 +1,37 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseL4Port(t *testing.T) {
+	tests := []struct {
+		value    string
+		protocol uint16
+		port     uint16
+		valid    bool
+	}{
+		{"tcp:80", syscall.IPPROTO_TCP, 80, true},
+		{"udp:53", syscall.IPPROTO_UDP, 53, true},
+		{"sctp:3868", syscall.IPPROTO_SCTP, 3868, true},
+		{"tcp:65535", syscall.IPPROTO_TCP, 65535, true},
+		{"tcp:0", 0, 0, false},
+		{"tcp:65536", 0, 0, false},
+		{"tcp:http", 0, 0, false},
+		{"icmp:1", 0, 0, false},
+		{"TCP:80", 0, 0, false},
+		{"80", 0, 0, false},
+		{"tcp:", 0, 0, false},
+	}
+	for _, tt := range tests {
+		protocol, port, err := parseL4Port(tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseL4Port(%q) error = %v, want valid %v", tt.value, err, tt.valid)
+			continue
+		}
+		if protocol != tt.protocol || port != tt.port {
+			t.Errorf("parseL4Port(%q) = %d, %d, want %d, %d", tt.value, protocol, port, tt.protocol, tt.port)
+		}
+	}
+}
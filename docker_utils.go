@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -49,9 +50,10 @@ func advertiseNetworksOnStart(ctx context.Context) {
 
 	for _, network := range networks {
 		log := log.WithField("network.id", network.ID[:11]).WithField("network.name", network.Name)
+		peers := splitList(network.Labels["bgplb_peers"])
 		ipamConfigs := network.IPAM.Config
 		for _, ipam := range ipamConfigs {
-			if err := addAdvertisedSubnet(ctx, network.ID, ipam.Subnet); err == nil {
+			if err := addAdvertisedSubnet(ctx, network.ID, ipam.Subnet, peers); err == nil {
 				log.WithField("subnet", ipam.Subnet).Info("advertiseNetworksOnStart: advertising the subnet")
 			} else {
 				log.WithField("subnet", ipam.Subnet).Errorf("advertiseNetworksOnStart: failed to advertise the subnet: %v", err)
@@ -60,7 +62,7 @@ func advertiseNetworksOnStart(ctx context.Context) {
 	}
 }
 
-func waitContainerHealthy(networkID, endpointID string) bool {
+func waitContainerHealthy(networkID, endpointID, healthMode string) bool {
 	time.Sleep(1 * time.Second)
 	for {
 		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
@@ -86,7 +88,7 @@ func waitContainerHealthy(networkID, endpointID string) bool {
 			container, _ := cli.ContainerInspect(context.TODO(), containerID)
 			log.Infof("waitContainerHealthy, waiting container %s", container.Name)
 			if container.State != nil {
-				if container.State.Health != nil {
+				if container.State.Health != nil && healthMode == healthModeHealthy {
 					if container.State.Health.Status == "healthy" {
 						log.Infof("Container %s healthy, adding BGP route(s)", container.Name)
 						cli.Close()
@@ -116,7 +118,34 @@ func waitContainerHealthy(networkID, endpointID string) bool {
 	}
 }
 
-func delContainerRoutes(containerID string, cli *client.Client) {
+// endpointContainer returns details of the container which has endpoint in network.
+func endpointContainer(networkID, endpointID string) (*types.ContainerJSON, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	network, err := cli.NetworkInspect(context.TODO(), networkID, types.NetworkInspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for containerID, endpoint := range network.Containers {
+		if endpoint.EndpointID != endpointID {
+			continue
+		}
+		container, err := cli.ContainerInspect(context.TODO(), containerID)
+		if err != nil {
+			return nil, err
+		}
+		return &container, nil
+	}
+	return nil, fmt.Errorf("endpoint %s not found from network %s", endpointID, networkID)
+}
+
+// delContainerRoutes removes routes of container and returns how long its traffic
+// should be drained before stopping it, based on options of its networks.
+func delContainerRoutes(containerID string, cli *client.Client) time.Duration {
 	networkFilter := filters.NewArgs()
 	networkFilter.Add("driver", dockerDriverName)
 	options := types.NetworkListOptions{
@@ -125,22 +154,32 @@ func delContainerRoutes(containerID string, cli *client.Client) {
 	networks, err := cli.NetworkList(context.Background(), options)
 	if err != nil {
 		log.Errorf("delContainerRoutes: Error getting networks from Docker: %v\n", err)
-		return
+		return defaultDrainTimeout * time.Second
 	}
 
 	containerInspect, err := cli.ContainerInspect(context.Background(), containerID)
 	if err != nil {
 		log.Errorf("delContainerRoutes: Error getting container details from Docker: %v\n", err)
-		return
+		return defaultDrainTimeout * time.Second
 	}
+	drainTimeout := 0
 	containerNetworks := containerInspect.NetworkSettings.Networks
 	for _, containerNetwork := range containerNetworks {
 		for _, network := range networks {
 			if network.ID == containerNetwork.NetworkID {
 				go delRoute(containerNetwork.NetworkID, containerNetwork.EndpointID)
+
+				timeout := defaultDrainTimeout
+				lbServer.Lock()
+				if n, ok := lbServer.Networks[network.ID]; ok {
+					timeout = n.Options.DrainTimeout
+				}
+				lbServer.Unlock()
+				drainTimeout = max(drainTimeout, timeout)
 			}
 		}
 	}
+	return time.Duration(drainTimeout) * time.Second
 }
 
 func watchDockerEvents(ctx context.Context) {
@@ -177,8 +216,10 @@ func watchDockerEvents(ctx context.Context) {
 				filters.Arg("action", "destroy"),
 			)
 
+			// Health changes of containers update weights of IPVS real servers
+			eventFilters.Add("type", "container")
+			eventFilters.Add("action", string(events.ActionHealthStatus))
 			if SIGUSR2Enabled {
-				eventFilters.Add("type", "container")
 				eventFilters.Add("action", "kill")
 			}
 
@@ -203,6 +244,9 @@ func watchDockerEvents(ctx context.Context) {
 								handleDockerContainerKill(ctx, cli, &event)
 							}
 						}
+						if strings.HasPrefix(string(event.Action), string(events.ActionHealthStatus)) {
+							handleDockerContainerHealth(&event)
+						}
 					}
 
 				case err := <-errors:
@@ -229,8 +273,9 @@ func handleDockerNetworkCreate(ctx context.Context, cli *client.Client, event *e
 	}
 	log = log.WithField("network.name", network.Name)
 	if l, ok := network.Labels["bgplb_advertise"]; ok && l == "true" {
+		peers := splitList(network.Labels["bgplb_peers"])
 		for _, ipam := range network.IPAM.Config {
-			if err := addAdvertisedSubnet(ctx, network.ID, ipam.Subnet); err == nil {
+			if err := addAdvertisedSubnet(ctx, network.ID, ipam.Subnet, peers); err == nil {
 				log.WithField("subnet", ipam.Subnet).Info("handleDockerNetworkCreate: advertising the subnet")
 			} else {
 				log.WithField("subnet", ipam.Subnet).Errorf("handleDockerNetworkCreate: failed to advertise the subnet: %v", err)
@@ -248,16 +293,25 @@ func handleDockerNetworkDestroy(ctx context.Context, event *events.Message) {
 	}
 }
 
+func handleDockerContainerHealth(event *events.Message) {
+	switch event.Action {
+	case events.ActionHealthStatusHealthy:
+		localBalancer.setHealthy(event.Actor.ID, true)
+	case events.ActionHealthStatusUnhealthy:
+		localBalancer.setHealthy(event.Actor.ID, false)
+	}
+}
+
 func handleDockerContainerKill(ctx context.Context, cli *client.Client, event *events.Message) {
 	log := log.WithField("container.id", event.Actor.ID[:11])
 	if event.Actor.Attributes["signal"] == SIGUSR2Number {
 		log.Info("SIGUSR2 signal received. Gracefully drain the load")
-		delContainerRoutes(event.Actor.ID, cli)
+		drainTimeout := delContainerRoutes(event.Actor.ID, cli)
 
 		if SIGUSR2Action == "stop" {
-			log.Info("Stopping the container due to the 'SIGUSR2_ACTION=stop'")
+			log.Infof("Stopping the container after %v due to the 'SIGUSR2_ACTION=stop'", drainTimeout)
 			go func() {
-				time.Sleep(5 * time.Second)
+				time.Sleep(drainTimeout)
 				cli.ContainerStop(ctx, event.Actor.ID, container.StopOptions{Signal: "SIGTERM"})
 			}()
 		}
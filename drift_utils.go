@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const defaultDriftCheckInterval = 30 * time.Second
+
+// localRoute is a host route which the plugin has installed and announces with BGP.
+// Endpoints which share the address are its nexthops. Nexthops on different links
+// make it multipath route which balances flows between the endpoints.
+type localRoute struct {
+	networkID string
+	nexthops  map[string]string
+	dst       *net.IPNet
+	family    apiGoBGP.Family_Afi
+	options   *networkOptions
+	withdrawn bool
+	// peersPending is set when export policy selecting peers of the route could not
+	// be applied. Route must not be announced before that because it would reach all peers.
+	peersPending bool
+	repairs      int
+	lastChange   time.Time
+}
+
+type routeTable struct {
+	routes map[string]*localRoute
+	// updates serializes changes which program kernel routes and announce them so
+	// that backend calls are done without holding the table lock. It is taken
+	// before the table lock.
+	updates sync.Mutex
+	sync.Mutex
+}
+
+var desiredRoutes = &routeTable{routes: make(map[string]*localRoute)}
+
+func (t *routeTable) add(r *localRoute) {
+	t.Lock()
+	defer t.Unlock()
+	r.lastChange = time.Now()
+	if existing, ok := t.routes[r.dst.String()]; ok {
+		// Another endpoint added same route meanwhile
+		for endpointID, linkName := range r.nexthops {
+			existing.nexthops[endpointID] = linkName
+		}
+		return
+	}
+	t.routes[r.dst.String()] = r
+}
+
+// addNexthop adds endpoint as nexthop of existing route to dst and returns the route.
+// Nil is returned if there is no route to dst yet.
+func (t *routeTable) addNexthop(dst *net.IPNet, endpointID, linkName string) *localRoute {
+	t.Lock()
+	defer t.Unlock()
+	r, ok := t.routes[dst.String()]
+	if !ok {
+		return nil
+	}
+	r.nexthops[endpointID] = linkName
+	r.lastChange = time.Now()
+	return r
+}
+
+// delNexthop removes endpoint from nexthops of its routes. Routes which other
+// endpoints still use are returned as shared and routes which were left without
+// nexthops as orphaned. Orphaned routes are removed from the table at the same
+// time so that endpoint which gets the address later adds new route.
+func (t *routeTable) delNexthop(endpointID string) (shared, orphaned []*localRoute) {
+	t.Lock()
+	defer t.Unlock()
+	for key, r := range t.routes {
+		if _, ok := r.nexthops[endpointID]; !ok {
+			continue
+		}
+		delete(r.nexthops, endpointID)
+		r.lastChange = time.Now()
+		if len(r.nexthops) > 0 {
+			shared = append(shared, r)
+		} else {
+			delete(t.routes, key)
+			orphaned = append(orphaned, r)
+		}
+	}
+	return shared, orphaned
+}
+
+// links returns names of links which route uses.
+func (t *routeTable) links(r *localRoute) []string {
+	t.Lock()
+	defer t.Unlock()
+	return r.linkNames()
+}
+
+// forgetNetwork removes routes of network from desired state and returns them.
+func (t *routeTable) forgetNetwork(networkID string) []*localRoute {
+	t.Lock()
+	defer t.Unlock()
+	routes := []*localRoute{}
+	for key, r := range t.routes {
+		if r.networkID == networkID {
+			delete(t.routes, key)
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// contains tells if route is still in desired state. Caller must hold the lock.
+func (t *routeTable) contains(r *localRoute) bool {
+	return t.routes[r.dst.String()] == r
+}
+
+func (t *routeTable) snapshot() []*localRoute {
+	t.Lock()
+	defer t.Unlock()
+	routes := make([]*localRoute, 0, len(t.routes))
+	for _, r := range t.routes {
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// linkNames returns sorted names of links used by nexthops of route. Caller must
+// hold lock of desiredRoutes.
+func (r *localRoute) linkNames() []string {
+	names := []string{}
+	for _, name := range r.nexthops {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// endpointIDs returns sorted IDs of endpoints which are nexthops of route. Caller must
+// hold lock of desiredRoutes.
+func (r *localRoute) endpointIDs() []string {
+	ids := []string{}
+	for id := range r.nexthops {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// kernelRoute returns route to dst through those links of route which exist. Route
+// through multiple links uses endpoint address as onlink gateway on each of them
+// because kernel does not balance IPv6 routes without gateway.
+func (r *localRoute) kernelRoute() (*netlink.Route, error) {
+	links := []netlink.Link{}
+	for _, name := range desiredRoutes.links(r) {
+		if link, err := netlink.LinkByName(name); err == nil {
+			links = append(links, link)
+		}
+	}
+	switch len(links) {
+	case 0:
+		return nil, fmt.Errorf("no link of route %s exists", r.dst)
+	case 1:
+		return &netlink.Route{Dst: r.dst, LinkIndex: links[0].Attrs().Index}, nil
+	}
+	route := &netlink.Route{Dst: r.dst}
+	for _, link := range links {
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{
+			LinkIndex: link.Attrs().Index,
+			Gw:        r.dst.IP,
+			Flags:     int(netlink.FLAG_ONLINK),
+		})
+	}
+	return route, nil
+}
+
+// program installs route to kernel, replacing nexthops of existing route to dst.
+func (r *localRoute) program() error {
+	route, err := r.kernelRoute()
+	if err != nil {
+		return err
+	}
+	return netlink.RouteReplace(route)
+}
+
+func routeLinkIndexes(route *netlink.Route) []int {
+	if len(route.MultiPath) == 0 {
+		return []int{route.LinkIndex}
+	}
+	indexes := []int{}
+	for _, nh := range route.MultiPath {
+		indexes = append(indexes, nh.LinkIndex)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+func (r *localRoute) prefixLen() int {
+	ones, _ := r.dst.Mask.Size()
+	return ones
+}
+
+// announce makes route reachable from outside of this host as configured for its network.
+// When the network needs single owner for its routes this host only becomes candidate
+// and the route is announced once this host has been elected.
+func (r *localRoute) announce() error {
+	if r.options.elected() {
+		return elections.join(r)
+	}
+	return r.takeover()
+}
+
+func (r *localRoute) unannounce() error {
+	if r.options.elected() {
+		return elections.leave(r)
+	}
+	return r.release()
+}
+
+// takeover announces route without election.
+func (r *localRoute) takeover() error {
+	switch r.options.AnnounceMode {
+	case announceModeNone:
+		return nil
+	case announceModeL2:
+		return l2Announce(r.options.L2Interface, r.dst.IP)
+	}
+	return addBgpRoute(r.dst.IP.String(), r.prefixLen(), r.family, r.options)
+}
+
+func (r *localRoute) release() error {
+	switch r.options.AnnounceMode {
+	case announceModeNone:
+		return nil
+	case announceModeL2:
+		return l2Release(r.options.L2Interface, r.dst.IP)
+	}
+	return delBgpRoute(r.dst.IP.String(), r.prefixLen(), r.family)
+}
+
+// removeRoute withdraws announcement and kernel route of route which has been
+// removed from desired state. Caller must hold updates lock of desiredRoutes.
+func removeRoute(r *localRoute) {
+	if err := clearPrefixPeers(r.dst.String()); err != nil {
+		log.Errorf("Cannot clear peer selection of %s: %v", r.dst, err)
+	}
+	desiredRoutes.Lock()
+	withdrawn := r.withdrawn
+	desiredRoutes.Unlock()
+	if !withdrawn {
+		if err := r.unannounce(); err != nil {
+			log.Errorf("Cannot withdraw BGP route %s: %v", r.dst, err)
+		}
+	}
+	if err := netlink.RouteDel(&netlink.Route{Dst: r.dst}); err != nil {
+		log.Errorf("Cannot remove local route to: %v , Error: %v", r.dst.IP, err)
+	}
+}
+
+// forgetNetworkRoutes removes routes which are left from deleted network.
+func forgetNetworkRoutes(networkID string) {
+	desiredRoutes.updates.Lock()
+	defer desiredRoutes.updates.Unlock()
+	for _, r := range desiredRoutes.forgetNetwork(networkID) {
+		log.Infof("Removing route %s of deleted network %s", r.dst, networkID)
+		removeRoute(r)
+	}
+}
+
+// withdraw removes the BGP announcement of route while keeping it in the desired state
+// so that it can be announced again once the dataplane has been fixed. Caller must
+// hold updates lock of desiredRoutes.
+func (r *localRoute) withdraw(reason string) {
+	desiredRoutes.Lock()
+	if r.withdrawn {
+		desiredRoutes.Unlock()
+		return
+	}
+	links := strings.Join(r.linkNames(), ",")
+	desiredRoutes.Unlock()
+
+	log.Warnf("Route drift detected for %s on %s (%s), withdrawing BGP route", r.dst, links, reason)
+	if err := r.unannounce(); err != nil {
+		log.Errorf("Cannot withdraw BGP route %s: %v", r.dst, err)
+		return
+	}
+	desiredRoutes.Lock()
+	r.withdrawn = true
+	r.lastChange = time.Now()
+	desiredRoutes.Unlock()
+}
+
+// restore announces route again once its dataplane is back. Caller must hold
+// updates lock of desiredRoutes.
+func (r *localRoute) restore() {
+	desiredRoutes.Lock()
+	if !r.withdrawn {
+		desiredRoutes.Unlock()
+		return
+	}
+	peersPending := r.peersPending
+	links := strings.Join(r.linkNames(), ",")
+	desiredRoutes.Unlock()
+
+	if peersPending {
+		if err := setPrefixPeers(r.dst.String(), r.options.Peers); err != nil {
+			log.Errorf("Cannot select peers for %s, keeping BGP route withdrawn: %v", r.dst, err)
+			return
+		}
+		desiredRoutes.Lock()
+		r.peersPending = false
+		desiredRoutes.Unlock()
+	}
+	log.Infof("Local route %s on %s is back, announcing BGP route", r.dst, links)
+	if err := r.announce(); err != nil {
+		log.Errorf("Cannot announce BGP route %s: %v", r.dst, err)
+		return
+	}
+	desiredRoutes.Lock()
+	r.withdrawn = false
+	r.lastChange = time.Now()
+	desiredRoutes.Unlock()
+}
+
+// checkRoute compares one desired route against the kernel. A missing route, or one
+// with wrong nexthops, is re-added when some of its links still exist; otherwise the
+// BGP route is withdrawn.
+func checkRoute(r *localRoute) {
+	desiredRoutes.updates.Lock()
+	defer desiredRoutes.updates.Unlock()
+	// Route may have been removed after it was looked up
+	desiredRoutes.Lock()
+	current := desiredRoutes.contains(r)
+	desiredRoutes.Unlock()
+	if !current {
+		return
+	}
+
+	want, err := r.kernelRoute()
+	if err != nil {
+		r.withdraw("link is missing")
+		return
+	}
+
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Dst: r.dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		log.Errorf("checkRoute: failed to list routes to %s: %v", r.dst, err)
+		return
+	}
+
+	if len(existing) == 0 || !slices.Equal(routeLinkIndexes(&existing[0]), routeLinkIndexes(want)) {
+		log.Warnf("Local route %s is missing or has wrong nexthops, repairing it", r.dst)
+		if err := netlink.RouteReplace(want); err != nil {
+			r.withdraw("route repair failed: " + err.Error())
+			return
+		}
+		desiredRoutes.Lock()
+		r.repairs++
+		r.lastChange = time.Now()
+		desiredRoutes.Unlock()
+	}
+	r.restore()
+}
+
+func checkAllRoutes() {
+	for _, r := range desiredRoutes.snapshot() {
+		checkRoute(r)
+	}
+}
+
+func handleRouteUpdate(u netlink.RouteUpdate) {
+	if u.Type != unix.RTM_DELROUTE || u.Dst == nil {
+		return
+	}
+	desiredRoutes.Lock()
+	r, ok := desiredRoutes.routes[u.Dst.String()]
+	desiredRoutes.Unlock()
+	if ok {
+		checkRoute(r)
+	}
+}
+
+func handleLinkUpdate(u netlink.LinkUpdate) {
+	name := u.Attrs().Name
+	if u.Header.Type != unix.RTM_DELLINK || !(strings.HasPrefix(name, bridgeNamePrefix+"-") || strings.HasPrefix(name, vethNamePrefix)) {
+		return
+	}
+	for _, r := range desiredRoutes.snapshot() {
+		if slices.Contains(desiredRoutes.links(r), name) {
+			checkRoute(r)
+		}
+	}
+}
+
+// watchRouteDrift keeps the kernel routes of bgplb-* links and routed veths in sync with the routes
+// announced with BGP. It reacts to netlink route/link updates immediately and
+// re-checks everything periodically in case some updates were missed.
+func watchRouteDrift(ctx context.Context) {
+	interval := defaultDriftCheckInterval
+	if v := os.Getenv("DRIFT_CHECK_INTERVAL"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			log.Errorf("Environment variable DRIFT_CHECK_INTERVAL value is invalid, using default %v", defaultDriftCheckInterval)
+		} else {
+			interval = time.Duration(seconds) * time.Second
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	routeUpdates := make(chan netlink.RouteUpdate)
+	if err := netlink.RouteSubscribe(routeUpdates, done); err != nil {
+		log.Errorf("watchRouteDrift: cannot subscribe to route updates: %v", err)
+		routeUpdates = nil
+	}
+	linkUpdates := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(linkUpdates, done); err != nil {
+		log.Errorf("watchRouteDrift: cannot subscribe to link updates: %v", err)
+		linkUpdates = nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case u, ok := <-routeUpdates:
+			if !ok {
+				log.Warn("watchRouteDrift: route update subscription closed, relying on periodic checks")
+				routeUpdates = nil
+				break
+			}
+			handleRouteUpdate(u)
+		case u, ok := <-linkUpdates:
+			if !ok {
+				log.Warn("watchRouteDrift: link update subscription closed, relying on periodic checks")
+				linkUpdates = nil
+				break
+			}
+			handleLinkUpdate(u)
+		case <-ticker.C:
+			checkAllRoutes()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+	"github.com/vishvananda/netlink"
+)
+
+func testRouteLink(t *testing.T, name string) netlink.Link {
+	t.Helper()
+	link := testVeth(t, name)
+	for _, n := range []string{name, name + "p"} {
+		l, err := netlink.LinkByName(n)
+		if err == nil {
+			err = netlink.LinkSetUp(l)
+		}
+		if err != nil {
+			t.Fatalf("cannot set %s up: %v", n, err)
+		}
+	}
+	return link
+}
+
+func kernelRouteExists(t *testing.T, dst *net.IPNet) bool {
+	t.Helper()
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		t.Fatalf("RouteListFiltered(%s) error = %v", dst, err)
+	}
+	return len(routes) > 0
+}
+
+func setupDriftTest(t *testing.T) *fakeAnnouncer {
+	fake := newFakeAnnouncer()
+	bgpAnnouncer = fake
+	desiredRoutes = &routeTable{routes: make(map[string]*localRoute)}
+	t.Cleanup(func() {
+		bgpAnnouncer = nil
+		desiredRoutes = &routeTable{routes: make(map[string]*localRoute)}
+	})
+	return fake
+}
+
+func TestDriftRepair(t *testing.T) {
+	fake := setupDriftTest(t)
+	link := testRouteLink(t, "bgplbtest1")
+	_, dst, _ := net.ParseCIDR("10.255.0.1/32")
+
+	addLocalRoute("net1", "ep1", link, dst, apiGoBGP.Family_AFI_IP, defaultNetworkOptions())
+	if !kernelRouteExists(t, dst) || fake.announced[dst.String()] == nil {
+		t.Fatalf("addLocalRoute() did not install and announce %s", dst)
+	}
+
+	// Route removed behind our back is added again and stays announced
+	if err := netlink.RouteDel(&netlink.Route{Dst: dst, LinkIndex: link.Attrs().Index}); err != nil {
+		t.Fatalf("RouteDel(%s) error = %v", dst, err)
+	}
+	checkAllRoutes()
+	r := desiredRoutes.routes[dst.String()]
+	if !kernelRouteExists(t, dst) || r.repairs != 1 || r.withdrawn || fake.announced[dst.String()] == nil {
+		t.Errorf("checkAllRoutes() did not repair %s: repairs %d, withdrawn %v", dst, r.repairs, r.withdrawn)
+	}
+
+	// Without link the route cannot be repaired and is withdrawn
+	if err := netlink.LinkDel(link); err != nil {
+		t.Fatalf("LinkDel() error = %v", err)
+	}
+	checkAllRoutes()
+	if !r.withdrawn || fake.announced[dst.String()] != nil {
+		t.Errorf("checkAllRoutes() kept %s announced without link", dst)
+	}
+
+	// Route is added and announced again once the link is back
+	testRouteLink(t, "bgplbtest1")
+	checkAllRoutes()
+	if !kernelRouteExists(t, dst) || r.withdrawn || fake.announced[dst.String()] == nil {
+		t.Errorf("checkAllRoutes() did not restore %s, withdrawn %v", dst, r.withdrawn)
+	}
+
+	delLocalRoutes("ep1")
+	if kernelRouteExists(t, dst) || fake.announced[dst.String()] != nil || len(desiredRoutes.routes) != 0 {
+		t.Errorf("delLocalRoutes() left %s behind", dst)
+	}
+}
+
+func TestDriftSharedRoute(t *testing.T) {
+	fake := setupDriftTest(t)
+	link := testRouteLink(t, "bgplbtest1")
+	_, dst, _ := net.ParseCIDR("10.255.0.1/32")
+
+	addLocalRoute("net1", "ep1", link, dst, apiGoBGP.Family_AFI_IP, defaultNetworkOptions())
+	addLocalRoute("net1", "ep2", link, dst, apiGoBGP.Family_AFI_IP, defaultNetworkOptions())
+	delLocalRoutes("ep1")
+	if !kernelRouteExists(t, dst) || fake.announced[dst.String()] == nil {
+		t.Errorf("delLocalRoutes() removed %s which other endpoint uses", dst)
+	}
+
+	// Route which is removed after the lookup is not checked anymore
+	r := desiredRoutes.routes[dst.String()]
+	delLocalRoutes("ep2")
+	checkRoute(r)
+	if kernelRouteExists(t, dst) || fake.announced[dst.String()] != nil || r.withdrawn {
+		t.Errorf("checkRoute() changed removed route %s", dst)
+	}
+
+	// Endpoint which gets the address again adds a new route
+	addLocalRoute("net1", "ep3", link, dst, apiGoBGP.Family_AFI_IP, defaultNetworkOptions())
+	if !kernelRouteExists(t, dst) || fake.announced[dst.String()] == nil {
+		t.Errorf("addLocalRoute() after removal did not install and announce %s", dst)
+	}
+}
+
+func TestForgetNetworkRoutes(t *testing.T) {
+	fake := setupDriftTest(t)
+	link := testRouteLink(t, "bgplbtest1")
+	other := testRouteLink(t, "bgplbtest2")
+	_, dst, _ := net.ParseCIDR("10.255.0.1/32")
+	_, otherDst, _ := net.ParseCIDR("10.255.0.2/32")
+
+	addLocalRoute("net1", "ep1", link, dst, apiGoBGP.Family_AFI_IP, defaultNetworkOptions())
+	addLocalRoute("net2", "ep2", other, otherDst, apiGoBGP.Family_AFI_IP, defaultNetworkOptions())
+	// Route of endpoint which Docker never removed is withdrawn with its bridge
+	netlink.LinkDel(link)
+	checkAllRoutes()
+
+	forgetNetworkRoutes("net1")
+	if _, ok := desiredRoutes.routes[dst.String()]; ok {
+		t.Errorf("forgetNetworkRoutes() kept %s of deleted network", dst)
+	}
+	if _, ok := desiredRoutes.routes[otherDst.String()]; !ok || fake.announced[otherDst.String()] == nil {
+		t.Errorf("forgetNetworkRoutes() removed %s of other network", otherDst)
+	}
+}
+
+func kernelRouteLinks(t *testing.T, dst *net.IPNet) []int {
+	t.Helper()
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: dst}, netlink.RT_FILTER_DST)
+	if err != nil || len(routes) != 1 {
+		t.Fatalf("RouteListFiltered(%s) = %v, %v, want one route", dst, routes, err)
+	}
+	return routeLinkIndexes(&routes[0])
+}
+
+func TestLocalECMP(t *testing.T) {
+	fake := setupDriftTest(t)
+	link1 := testRouteLink(t, "bgplbtest1")
+	link2 := testRouteLink(t, "bgplbtest2")
+	_, dst, _ := net.ParseCIDR("10.255.0.1/32")
+	options, err := parseNetworkOptions(testGenericOptions(map[string]string{optDataplane: dataplaneRouted}))
+	if err != nil {
+		t.Fatalf("parseNetworkOptions() error = %v", err)
+	}
+
+	addLocalRoute("net1", "ep1", link1, dst, apiGoBGP.Family_AFI_IP, options)
+	addLocalRoute("net1", "ep2", link2, dst, apiGoBGP.Family_AFI_IP, options)
+	want := []int{link1.Attrs().Index, link2.Attrs().Index}
+	if got := kernelRouteLinks(t, dst); !slices.Equal(got, want) {
+		t.Errorf("route %s uses links %v, want %v", dst, got, want)
+	}
+
+	// Multipath route matches desired state and is not repaired
+	checkAllRoutes()
+	if r := desiredRoutes.routes[dst.String()]; r.repairs != 0 || r.withdrawn {
+		t.Errorf("checkAllRoutes() changed multipath route: repairs %d, withdrawn %v", r.repairs, r.withdrawn)
+	}
+
+	delLocalRoutes("ep1")
+	if got := kernelRouteLinks(t, dst); !slices.Equal(got, []int{link2.Attrs().Index}) || fake.announced[dst.String()] == nil {
+		t.Errorf("route %s after delLocalRoutes() uses links %v, announced %v", dst, got, fake.announced[dst.String()] != nil)
+	}
+}
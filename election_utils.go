@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultElectionPort     = 7947
+	defaultElectionInterval = time.Second
+	// Remote candidate is considered dead when it has not been heard within this many intervals
+	electionDeadIntervals = 3
+)
+
+// electionMessage is sent periodically by every plugin instance to other hosts. It
+// lists all VIPs for which this host has a healthy endpoint with their priorities.
+// Hosts with overload protection also list prefixes which they announce with BGP.
+type electionMessage struct {
+	RouterID string
+	// Sequence grows with every message of the sender so that captured messages
+	// cannot be replayed
+	Sequence  uint64
+	VIPs      map[string]int
+	Announced []string `json:",omitempty"`
+	// Overloaded hosts may withdraw their announcements at any time
+	Overloaded bool `json:",omitempty"`
+}
+
+// electionPacket is sent on the wire. MAC is HMAC-SHA256 of Message with ELECTION_KEY.
+type electionPacket struct {
+	Message json.RawMessage
+	MAC     []byte `json:",omitempty"`
+}
+
+type remoteCandidate struct {
+	priority int
+	lastSeen time.Time
+}
+
+type electionCandidate struct {
+	route  *localRoute
+	leader bool
+	joined time.Time
+}
+
+// vipElection elects one host to own each VIP. Highest priority wins and ties are
+// broken with the highest router ID.
+type vipElection struct {
+	ctx      context.Context
+	port     int
+	conn     *net.UDPConn
+	targets  []*net.UDPAddr
+	interval time.Duration
+	// key authenticates messages when ELECTION_KEY is set
+	key []byte
+	// peersOnly accepts messages only from hosts listed in ELECTION_PEERS
+	peersOnly bool
+	// sequence is the sequence number of the latest message sent by this host
+	sequence uint64
+	// sequences are the latest sequence numbers received from other hosts
+	sequences  map[string]uint64
+	candidates map[string]*electionCandidate
+	remotes    map[string]map[string]*remoteCandidate
+	changed    chan struct{}
+	running    atomic.Bool
+	startLock  sync.Mutex
+	sync.Mutex
+}
+
+var elections = &vipElection{
+	sequences:  make(map[string]uint64),
+	candidates: make(map[string]*electionCandidate),
+	remotes:    make(map[string]map[string]*remoteCandidate),
+	changed:    make(chan struct{}, 1),
+}
+
+// loadElectionConfig reads configuration of election messages. Socket is opened only
+// when some network needs elections, see start.
+func loadElectionConfig(ctx context.Context) error {
+	elections.ctx = ctx
+	elections.port = defaultElectionPort
+	if v := os.Getenv("ELECTION_PORT"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p <= 0 || p > 65535 {
+			return fmt.Errorf("Environment variable ELECTION_PORT value is invalid\r\n")
+		}
+		elections.port = p
+	}
+
+	elections.interval = defaultElectionInterval
+	if v := os.Getenv("ELECTION_INTERVAL"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("Environment variable ELECTION_INTERVAL value is invalid\r\n")
+		}
+		elections.interval = time.Duration(ms) * time.Millisecond
+	}
+
+	for _, peer := range splitList(os.Getenv("ELECTION_PEERS")) {
+		ip := net.ParseIP(peer)
+		if ip == nil {
+			return fmt.Errorf("Environment variable ELECTION_PEERS value is invalid, %s is not an IP address\r\n", peer)
+		}
+		elections.targets = append(elections.targets, &net.UDPAddr{IP: ip, Port: elections.port})
+	}
+	elections.peersOnly = len(elections.targets) > 0
+	if !elections.peersOnly {
+		elections.targets = []*net.UDPAddr{{IP: net.IPv4bcast, Port: elections.port}}
+	}
+	elections.key = []byte(os.Getenv("ELECTION_KEY"))
+	return nil
+}
+
+// start opens the UDP socket used to exchange election messages with the plugin
+// instances on other hosts listed in ELECTION_PEERS and starts sending them.
+// Without ELECTION_PEERS messages are broadcasted to the local network. Calling it
+// again when elections are already running does nothing.
+func (e *vipElection) start() error {
+	e.startLock.Lock()
+	defer e.startLock.Unlock()
+	if e.isRunning() {
+		return nil
+	}
+	// Anyone who can send messages could take over every VIP
+	if len(e.key) == 0 && !e.peersOnly {
+		return fmt.Errorf("VIP election needs ELECTION_KEY or ELECTION_PEERS so that messages of other hosts can be trusted")
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(e.ctx, "udp", fmt.Sprintf(":%d", e.port))
+	if err != nil {
+		return fmt.Errorf("cannot listen VIP election messages on port %d: %w", e.port, err)
+	}
+	e.conn = conn.(*net.UDPConn)
+	e.sequence = uint64(time.Now().UnixNano())
+	go e.listen(e.ctx)
+	go e.run(e.ctx)
+	e.running.Store(true)
+	log.Infof("Listening VIP election messages on port %d", e.port)
+	return nil
+}
+
+func (e *vipElection) isRunning() bool {
+	return e.running.Load()
+}
+
+// join makes this host a candidate to own the VIP of route.
+func (e *vipElection) join(r *localRoute) error {
+	if !e.isRunning() {
+		return fmt.Errorf("cannot elect owner of %s, leader election is not running", r.dst)
+	}
+	e.Lock()
+	if _, ok := e.candidates[r.dst.String()]; !ok {
+		e.candidates[r.dst.String()] = &electionCandidate{route: r, joined: time.Now()}
+	}
+	e.Unlock()
+	e.notify()
+	return nil
+}
+
+// leave removes candidacy of this host and releases the VIP if this host owns it.
+func (e *vipElection) leave(r *localRoute) error {
+	e.Lock()
+	c, ok := e.candidates[r.dst.String()]
+	delete(e.candidates, r.dst.String())
+	e.Unlock()
+	if !ok {
+		return nil
+	}
+	// Other hosts take over immediately when they hear that we left
+	e.notify()
+	if c.leader {
+		log.Infof("Releasing ownership of %s", r.dst)
+		return r.release()
+	}
+	return nil
+}
+
+// leader returns router ID of the host which owns the VIP in prefix.
+func (e *vipElection) leader(prefix string) string {
+	e.Lock()
+	defer e.Unlock()
+	c, ok := e.candidates[prefix]
+	if ok && c.leader {
+		return routerID
+	}
+	best, _ := e.bestRemote(prefix)
+	return best
+}
+
+func (e *vipElection) notify() {
+	select {
+	case e.changed <- struct{}{}:
+	default:
+	}
+}
+
+// bestRemote returns router ID and priority of the alive remote candidate which would
+// win the election of prefix. Caller must hold the lock.
+func (e *vipElection) bestRemote(prefix string) (string, int) {
+	bestID, bestPriority := "", -1
+	deadline := time.Now().Add(-electionDeadIntervals * e.interval)
+	for id, c := range e.remotes[prefix] {
+		if c.lastSeen.Before(deadline) {
+			continue
+		}
+		if bestID == "" || isBetterCandidate(id, c.priority, bestID, bestPriority) {
+			bestID, bestPriority = id, c.priority
+		}
+	}
+	return bestID, bestPriority
+}
+
+func isBetterCandidate(id string, priority int, otherID string, otherPriority int) bool {
+	if priority != otherPriority {
+		return priority > otherPriority
+	}
+	return bytes.Compare(net.ParseIP(id).To16(), net.ParseIP(otherID).To16()) > 0
+}
+
+// priority returns priority of this host for the VIP. Overloaded host keeps the VIP
+// only when no other host is available.
+func (c *electionCandidate) priority() int {
+	if isOverloaded() {
+		return 0
+	}
+	return c.route.options.Priority
+}
+
+// evaluate takes or releases ownership of local candidates based on the latest
+// messages received from other hosts.
+func (e *vipElection) evaluate() {
+	e.Lock()
+	defer e.Unlock()
+	for prefix, c := range e.candidates {
+		remoteID, remotePriority := e.bestRemote(prefix)
+		leader := remoteID == "" || isBetterCandidate(routerID, c.priority(), remoteID, remotePriority)
+		if leader == c.leader {
+			continue
+		}
+		// New candidate must hear from other hosts before it can claim the VIP
+		if leader && time.Since(c.joined) < 2*e.interval {
+			continue
+		}
+		if leader {
+			log.Infof("Elected as owner of %s", prefix)
+			if err := c.route.takeover(); err != nil {
+				log.Errorf("Cannot take ownership of %s: %v", prefix, err)
+				continue
+			}
+		} else {
+			log.Infof("Host %s took ownership of %s", remoteID, prefix)
+			if err := c.route.release(); err != nil {
+				log.Errorf("Cannot release ownership of %s: %v", prefix, err)
+				continue
+			}
+		}
+		c.leader = leader
+	}
+}
+
+// mac returns HMAC-SHA256 of message with ELECTION_KEY.
+func (e *vipElection) mac(message []byte) []byte {
+	h := hmac.New(sha256.New, e.key)
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+// seal encodes msg to packet which is sent to other hosts.
+func (e *vipElection) seal(msg *electionMessage) ([]byte, error) {
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	packet := &electionPacket{Message: message}
+	if len(e.key) > 0 {
+		packet.MAC = e.mac(message)
+	}
+	return json.Marshal(packet)
+}
+
+// open decodes packet received from address from. Packets from hosts which are not in
+// ELECTION_PEERS, when it is set, and packets without valid MAC, when ELECTION_KEY is
+// set, are rejected.
+func (e *vipElection) open(data []byte, from net.IP) (*electionMessage, error) {
+	if e.peersOnly && !e.isPeer(from) {
+		return nil, fmt.Errorf("sender is not listed in ELECTION_PEERS")
+	}
+	packet := &electionPacket{}
+	if err := json.Unmarshal(data, packet); err != nil {
+		return nil, err
+	}
+	if len(e.key) > 0 && !hmac.Equal(packet.MAC, e.mac(packet.Message)) {
+		return nil, fmt.Errorf("invalid message authentication code")
+	}
+	msg := &electionMessage{}
+	if err := json.Unmarshal(packet.Message, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (e *vipElection) isPeer(ip net.IP) bool {
+	for _, target := range e.targets {
+		if target.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *vipElection) send() {
+	msg := &electionMessage{RouterID: routerID, VIPs: make(map[string]int)}
+	if overload != nil {
+		msg.Announced = overload.announced()
+		msg.Overloaded = isOverloaded()
+	}
+	e.Lock()
+	for prefix, c := range e.candidates {
+		msg.VIPs[prefix] = c.priority()
+	}
+	e.sequence++
+	msg.Sequence = e.sequence
+	e.Unlock()
+
+	data, err := e.seal(msg)
+	if err != nil {
+		log.Errorf("vipElection: failed to encode message: %v", err)
+		return
+	}
+	for _, target := range e.targets {
+		if _, err := e.conn.WriteToUDP(data, target); err != nil {
+			log.Debugf("vipElection: failed to send message to %s: %v", target, err)
+		}
+	}
+}
+
+// receive records candidacies of the host which sent msg. VIPs which are missing
+// from the message are not candidates on that host anymore. Messages which are not
+// newer than the previous one from same host are ignored.
+func (e *vipElection) receive(msg *electionMessage) {
+	if msg.RouterID == routerID || net.ParseIP(msg.RouterID) == nil {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	if last, ok := e.sequences[msg.RouterID]; ok && msg.Sequence <= last {
+		log.Debugf("vipElection: ignoring old message %d from %s", msg.Sequence, msg.RouterID)
+		return
+	}
+	e.sequences[msg.RouterID] = msg.Sequence
+	now := time.Now()
+	remoteAnnouncers.update(msg.RouterID, msg.Announced, msg.Overloaded, now)
+	for prefix, remotes := range e.remotes {
+		if _, ok := msg.VIPs[prefix]; !ok {
+			delete(remotes, msg.RouterID)
+		}
+	}
+	for prefix, priority := range msg.VIPs {
+		if e.remotes[prefix] == nil {
+			e.remotes[prefix] = make(map[string]*remoteCandidate)
+		}
+		e.remotes[prefix][msg.RouterID] = &remoteCandidate{priority: priority, lastSeen: now}
+	}
+}
+
+func (e *vipElection) listen(ctx context.Context) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := e.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("vipElection: failed to receive message: %v", err)
+			continue
+		}
+		msg, err := e.open(buf[:n], from.IP)
+		if err != nil {
+			log.Warnf("vipElection: ignoring message from %s: %v", from, err)
+			continue
+		}
+		e.receive(msg)
+		e.evaluate()
+	}
+}
+
+// run exchanges election messages with other hosts and keeps ownership of local
+// candidate VIPs up to date.
+func (e *vipElection) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.changed:
+		case <-ctx.Done():
+			e.conn.Close()
+			return
+		}
+		e.send()
+		e.evaluate()
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsBetterCandidate(t *testing.T) {
+	tests := []struct {
+		id            string
+		priority      int
+		otherID       string
+		otherPriority int
+		want          bool
+	}{
+		{"192.0.2.1", 200, "192.0.2.2", 100, true},
+		{"192.0.2.2", 100, "192.0.2.1", 200, false},
+		{"192.0.2.2", 100, "192.0.2.1", 100, true},
+		{"192.0.2.1", 100, "192.0.2.2", 100, false},
+		{"192.0.2.10", 100, "192.0.2.9", 100, true},
+		{"192.0.2.1", 100, "192.0.2.1", 100, false},
+		{"192.0.2.1", 0, "192.0.2.2", -1, true},
+	}
+	for _, tt := range tests {
+		if got := isBetterCandidate(tt.id, tt.priority, tt.otherID, tt.otherPriority); got != tt.want {
+			t.Errorf("isBetterCandidate(%s, %d, %s, %d) = %v, want %v", tt.id, tt.priority, tt.otherID, tt.otherPriority, got, tt.want)
+		}
+	}
+}
+
+func TestVipElectionEvaluate(t *testing.T) {
+	routerID = "192.0.2.2"
+	defer func() { routerID = "" }()
+
+	type remote struct {
+		id       string
+		priority int
+		age      time.Duration
+	}
+	tests := []struct {
+		name     string
+		priority int
+		joined   time.Duration
+		leader   bool
+		remotes  []remote
+		want     bool
+	}{
+		{"alone", 100, time.Minute, false, nil, true},
+		{"new candidate waits for other hosts", 100, 0, false, nil, false},
+		{"higher priority remote", 100, time.Minute, true, []remote{{"192.0.2.1", 200, 0}}, false},
+		{"lower priority remote", 100, time.Minute, false, []remote{{"192.0.2.3", 50, 0}}, true},
+		{"tie is won by higher router id", 100, time.Minute, false, []remote{{"192.0.2.1", 100, 0}}, true},
+		{"tie is lost to higher router id", 100, time.Minute, true, []remote{{"192.0.2.3", 100, 0}}, false},
+		{"dead remote is ignored", 100, time.Minute, false, []remote{{"192.0.2.3", 200, 4 * time.Second}}, true},
+		{"best of alive remotes", 100, time.Minute, true, []remote{{"192.0.2.1", 50, 0}, {"192.0.2.3", 150, 0}}, false},
+	}
+	for _, tt := range tests {
+		_, dst, _ := net.ParseCIDR("10.0.0.1/32")
+		options := defaultNetworkOptions()
+		options.AnnounceMode = announceModeNone
+		options.Priority = tt.priority
+		e := &vipElection{
+			interval: time.Second,
+			candidates: map[string]*electionCandidate{
+				dst.String(): {route: &localRoute{dst: dst, options: options}, leader: tt.leader, joined: time.Now().Add(-tt.joined)},
+			},
+			remotes: map[string]map[string]*remoteCandidate{dst.String(): {}},
+		}
+		for _, r := range tt.remotes {
+			e.remotes[dst.String()][r.id] = &remoteCandidate{priority: r.priority, lastSeen: time.Now().Add(-r.age)}
+		}
+		e.evaluate()
+		if got := e.candidates[dst.String()].leader; got != tt.want {
+			t.Errorf("%s: leader = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVipElectionReceive(t *testing.T) {
+	routerID = "192.0.2.2"
+	defer func() { routerID = "" }()
+
+	e := &vipElection{interval: time.Second, sequences: make(map[string]uint64), remotes: make(map[string]map[string]*remoteCandidate)}
+	e.receive(&electionMessage{RouterID: "192.0.2.1", Sequence: 1, VIPs: map[string]int{"10.0.0.1/32": 100, "10.0.0.2/32": 50}})
+	e.receive(&electionMessage{RouterID: "192.0.2.1", Sequence: 2, VIPs: map[string]int{"10.0.0.1/32": 100}})
+	e.receive(&electionMessage{RouterID: routerID, Sequence: 3, VIPs: map[string]int{"10.0.0.2/32": 200}})
+	e.receive(&electionMessage{RouterID: "invalid", Sequence: 3, VIPs: map[string]int{"10.0.0.2/32": 200}})
+	// Replayed message is ignored
+	e.receive(&electionMessage{RouterID: "192.0.2.1", Sequence: 1, VIPs: map[string]int{"10.0.0.1/32": 100, "10.0.0.2/32": 50}})
+
+	if id, priority := e.bestRemote("10.0.0.1/32"); id != "192.0.2.1" || priority != 100 {
+		t.Errorf("bestRemote(10.0.0.1/32) = %s, %d, want 192.0.2.1, 100", id, priority)
+	}
+	if id, _ := e.bestRemote("10.0.0.2/32"); id != "" {
+		t.Errorf("bestRemote(10.0.0.2/32) = %s, want no candidates", id)
+	}
+}
+
+func TestVipElectionOpen(t *testing.T) {
+	msg := &electionMessage{RouterID: "192.0.2.1", Sequence: 1, VIPs: map[string]int{"10.0.0.1/32": 255}}
+	peer := net.ParseIP("192.0.2.1")
+	other := net.ParseIP("192.0.2.9")
+	keyed := &vipElection{key: []byte("secret")}
+	unkeyed := &vipElection{}
+	peers := &vipElection{peersOnly: true, targets: []*net.UDPAddr{{IP: peer, Port: defaultElectionPort}}}
+
+	tests := []struct {
+		name     string
+		sender   *vipElection
+		receiver *vipElection
+		from     net.IP
+		valid    bool
+	}{
+		{"valid mac", keyed, keyed, other, true},
+		{"wrong key", &vipElection{key: []byte("guess")}, keyed, other, false},
+		{"missing mac", unkeyed, keyed, other, false},
+		{"listed peer", unkeyed, peers, peer, true},
+		{"unlisted sender", unkeyed, peers, other, false},
+		{"listed peer with valid mac", keyed, &vipElection{key: keyed.key, peersOnly: true, targets: peers.targets}, peer, true},
+	}
+	for _, tt := range tests {
+		data, err := tt.sender.seal(msg)
+		if err != nil {
+			t.Fatalf("%s: seal() error = %v", tt.name, err)
+		}
+		got, err := tt.receiver.open(data, tt.from)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: open() error = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if err == nil && (got.RouterID != msg.RouterID || got.VIPs["10.0.0.1/32"] != 255) {
+			t.Errorf("%s: open() = %+v, want %+v", tt.name, got, msg)
+		}
+	}
+
+	// Changing any byte of authenticated message invalidates it
+	data, _ := keyed.seal(msg)
+	tampered := append([]byte(nil), data...)
+	for i := range tampered {
+		if tampered[i] == '5' {
+			tampered[i] = '4'
+			break
+		}
+	}
+	if _, err := keyed.open(tampered, other); err == nil {
+		t.Error("open() accepted modified message")
+	}
+}
+
+func TestVipElectionStart(t *testing.T) {
+	e := &vipElection{}
+	if err := e.start(); err == nil || e.isRunning() {
+		t.Error("start() opened socket without ELECTION_KEY or ELECTION_PEERS")
+	}
+}
+
+func TestVipElectionSend(t *testing.T) {
+	routerID = "192.0.2.2"
+	defer func() { routerID = "" }()
+
+	if _, err := parseNetworkOptions(testGenericOptions(map[string]string{optPriority: "256"})); err == nil {
+		t.Error("parseNetworkOptions() accepted priority 256")
+	}
+	options, err := parseNetworkOptions(testGenericOptions(map[string]string{optAnnounceMode: announceModeL2, optL2Interface: "lo", optPriority: "255"}))
+	if err != nil {
+		t.Fatalf("parseNetworkOptions() error = %v", err)
+	}
+
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	e := &vipElection{
+		conn:       conn,
+		targets:    []*net.UDPAddr{receiver.LocalAddr().(*net.UDPAddr)},
+		key:        []byte("secret"),
+		candidates: make(map[string]*electionCandidate),
+	}
+	e.running.Store(true)
+	_, dst, _ := net.ParseCIDR("10.0.0.1/32")
+	r := &localRoute{dst: dst, options: options}
+	if err := e.join(r); err != nil {
+		t.Fatalf("join() error = %v", err)
+	}
+
+	next := func() *electionMessage {
+		t.Helper()
+		e.send()
+		buf := make([]byte, 65535)
+		receiver.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := receiver.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("election message was not sent: %v", err)
+		}
+		msg, err := (&vipElection{key: e.key}).open(buf[:n], from.IP)
+		if err != nil {
+			t.Fatalf("open() error = %v", err)
+		}
+		return msg
+	}
+	first := next()
+	if first.RouterID != routerID || len(first.VIPs) != 1 || first.VIPs[dst.String()] != 255 {
+		t.Errorf("send() message = %+v, want %s with priority 255", first, dst)
+	}
+
+	// Host which left is not candidate anymore and messages are never replayable
+	if err := e.leave(r); err != nil {
+		t.Fatalf("leave() error = %v", err)
+	}
+	second := next()
+	if len(second.VIPs) != 0 || second.Sequence <= first.Sequence {
+		t.Errorf("send() after leave() = %+v, previous sequence %d", second, first.Sequence)
+	}
+}
+
+func TestSingleOwnerTakeover(t *testing.T) {
+	routerID = "192.0.2.2"
+	fake := newFakeAnnouncer()
+	bgpAnnouncer = fake
+	e := &vipElection{
+		interval:   20 * time.Millisecond,
+		sequences:  make(map[string]uint64),
+		candidates: make(map[string]*electionCandidate),
+		remotes:    make(map[string]map[string]*remoteCandidate),
+		changed:    make(chan struct{}, 1),
+	}
+	e.running.Store(true)
+	orig := elections
+	elections = e
+	defer func() {
+		routerID, bgpAnnouncer, elections = "", nil, orig
+	}()
+
+	if _, err := parseNetworkOptions(testGenericOptions(map[string]string{optOwnership: "all"})); err == nil {
+		t.Error("parseNetworkOptions() accepted ownership all")
+	}
+	options, err := parseNetworkOptions(testGenericOptions(map[string]string{optOwnership: ownershipSingle}))
+	if err != nil || !options.elected() {
+		t.Fatalf("parseNetworkOptions() = %+v, %v, want elected routes", options, err)
+	}
+	_, dst, _ := net.ParseCIDR("10.0.0.1/32")
+	r := &localRoute{dst: dst, options: options}
+	prefix := dst.String()
+
+	// New candidate waits until it would have heard other hosts
+	if err := r.announce(); err != nil {
+		t.Fatalf("announce() error = %v", err)
+	}
+	e.evaluate()
+	if fake.announced[prefix] != nil {
+		t.Error("announce() announced route before election")
+	}
+	time.Sleep(2 * e.interval)
+	e.evaluate()
+	if fake.announced[prefix] == nil || e.leader(prefix) != routerID {
+		t.Fatalf("host was not elected as only candidate, leader %s", e.leader(prefix))
+	}
+
+	// Better host takes over
+	e.receive(&electionMessage{RouterID: "192.0.2.3", Sequence: 1, VIPs: map[string]int{prefix: defaultPriority + 1}})
+	e.evaluate()
+	if fake.announced[prefix] != nil || e.leader(prefix) != "192.0.2.3" {
+		t.Errorf("route stayed announced after better host joined, leader %s", e.leader(prefix))
+	}
+
+	// Route is announced again when the other host is not heard anymore
+	time.Sleep((electionDeadIntervals + 1) * e.interval)
+	e.evaluate()
+	if fake.announced[prefix] == nil || e.leader(prefix) != routerID {
+		t.Errorf("host did not take over from dead host, leader %s", e.leader(prefix))
+	}
+
+	if err := r.unannounce(); err != nil {
+		t.Fatalf("unannounce() error = %v", err)
+	}
+	if fake.announced[prefix] != nil || len(e.candidates) != 0 {
+		t.Error("unannounce() kept route announced")
+	}
+
+	// Shared routes are announced without election
+	shared := &localRoute{dst: dst, options: defaultNetworkOptions()}
+	if err := shared.announce(); err != nil || fake.announced[prefix] == nil || len(e.candidates) != 0 {
+		t.Errorf("announce() of shared route = %v, candidates %d", err, len(e.candidates))
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// firewallTableName is nftables table (family inet) which plugin owns. It is rebuilt
+// from the desired state on every change so nothing else should be added to it.
+const firewallTableName = "bgplb"
+
+// Kinds of rules which have counter. They are stored to rule comment together with
+// address so that counters can be read back.
+const (
+	ruleAllowedPorts   = optAllowedPorts
+	rulePacketRate     = optPacketRate
+	ruleNewConnRate    = optNewConnRate
+	ruleMaxConnections = optMaxConnections
+)
+
+// firewallTarget is LB address which accepts only limited traffic.
+type firewallTarget struct {
+	address net.IP
+	options *networkOptions
+}
+
+// firewallTargets returns addresses of joined endpoints (and IPVS virtual services) in
+// networks which have port allowlist or rate limits. Caller must hold lock of lbServer.
+func (d *bgpLB) firewallTargets() []firewallTarget {
+	targets := make(map[string]firewallTarget)
+	add := func(address string, options *networkOptions) {
+		ip := parseAddress(address)
+		if ip == nil || ip.IsUnspecified() {
+			return
+		}
+		targets[ip.String()] = firewallTarget{address: ip, options: options}
+	}
+	for _, network := range d.Networks {
+		if !network.Options.firewalled() {
+			continue
+		}
+		joined := false
+		for _, endpoint := range network.endpoints {
+			if endpoint.vethOutside == "" {
+				continue
+			}
+			joined = true
+			add(endpoint.ipv4, network.Options)
+			add(endpoint.ipv6, network.Options)
+		}
+		if joined && network.Options.IPVSAddress != "" {
+			add(network.Options.IPVSAddress, network.Options)
+		}
+	}
+
+	list := []firewallTarget{}
+	for _, t := range targets {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].address.String() < list[j].address.String() })
+	return list
+}
+
+// matchDestination returns expressions which match packets sent to ip.
+func matchDestination(ip net.IP) []expr.Any {
+	family, offset, data := byte(unix.NFPROTO_IPV4), uint32(16), []byte(ip.To4())
+	if ip.To4() == nil {
+		family, offset, data = byte(unix.NFPROTO_IPV6), uint32(24), []byte(ip.To16())
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(data))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+	}
+}
+
+// matchPort returns expressions which match packets to port given in format <protocol>:<port>.
+func matchPort(port string) []expr.Any {
+	proto, p, _ := parseL4Port(port)
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(proto)}},
+		// Destination port is at same offset in TCP, UDP and SCTP headers
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(p)},
+	}
+}
+
+// matchCtState returns expressions which match packets of connections in any of states.
+func matchCtState(states uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(states),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+// rateOver returns expression which matches packets exceeding rate per second.
+func rateOver(rate int) []expr.Any {
+	return []expr.Any{&expr.Limit{Type: expr.LimitTypePkts, Rate: uint64(rate), Over: true, Unit: expr.LimitTimeSecond, Burst: uint32(rate)}}
+}
+
+// countedDrop returns rule which counts and drops packets matching exprs. Rule comment
+// tells which address and limit the counter belongs to.
+func countedDrop(table *nftables.Table, chain *nftables.Chain, address net.IP, kind string, exprs ...[]expr.Any) *nftables.Rule {
+	exprs = append(exprs, []expr.Any{&expr.Counter{}})
+	return &nftables.Rule{
+		Table:    table,
+		Chain:    chain,
+		Exprs:    verdict(expr.VerdictDrop, exprs...),
+		UserData: userdata.AppendString(nil, userdata.TypeComment, address.String()+" "+kind),
+	}
+}
+
+// limitRules returns rules which drop traffic to target exceeding its rate limits.
+func (t firewallTarget) limitRules(table *nftables.Table, chain *nftables.Chain) []*nftables.Rule {
+	rules := []*nftables.Rule{}
+	if t.options.PacketRate > 0 {
+		rules = append(rules, countedDrop(table, chain, t.address, rulePacketRate, matchDestination(t.address), rateOver(t.options.PacketRate)))
+	}
+	if t.options.NewConnRate > 0 {
+		rules = append(rules, countedDrop(table, chain, t.address, ruleNewConnRate, matchDestination(t.address), matchCtState(expr.CtStateBitNEW), rateOver(t.options.NewConnRate)))
+	}
+	if t.options.MaxConnections > 0 {
+		// Connections are counted by the rule itself so only new ones are checked
+		rules = append(rules, countedDrop(table, chain, t.address, ruleMaxConnections, matchDestination(t.address), matchCtState(expr.CtStateBitNEW),
+			[]expr.Any{&expr.Connlimit{Count: uint32(t.options.MaxConnections), Flags: expr.NFT_CONNLIMIT_F_INV}}))
+	}
+	return rules
+}
+
+// portRules returns rules which accept traffic to allowed ports of target and drop the rest.
+func (t firewallTarget) portRules(table *nftables.Table, chain *nftables.Chain) []*nftables.Rule {
+	rules := []*nftables.Rule{}
+	if len(t.options.AllowedPorts) == 0 {
+		return rules
+	}
+	for _, port := range t.options.AllowedPorts {
+		rules = append(rules, &nftables.Rule{Table: table, Chain: chain, Exprs: verdict(expr.VerdictAccept, matchDestination(t.address), matchPort(port))})
+	}
+	return append(rules, countedDrop(table, chain, t.address, ruleAllowedPorts, matchDestination(t.address)))
+}
+
+func verdict(kind expr.VerdictKind, exprs ...[]expr.Any) []expr.Any {
+	rule := []expr.Any{}
+	for _, e := range exprs {
+		rule = append(rule, e...)
+	}
+	return append(rule, &expr.Verdict{Kind: kind})
+}
+
+// syncFirewall makes nftables table of plugin to match port allowlists and rate limits
+// of networks. Traffic to LB addresses is filtered both when it is routed to containers
+// and when it is received locally by IPVS. Rate limits are checked first so that they
+// also cover established connections. Table is removed when no network needs it.
+// Caller must hold lock of lbServer.
+func (d *bgpLB) syncFirewall() error {
+	targets := d.firewallTargets()
+
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("syncFirewall: failed to open nftables connection: %w", err)
+	}
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: firewallTableName}
+
+	if len(targets) == 0 {
+		if _, err := conn.ListTableOfFamily(firewallTableName, nftables.TableFamilyINet); err != nil {
+			return nil
+		}
+		conn.DelTable(table)
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("syncFirewall: failed to remove table %s: %w", firewallTableName, err)
+		}
+		return nil
+	}
+
+	// All changes are applied atomically in one batch
+	conn.AddTable(table)
+	conn.FlushTable(table)
+	policy := nftables.ChainPolicyAccept
+	for name, hook := range map[string]*nftables.ChainHook{"input": nftables.ChainHookInput, "forward": nftables.ChainHookForward} {
+		chain := conn.AddChain(&nftables.Chain{
+			Name:     name,
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  hook,
+			Priority: nftables.ChainPriorityFilter,
+			Policy:   &policy,
+		})
+		for _, t := range targets {
+			for _, rule := range t.limitRules(table, chain) {
+				conn.AddRule(rule)
+			}
+		}
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: verdict(expr.VerdictAccept, matchCtState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED))})
+		for _, t := range targets {
+			for _, rule := range t.portRules(table, chain) {
+				conn.AddRule(rule)
+			}
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("syncFirewall: failed to update table %s: %w", firewallTableName, err)
+	}
+	return nil
+}
+
+type firewallCounterStatus struct {
+	Address string
+	Rule    string
+	Packets uint64
+	Bytes   uint64
+}
+
+// firewallStatus returns counters of packets which rules of plugin have dropped,
+// summed over chains.
+func firewallStatus() []firewallCounterStatus {
+	status := []firewallCounterStatus{}
+	conn, err := nftables.New()
+	if err != nil {
+		return status
+	}
+	table, err := conn.ListTableOfFamily(firewallTableName, nftables.TableFamilyINet)
+	if err != nil {
+		return status
+	}
+
+	counters := make(map[string]*firewallCounterStatus)
+	for _, name := range []string{"input", "forward"} {
+		rules, err := conn.GetRules(table, &nftables.Chain{Name: name, Table: table})
+		if err != nil {
+			continue
+		}
+		for _, rule := range rules {
+			comment, ok := userdata.GetString(rule.UserData, userdata.TypeComment)
+			if !ok {
+				continue
+			}
+			address, kind, _ := strings.Cut(comment, " ")
+			c, ok := counters[comment]
+			if !ok {
+				c = &firewallCounterStatus{Address: address, Rule: kind}
+				counters[comment] = c
+			}
+			for _, e := range rule.Exprs {
+				if counter, ok := e.(*expr.Counter); ok {
+					c.Packets += counter.Packets
+					c.Bytes += counter.Bytes
+				}
+			}
+		}
+	}
+	for _, c := range counters {
+		status = append(status, *c)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		if status[i].Address != status[j].Address {
+			return status[i].Address < status[j].Address
+		}
+		return status[i].Rule < status[j].Rule
+	})
+	return status
+}
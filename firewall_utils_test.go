@@ -0,0 +1,147 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+)
+
+// testFirewall returns LB with network of options which has joined endpoint 10.0.0.1
+// and endpoint 10.0.0.2 which has not joined yet. Table of plugin is removed after test.
+func testFirewall(t *testing.T, options map[string]string) *bgpLB {
+	t.Helper()
+	conn, err := nftables.New()
+	if err == nil {
+		_, err = conn.ListTables()
+	}
+	if err != nil {
+		t.Skipf("nftables is not available: %v", err)
+	}
+	opts, err := parseNetworkOptions(testGenericOptions(options))
+	if err != nil {
+		t.Fatalf("parseNetworkOptions() error = %v", err)
+	}
+	d := &bgpLB{Networks: map[string]*bgpNetwork{"net1": {Options: opts, endpoints: map[string]*bgpLBEndpoint{
+		"ep1": {vethOutside: "veth1", ipv4: "10.0.0.1/24"},
+		"ep2": {ipv4: "10.0.0.2/24"},
+	}}}}
+	t.Cleanup(func() {
+		d.Networks = nil
+		d.syncFirewall()
+	})
+	return d
+}
+
+// firewallRules returns verdicts of rules in chain of plugin table with comments of
+// counted rules, e.g. "accept" or "drop 10.0.0.1 allowed_ports".
+func firewallRules(t *testing.T, chain string) []string {
+	t.Helper()
+	conn, _ := nftables.New()
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: firewallTableName}
+	rules, err := conn.GetRules(table, &nftables.Chain{Name: chain, Table: table})
+	if err != nil {
+		t.Fatalf("GetRules(%s) error = %v", chain, err)
+	}
+	got := []string{}
+	for _, rule := range rules {
+		s := ""
+		for _, e := range rule.Exprs {
+			if v, ok := e.(*expr.Verdict); ok {
+				s = map[expr.VerdictKind]string{expr.VerdictAccept: "accept", expr.VerdictDrop: "drop"}[v.Kind]
+			}
+		}
+		if comment, ok := userdata.GetString(rule.UserData, userdata.TypeComment); ok {
+			s += " " + comment
+		}
+		got = append(got, s)
+	}
+	return got
+}
+
+func TestSyncFirewallAllowedPorts(t *testing.T) {
+	if _, err := parseNetworkOptions(testGenericOptions(map[string]string{optAllowedPorts: "443"})); err == nil {
+		t.Error("parseNetworkOptions() accepted port without protocol")
+	}
+	d := testFirewall(t, map[string]string{optAllowedPorts: "tcp:443,udp:53"})
+
+	if err := d.syncFirewall(); err != nil {
+		t.Fatalf("syncFirewall() error = %v", err)
+	}
+	// Only joined endpoint is filtered, established connections are accepted first
+	want := []string{"accept", "accept", "accept", "drop 10.0.0.1 allowed_ports"}
+	for _, chain := range []string{"input", "forward"} {
+		if got := firewallRules(t, chain); !slices.Equal(got, want) {
+			t.Errorf("%s chain rules = %q, want %q", chain, got, want)
+		}
+	}
+	if status := firewallStatus(); len(status) != 1 || status[0].Address != "10.0.0.1" || status[0].Rule != ruleAllowedPorts {
+		t.Errorf("firewallStatus() = %+v, want counter of 10.0.0.1", status)
+	}
+
+	// Table is rebuilt when endpoints change and removed when nothing is filtered
+	d.Networks["net1"].endpoints["ep2"].vethOutside = "veth2"
+	if err := d.syncFirewall(); err != nil {
+		t.Fatalf("syncFirewall() error = %v", err)
+	}
+	if got := firewallRules(t, "input"); len(got) != 7 {
+		t.Errorf("input chain rules = %q, want rules for both endpoints", got)
+	}
+	d.Networks["net1"].endpoints["ep1"].vethOutside = ""
+	d.Networks["net1"].endpoints["ep2"].vethOutside = ""
+	if err := d.syncFirewall(); err != nil {
+		t.Fatalf("syncFirewall() error = %v", err)
+	}
+	conn, _ := nftables.New()
+	if _, err := conn.ListTableOfFamily(firewallTableName, nftables.TableFamilyINet); err == nil {
+		t.Errorf("syncFirewall() kept table %s without filtered endpoints", firewallTableName)
+	}
+}
+
+func TestSyncFirewallRateLimits(t *testing.T) {
+	if _, err := parseNetworkOptions(testGenericOptions(map[string]string{optNewConnRate: "0"})); err == nil {
+		t.Error("parseNetworkOptions() accepted zero rate limit")
+	}
+	d := testFirewall(t, map[string]string{optPacketRate: "1000", optMaxConnections: "10"})
+	if err := d.syncFirewall(); err != nil {
+		t.Fatalf("syncFirewall() error = %v", err)
+	}
+
+	// Limits are checked before established connections are accepted and other
+	// traffic is allowed without port allowlist
+	want := []string{"drop 10.0.0.1 packet_rate", "drop 10.0.0.1 max_connections", "accept"}
+	if got := firewallRules(t, "forward"); !slices.Equal(got, want) {
+		t.Errorf("forward chain rules = %q, want %q", got, want)
+	}
+
+	conn, _ := nftables.New()
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: firewallTableName}
+	rules, err := conn.GetRules(table, &nftables.Chain{Name: "input", Table: table})
+	if err != nil || len(rules) != 3 {
+		t.Fatalf("GetRules() = %d rules, %v", len(rules), err)
+	}
+	var limit *expr.Limit
+	var connlimit *expr.Connlimit
+	for _, rule := range rules[:2] {
+		for _, e := range rule.Exprs {
+			switch v := e.(type) {
+			case *expr.Limit:
+				limit = v
+			case *expr.Connlimit:
+				connlimit = v
+			}
+		}
+	}
+	if limit == nil || limit.Rate != 1000 || !limit.Over || limit.Unit != expr.LimitTimeSecond {
+		t.Errorf("packet rate rule has limit %+v, want over 1000/second", limit)
+	}
+	if connlimit == nil || connlimit.Count != 10 || connlimit.Flags != expr.NFT_CONNLIMIT_F_INV {
+		t.Errorf("max connections rule has connlimit %+v, want over 10", connlimit)
+	}
+	status := firewallStatus()
+	if len(status) != 2 || status[0].Rule != ruleMaxConnections || status[1].Rule != rulePacketRate {
+		t.Errorf("firewallStatus() = %+v, want counters of both limits", status)
+	}
+}
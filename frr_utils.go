@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultFRRSocket is the VTY socket of bgpd on the host. Plugin shares PID
+// namespace of the host so the host filesystem is reachable through root of
+// the init process without a mount, which would fail on hosts without FRR.
+const defaultFRRSocket = "/proc/1/root/var/run/frr/bgpd.vty"
+
+// frrAnnouncer announces prefixes with the FRR daemon running on the host. Prefixes
+// are added as `network` statements and their attributes are set with route-maps.
+type frrAnnouncer struct {
+	socket  string
+	timeout time.Duration
+}
+
+func newFRRAnnouncer() (*frrAnnouncer, error) {
+	socket := os.Getenv("FRR_VTY_SOCKET")
+	if socket == "" {
+		socket = defaultFRRSocket
+	}
+	a := &frrAnnouncer{socket: socket, timeout: defaultBackendTimeout}
+	if _, err := a.run(context.Background(), "show bgp summary"); err != nil {
+		return nil, fmt.Errorf("Cannot connect to FRR in %s: %v\r\n", socket, err)
+	}
+	log.Infof("Using FRR in %s for BGP announcements", socket)
+	return a, nil
+}
+
+// run runs commands in bgpd like vtysh does. Every command is terminated with
+// zero byte and bgpd ends its output with three zero bytes and the return code.
+// Output of all commands is returned.
+func (f *frrAnnouncer) run(ctx context.Context, commands ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", f.socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	r := bufio.NewReader(conn)
+	out := []byte{}
+	// Connections of vtysh start in view node where configuration is not allowed
+	for _, c := range append([]string{"enable"}, commands...) {
+		if _, err := conn.Write(append([]byte(c), 0)); err != nil {
+			return out, err
+		}
+		output, code, err := readVtyResponse(r)
+		if err != nil {
+			return out, err
+		}
+		if code != 0 {
+			return out, fmt.Errorf("command %q failed with code %d: %s", c, code, strings.TrimSpace(string(output)))
+		}
+		if c != "enable" {
+			out = append(out, output...)
+		}
+	}
+	return out, nil
+}
+
+func readVtyResponse(r *bufio.Reader) ([]byte, byte, error) {
+	output := []byte{}
+	zeros := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return output, 0, err
+		}
+		if zeros == 3 {
+			return output, b, nil
+		}
+		if b == 0 {
+			zeros++
+			continue
+		}
+		for ; zeros > 0; zeros-- {
+			output = append(output, 0)
+		}
+		output = append(output, b)
+	}
+}
+
+func frrAddressFamily(prefix *net.IPNet) string {
+	if prefix.IP.To4() == nil {
+		return "address-family ipv6 unicast"
+	}
+	return "address-family ipv4 unicast"
+}
+
+func frrRouteMapName(prefix *net.IPNet) string {
+	return "bgplb-" + strings.NewReplacer(".", "-", ":", "-", "/", "_").Replace(prefix.String())
+}
+
+func (f *frrAnnouncer) announce(ctx context.Context, prefix *net.IPNet, options *networkOptions, prepend int) error {
+	routeMap := frrRouteMapName(prefix)
+	commands := []string{"configure terminal", "route-map " + routeMap + " permit 10"}
+	if options.MED != nil {
+		commands = append(commands, fmt.Sprintf("set metric %d", *options.MED))
+	} else {
+		commands = append(commands, "no set metric")
+	}
+	if prepend > 0 {
+		commands = append(commands, "set as-path prepend"+strings.Repeat(fmt.Sprintf(" %d", localAS), prepend))
+	} else {
+		commands = append(commands, "no set as-path prepend")
+	}
+	if len(options.Communities) > 0 {
+		commands = append(commands, "set community "+strings.Join(options.Communities, " ")+" additive")
+	} else {
+		commands = append(commands, "no set community")
+	}
+	if prefix.IP.To4() != nil && options.NextHop != "" {
+		commands = append(commands, "set ip next-hop "+options.NextHop)
+	}
+	if prefix.IP.To4() == nil && options.NextHopV6 != "" {
+		commands = append(commands, "set ipv6 next-hop global "+options.NextHopV6)
+	}
+	commands = append(commands,
+		"exit",
+		fmt.Sprintf("router bgp %d", localAS),
+		frrAddressFamily(prefix),
+		fmt.Sprintf("network %s route-map %s", prefix, routeMap),
+	)
+	_, err := f.run(ctx, commands...)
+	return err
+}
+
+func (f *frrAnnouncer) withdraw(ctx context.Context, prefix *net.IPNet) error {
+	_, err := f.run(ctx,
+		"configure terminal",
+		fmt.Sprintf("router bgp %d", localAS),
+		frrAddressFamily(prefix),
+		fmt.Sprintf("no network %s", prefix),
+		"exit-address-family",
+		"exit",
+		"no route-map "+frrRouteMapName(prefix),
+	)
+	return err
+}
+
+type frrPrefixPaths struct {
+	Paths []struct {
+		Peer struct {
+			PeerID string `json:"peerId"`
+		} `json:"peer"`
+	} `json:"paths"`
+}
+
+func (f *frrAnnouncer) paths(ctx context.Context, prefix *net.IPNet) *frrPrefixPaths {
+	family := "ipv4"
+	if prefix.IP.To4() == nil {
+		family = "ipv6"
+	}
+	out, err := f.run(ctx, fmt.Sprintf("show bgp %s unicast %s json", family, prefix))
+	if err != nil {
+		log.Errorf("frrAnnouncer: failed to query %s: %v", prefix, err)
+		return &frrPrefixPaths{}
+	}
+	p := &frrPrefixPaths{}
+	if err := json.Unmarshal(out, p); err != nil {
+		log.Errorf("frrAnnouncer: failed to parse paths of %s: %v", prefix, err)
+	}
+	return p
+}
+
+func (f *frrAnnouncer) isAnnounced(ctx context.Context, prefix *net.IPNet) bool {
+	return len(f.paths(ctx, prefix).Paths) > 0
+}
+
+type frrTable struct {
+	Routes map[string][]struct {
+		PeerID string `json:"peerId"`
+	} `json:"routes"`
+}
+
+func (f *frrAnnouncer) receivedHostRoutes(ctx context.Context) map[string][]string {
+	routes := make(map[string][]string)
+	for _, family := range []string{"ipv4", "ipv6"} {
+		out, err := f.run(ctx, fmt.Sprintf("show bgp %s unicast json", family))
+		if err != nil {
+			log.Errorf("frrAnnouncer: failed to query %s table: %v", family, err)
+			continue
+		}
+		table := &frrTable{}
+		if err := json.Unmarshal(out, table); err != nil {
+			log.Errorf("frrAnnouncer: failed to parse %s table: %v", family, err)
+			continue
+		}
+		for prefix, paths := range table.Routes {
+			_, ipnet, err := net.ParseCIDR(prefix)
+			if err != nil {
+				continue
+			}
+			if ones, bits := ipnet.Mask.Size(); ones != bits {
+				continue
+			}
+			for _, p := range paths {
+				// Locally originated paths are shown with unspecified peer
+				if ip := net.ParseIP(p.PeerID); ip != nil && !ip.IsUnspecified() {
+					routes[ipnet.String()] = append(routes[ipnet.String()], p.PeerID)
+				}
+			}
+		}
+	}
+	return routes
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBgpd serves VTY socket like bgpd. It records received commands, answers
+// commands in outputs with their output and fails command failing.
+type fakeBgpd struct {
+	commands chan string
+	outputs  map[string]string
+	failing  string
+	hang     bool
+}
+
+func startFakeBgpd(t *testing.T, d *fakeBgpd) string {
+	socket := filepath.Join(t.TempDir(), "bgpd.vty")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Listen(%s) error = %v", socket, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	d.commands = make(chan string, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					c, err := r.ReadString(0)
+					if err != nil {
+						return
+					}
+					c = strings.TrimSuffix(c, "\x00")
+					d.commands <- c
+					if d.hang {
+						continue
+					}
+					switch {
+					case c == d.failing:
+						conn.Write([]byte("% Unknown command\n\x00\x00\x00\x02"))
+					default:
+						conn.Write([]byte(d.outputs[c] + "\x00\x00\x00\x00"))
+					}
+				}
+			}()
+		}
+	}()
+	return socket
+}
+
+func (d *fakeBgpd) received() []string {
+	commands := []string{}
+	for {
+		select {
+		case c := <-d.commands:
+			commands = append(commands, c)
+		default:
+			return commands
+		}
+	}
+}
+
+func TestFRRAnnounce(t *testing.T) {
+	localAS = 65001
+	defer func() { localAS = 0 }()
+	d := &fakeBgpd{}
+	f := &frrAnnouncer{socket: startFakeBgpd(t, d), timeout: time.Second}
+
+	_, prefix, _ := net.ParseCIDR("10.0.0.1/32")
+	options := defaultNetworkOptions()
+	med := uint32(50)
+	options.MED = &med
+	options.Communities = []string{"65000:100"}
+	if err := f.announce(context.Background(), prefix, options, 2); err != nil {
+		t.Fatalf("announce() error = %v", err)
+	}
+	want := []string{
+		"enable",
+		"configure terminal",
+		"route-map bgplb-10-0-0-1_32 permit 10",
+		"set metric 50",
+		"set as-path prepend 65001 65001",
+		"set community 65000:100 additive",
+		"exit",
+		"router bgp 65001",
+		"address-family ipv4 unicast",
+		"network 10.0.0.1/32 route-map bgplb-10-0-0-1_32",
+	}
+	if got := d.received(); !slices.Equal(got, want) {
+		t.Errorf("announce() sent %q, want %q", got, want)
+	}
+
+	_, prefix, _ = net.ParseCIDR("2001:db8::1/128")
+	if err := f.withdraw(context.Background(), prefix); err != nil {
+		t.Fatalf("withdraw() error = %v", err)
+	}
+	want = []string{
+		"enable",
+		"configure terminal",
+		"router bgp 65001",
+		"address-family ipv6 unicast",
+		"no network 2001:db8::1/128",
+		"exit-address-family",
+		"exit",
+		"no route-map bgplb-2001-db8--1_128",
+	}
+	if got := d.received(); !slices.Equal(got, want) {
+		t.Errorf("withdraw() sent %q, want %q", got, want)
+	}
+}
+
+func TestFRRRun(t *testing.T) {
+	ipv4Table := `{"routes":{"10.0.0.1/32":[{"peerId":"192.0.2.1"},{"peerId":"0.0.0.0"}],"10.0.0.0/24":[{"peerId":"192.0.2.1"}]}}`
+	d := &fakeBgpd{outputs: map[string]string{
+		"show bgp ipv4 unicast json": ipv4Table,
+		"show bgp ipv6 unicast json": `{"routes":{"2001:db8::1/128":[{"peerId":"2001:db8::ff"}]}}`,
+	}, failing: "router bgp 65001"}
+	f := &frrAnnouncer{socket: startFakeBgpd(t, d), timeout: time.Second}
+
+	out, err := f.run(context.Background(), "show bgp ipv4 unicast json")
+	if err != nil || string(out) != ipv4Table {
+		t.Errorf("run() = %q, %v, want %q", out, err, ipv4Table)
+	}
+
+	routes := f.receivedHostRoutes(context.Background())
+	if len(routes) != 2 || !slices.Equal(routes["10.0.0.1/32"], []string{"192.0.2.1"}) || !slices.Equal(routes["2001:db8::1/128"], []string{"2001:db8::ff"}) {
+		t.Errorf("receivedHostRoutes() = %v, want host routes received from peers", routes)
+	}
+	d.received()
+
+	_, err = f.run(context.Background(), "configure terminal", "router bgp 65001", "address-family ipv4 unicast")
+	if err == nil || !strings.Contains(err.Error(), "Unknown command") {
+		t.Errorf("run() error = %v, want failure of router bgp", err)
+	}
+	if got := d.received(); len(got) != 3 {
+		t.Errorf("run() sent %q, want commands after failure to be skipped", got)
+	}
+}
+
+func TestFRRRunTimeout(t *testing.T) {
+	d := &fakeBgpd{hang: true}
+	f := &frrAnnouncer{socket: startFakeBgpd(t, d), timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	if _, err := f.run(context.Background(), "show bgp summary"); err == nil {
+		t.Error("run() succeeded without response")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("run() returned after %v, want timeout", elapsed)
+	}
+
+	t.Setenv("FRR_VTY_SOCKET", filepath.Join(t.TempDir(), "missing.vty"))
+	if _, err := newFRRAnnouncer(); err == nil {
+		t.Error("newFRRAnnouncer() succeeded without bgpd")
+	}
+}
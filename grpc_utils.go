@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	serverGoBGP "github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const unixSocketScheme = "unix://"
+
+// isLocalGrpcAddress tells if gRPC address is unix socket or loopback address.
+func isLocalGrpcAddress(address string) bool {
+	if strings.HasPrefix(address, unixSocketScheme) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// grpcTLSConfig loads server certificate from GRPC_TLS_CERT and GRPC_TLS_KEY. When
+// GRPC_TLS_CA is given clients must present certificate signed by that CA.
+func grpcTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("GRPC_TLS_CERT"), os.Getenv("GRPC_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Environment variables GRPC_TLS_CERT and GRPC_TLS_KEY value is invalid: %v\r\n", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile := os.Getenv("GRPC_TLS_CA"); caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Environment variable GRPC_TLS_CA value is invalid: %v\r\n", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Environment variable GRPC_TLS_CA value is invalid: no certificates found\r\n")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// grpcServerOptions returns GoBGP server options which enable its gRPC management
+// API in GRPC_ADDRESS. API is disabled when GRPC_ADDRESS is not set. API gives full
+// control of BGP so other than unix socket or loopback address requires TLS with
+// client certificates, server certificate alone only encrypts traffic.
+func grpcServerOptions() ([]serverGoBGP.ServerOption, error) {
+	address := os.Getenv("GRPC_ADDRESS")
+	if address == "" {
+		return nil, nil
+	}
+
+	tlsConfig, err := grpcTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if !isLocalGrpcAddress(address) && (tlsConfig == nil || tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert) {
+		return nil, fmt.Errorf("Environment variable GRPC_ADDRESS value is invalid, only unix socket or loopback address is allowed without TLS client authentication with GRPC_TLS_CA\r\n")
+	}
+	if tlsConfig != nil && strings.HasPrefix(address, unixSocketScheme) {
+		return nil, fmt.Errorf("Environment variable GRPC_ADDRESS value is invalid, TLS is not supported with unix socket\r\n")
+	}
+
+	options := []serverGoBGP.ServerOption{serverGoBGP.GrpcListenAddress(address)}
+	if tlsConfig != nil {
+		options = append(options, serverGoBGP.GrpcOption([]grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))}))
+		log.Infof("Enabling GoBGP gRPC API with TLS in %s", address)
+	} else {
+		log.Infof("Enabling GoBGP gRPC API in %s", address)
+	}
+	return options, nil
+}
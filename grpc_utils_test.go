@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+	serverGoBGP "github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// writeTestCertificate writes self-signed certificate and its key to dir.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bgplb"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot encode key: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestGrpcServerOptions(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+
+	tests := []struct {
+		name    string
+		address string
+		cert    bool
+		ca      string
+		enabled bool
+		valid   bool
+	}{
+		{"disabled", "", false, "", false, true},
+		{"unix socket", "unix:///run/gobgp.sock", false, "", true, true},
+		{"loopback", "127.0.0.1:50051", false, "", true, true},
+		{"ipv6 loopback", "[::1]:50051", false, "", true, true},
+		{"localhost", "localhost:50051", false, "", true, true},
+		{"loopback with tls", "127.0.0.1:50051", true, "", true, true},
+		{"remote without tls", "0.0.0.0:50051", false, "", false, false},
+		{"remote without client authentication", "192.0.2.1:50051", true, "", false, false},
+		{"remote with client authentication", "192.0.2.1:50051", true, certFile, true, true},
+		{"unix socket with tls", "unix:///run/gobgp.sock", true, "", false, false},
+		{"invalid ca", "192.0.2.1:50051", true, keyFile, false, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("GRPC_ADDRESS", tt.address)
+		t.Setenv("GRPC_TLS_CERT", "")
+		t.Setenv("GRPC_TLS_KEY", "")
+		if tt.cert {
+			t.Setenv("GRPC_TLS_CERT", certFile)
+			t.Setenv("GRPC_TLS_KEY", keyFile)
+		}
+		t.Setenv("GRPC_TLS_CA", tt.ca)
+
+		options, err := grpcServerOptions()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: grpcServerOptions() error = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if (len(options) > 0) != tt.enabled {
+			t.Errorf("%s: grpcServerOptions() returned %d options, want enabled %v", tt.name, len(options), tt.enabled)
+		}
+	}
+}
+
+// startGrpcTestServer starts GoBGP server with gRPC API configured from environment.
+func startGrpcTestServer(t *testing.T) {
+	t.Helper()
+	options, err := grpcServerOptions()
+	if err != nil {
+		t.Fatalf("grpcServerOptions() error = %v", err)
+	}
+	s := serverGoBGP.NewBgpServer(options...)
+	go s.Serve()
+	if err := s.StartBgp(context.Background(), &apiGoBGP.StartBgpRequest{
+		Global: &apiGoBGP.Global{RouterId: "192.0.2.254", Asn: 65000, ListenPort: -1},
+	}); err != nil {
+		t.Fatalf("StartBgp() error = %v", err)
+	}
+	t.Cleanup(s.Stop)
+}
+
+// grpcRouterID asks router ID from gRPC API in address.
+func grpcRouterID(address string, creds credentials.TransportCredentials) (string, error) {
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := apiGoBGP.NewGobgpApiClient(conn).GetBgp(ctx, &apiGoBGP.GetBgpRequest{})
+	if err != nil {
+		return "", err
+	}
+	return r.Global.RouterId, nil
+}
+
+func TestGrpcApi(t *testing.T) {
+	socket := unixSocketScheme + filepath.Join(t.TempDir(), "gobgp.sock")
+	t.Setenv("GRPC_ADDRESS", socket)
+	t.Setenv("GRPC_TLS_CERT", "")
+	t.Setenv("GRPC_TLS_KEY", "")
+	t.Setenv("GRPC_TLS_CA", "")
+	startGrpcTestServer(t)
+	// Server listens in the background so the first calls may not find the socket
+	var id string
+	var err error
+	for i := 0; i < 50; i++ {
+		if id, err = grpcRouterID(socket, insecure.NewCredentials()); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil || id != "192.0.2.254" {
+		t.Errorf("GetBgp() through %s = %s, %v", socket, id, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	t.Setenv("GRPC_ADDRESS", address)
+	t.Setenv("GRPC_TLS_CERT", certFile)
+	t.Setenv("GRPC_TLS_KEY", keyFile)
+	t.Setenv("GRPC_TLS_CA", certFile)
+	startGrpcTestServer(t)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	ca, _ := os.ReadFile(certFile)
+	pool.AppendCertsFromPEM(ca)
+	for i := 0; i < 50; i++ {
+		if id, err = grpcRouterID(address, credentials.NewTLS(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}})); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil || id != "192.0.2.254" {
+		t.Errorf("GetBgp() with client certificate = %s, %v", id, err)
+	}
+	if _, err := grpcRouterID(address, credentials.NewTLS(&tls.Config{RootCAs: pool})); err == nil {
+		t.Error("GetBgp() without client certificate succeeded")
+	}
+	if _, err := grpcRouterID(address, insecure.NewCredentials()); err == nil {
+		t.Error("GetBgp() without TLS succeeded")
+	}
+}
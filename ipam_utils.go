@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// poolModeAnycast pools hand out same addresses on every host, which is what
+	// ECMP between hosts needs.
+	poolModeAnycast = "anycast"
+	// poolModeUnique pools skip addresses which some other host already announces.
+	poolModeUnique = "unique"
+	// noPoolID is returned for IPv4 pool of IPv6 only networks
+	noPoolID = "0.0.0.0/32"
+)
+
+// addressPool is a pool of load balancer addresses. Every address is advertised as
+// its own host route so pool bigger than /32 (or /128) lets multiple services share
+// one LB network. Single address pools are shared by all containers in the network.
+type addressPool struct {
+	Pool      string
+	Mode      string
+	Allocated map[string]bool
+}
+
+func newAddressPool(pool, mode string) (*addressPool, error) {
+	_, ipnet, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, err
+	}
+	switch mode {
+	case "":
+		mode = poolModeAnycast
+	case poolModeAnycast, poolModeUnique:
+	default:
+		return nil, fmt.Errorf("invalid pool_mode %s, supported values are %s and %s", mode, poolModeAnycast, poolModeUnique)
+	}
+	return &addressPool{
+		Pool:      ipnet.String(),
+		Mode:      mode,
+		Allocated: make(map[string]bool),
+	}, nil
+}
+
+// newPoolID returns unique ID for pool so that networks which use same subnet do
+// not share allocations.
+func newPoolID(pool string) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return pool + "-" + hex.EncodeToString(b)
+}
+
+// legacyPool returns pool for PoolID of network which was created before pools
+// were stored to state. Those networks use their only /32 or /128 address as ID.
+func legacyPool(id string) *addressPool {
+	_, ipnet, err := net.ParseCIDR(id)
+	if err != nil {
+		return nil
+	}
+	if ones, bits := ipnet.Mask.Size(); ones != bits {
+		return nil
+	}
+	p, _ := newAddressPool(id, poolModeAnycast)
+	return p
+}
+
+func (p *addressPool) network() *net.IPNet {
+	_, ipnet, _ := net.ParseCIDR(p.Pool)
+	return ipnet
+}
+
+func (p *addressPool) shared() bool {
+	ones, bits := p.network().Mask.Size()
+	return ones == bits
+}
+
+// hostAddress formats ip with full length mask, which is what containers and routes use.
+func hostAddress(ip net.IP) string {
+	if ip.To4() != nil {
+		return fmt.Sprintf("%s/32", ip)
+	}
+	return fmt.Sprintf("%s/128", ip)
+}
+
+func parseAddress(address string) net.IP {
+	if strings.Contains(address, "/") {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil
+		}
+		return ip
+	}
+	return net.ParseIP(address)
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// reserved tells if ip is network address of the pool, or broadcast address of IPv4
+// pool, which are not given to containers. Point-to-point /31 and /127 pools do not
+// have such addresses.
+func (p *addressPool) reserved(ip net.IP) bool {
+	ipnet := p.network()
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 {
+		return false
+	}
+	if ip.Equal(ipnet.IP) {
+		return true
+	}
+	if bits != 32 {
+		return false
+	}
+	broadcast := make(net.IP, 4)
+	for i, b := range ipnet.IP.To4() {
+		broadcast[i] = b | ^ipnet.Mask[i]
+	}
+	return ip.Equal(broadcast)
+}
+
+// gateway returns the address reported to Docker as network gateway. It is never
+// configured anywhere so it does not consume an address from the pool.
+func (p *addressPool) gateway(requested string) (string, error) {
+	ipnet := p.network()
+	ones, _ := ipnet.Mask.Size()
+	if requested == "" {
+		return fmt.Sprintf("%s/%d", ipnet.IP, ones), nil
+	}
+	ip := parseAddress(requested)
+	if ip == nil || !ipnet.Contains(ip) {
+		return "", fmt.Errorf("gateway %s is not part of pool %s", requested, p.Pool)
+	}
+	return fmt.Sprintf("%s/%d", ip, ones), nil
+}
+
+// allocate reserves requested address, or the first free one when requested is empty.
+// Reservation is skipped for single address pools because those are shared.
+// In unique mode addresses for which announcedElsewhere returns true are not used.
+func (p *addressPool) allocate(requested string, announcedElsewhere func(net.IP) bool) (net.IP, error) {
+	ipnet := p.network()
+	conflict := func(ip net.IP) bool {
+		return p.Mode == poolModeUnique && announcedElsewhere(ip)
+	}
+
+	if p.shared() {
+		if requested != "" && !ipnet.IP.Equal(parseAddress(requested)) {
+			return nil, fmt.Errorf("address %s is not part of pool %s", requested, p.Pool)
+		}
+		if conflict(ipnet.IP) {
+			return nil, fmt.Errorf("address %s is already announced by another host", ipnet.IP)
+		}
+		return ipnet.IP, nil
+	}
+
+	if requested != "" {
+		ip := parseAddress(requested)
+		if ip == nil || !ipnet.Contains(ip) {
+			return nil, fmt.Errorf("address %s is not part of pool %s", requested, p.Pool)
+		}
+		if p.reserved(ip) {
+			return nil, fmt.Errorf("address %s is reserved in pool %s", ip, p.Pool)
+		}
+		if _, ok := p.Allocated[ip.String()]; ok {
+			return nil, fmt.Errorf("address %s is already allocated", ip)
+		}
+		if conflict(ip) {
+			return nil, fmt.Errorf("address %s is already announced by another host", ip)
+		}
+		p.Allocated[ip.String()] = true
+		return ip, nil
+	}
+
+	for ip := ipnet.IP; ipnet.Contains(ip); ip = nextIP(ip) {
+		if p.reserved(ip) {
+			continue
+		}
+		if _, ok := p.Allocated[ip.String()]; !ok && !conflict(ip) {
+			p.Allocated[ip.String()] = true
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no free addresses in pool %s", p.Pool)
+}
+
+func (p *addressPool) release(address string) {
+	ip := parseAddress(address)
+	if ip == nil {
+		return
+	}
+	delete(p.Allocated, ip.String())
+}
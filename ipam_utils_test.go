@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/olljanat/docker-bgp-lb/api"
+)
+
+func TestAddressPoolAllocate(t *testing.T) {
+	none := func(net.IP) bool { return false }
+
+	tests := []struct {
+		name       string
+		pool       string
+		mode       string
+		allocated  []string
+		requested  string
+		elsewhere  func(net.IP) bool
+		want       string
+		wantFailed bool
+	}{
+		{"first address skips network address", "10.0.0.0/30", poolModeAnycast, nil, "", none, "10.0.0.1", false},
+		{"next free address", "10.0.0.0/30", poolModeAnycast, []string{"10.0.0.1"}, "", none, "10.0.0.2", false},
+		{"broadcast address is not used", "10.0.0.0/30", poolModeAnycast, []string{"10.0.0.1", "10.0.0.2"}, "", none, "", true},
+		{"point-to-point pool uses both addresses", "10.0.0.0/31", poolModeAnycast, []string{"10.0.0.1"}, "", none, "10.0.0.0", false},
+		{"ipv6 pool skips only network address", "2001:db8::/126", poolModeAnycast, []string{"2001:db8::1", "2001:db8::2"}, "", none, "2001:db8::3", false},
+		{"requested address", "10.0.0.0/24", poolModeAnycast, nil, "10.0.0.10/24", none, "10.0.0.10", false},
+		{"requested address outside pool", "10.0.0.0/24", poolModeAnycast, nil, "10.0.1.10", none, "", true},
+		{"requested network address", "10.0.0.0/24", poolModeAnycast, nil, "10.0.0.0", none, "", true},
+		{"requested broadcast address", "10.0.0.0/24", poolModeAnycast, nil, "10.0.0.255", none, "", true},
+		{"requested address already allocated", "10.0.0.0/24", poolModeAnycast, []string{"10.0.0.10"}, "10.0.0.10", none, "", true},
+		{"shared pool", "192.0.2.1/32", poolModeAnycast, []string{"192.0.2.1"}, "", none, "192.0.2.1", false},
+		{"shared pool with other address", "192.0.2.1/32", poolModeAnycast, nil, "192.0.2.2", none, "", true},
+	}
+	for _, tt := range tests {
+		p, err := newAddressPool(tt.pool, tt.mode)
+		if err != nil {
+			t.Fatalf("%s: newAddressPool(%s) error = %v", tt.name, tt.pool, err)
+		}
+		for _, a := range tt.allocated {
+			p.Allocated[a] = true
+		}
+		ip, err := p.allocate(tt.requested, tt.elsewhere)
+		if (err != nil) != tt.wantFailed {
+			t.Errorf("%s: allocate(%q) error = %v, want failure %v", tt.name, tt.requested, err, tt.wantFailed)
+			continue
+		}
+		if err == nil && !ip.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%s: allocate(%q) = %s, want %s", tt.name, tt.requested, ip, tt.want)
+		}
+		if err == nil && !p.shared() && !p.Allocated[ip.String()] {
+			t.Errorf("%s: allocate(%q) did not reserve %s", tt.name, tt.requested, ip)
+		}
+	}
+}
+
+func TestAddressPoolGateway(t *testing.T) {
+	tests := []struct {
+		pool      string
+		requested string
+		want      string
+		valid     bool
+	}{
+		{"10.0.0.0/24", "", "10.0.0.0/24", true},
+		{"10.0.0.0/24", "10.0.0.254", "10.0.0.254/24", true},
+		{"10.0.0.0/24", "10.0.0.254/24", "10.0.0.254/24", true},
+		{"10.0.0.0/24", "10.0.1.1", "", false},
+		{"2001:db8::/64", "", "2001:db8::/64", true},
+	}
+	for _, tt := range tests {
+		p, err := newAddressPool(tt.pool, "")
+		if err != nil {
+			t.Fatalf("newAddressPool(%s) error = %v", tt.pool, err)
+		}
+		got, err := p.gateway(tt.requested)
+		if (err == nil) != tt.valid {
+			t.Errorf("gateway(%q) of %s error = %v, want valid %v", tt.requested, tt.pool, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("gateway(%q) of %s = %s, want %s", tt.requested, tt.pool, got, tt.want)
+		}
+	}
+}
+
+func TestNewAddressPool(t *testing.T) {
+	tests := []struct {
+		pool  string
+		mode  string
+		want  string
+		valid bool
+	}{
+		{"10.0.0.1/24", "", poolModeAnycast, true},
+		{"10.0.0.0/24", poolModeUnique, poolModeUnique, true},
+		{"10.0.0.0/24", "random", "", false},
+		{"10.0.0.0", "", "", false},
+	}
+	for _, tt := range tests {
+		p, err := newAddressPool(tt.pool, tt.mode)
+		if (err == nil) != tt.valid {
+			t.Errorf("newAddressPool(%s, %q) error = %v, want valid %v", tt.pool, tt.mode, err, tt.valid)
+			continue
+		}
+		if err == nil && (p.Mode != tt.want || p.Pool != "10.0.0.0/24") {
+			t.Errorf("newAddressPool(%s, %q) = %+v", tt.pool, tt.mode, p)
+		}
+	}
+}
+
+func TestRequestAddressLegacyPool(t *testing.T) {
+	stateFile = filepath.Join(t.TempDir(), "bgplb.json")
+	defer func() { stateFile = "/bgplb.json" }()
+	d := &bgpLB{Pools: make(map[string]*addressPool)}
+
+	tests := []struct {
+		poolID  string
+		options map[string]string
+		want    string
+	}{
+		{"192.0.2.10/32", map[string]string{"RequestAddressType": "com.docker.network.gateway"}, "192.0.2.10/32"},
+		{"192.0.2.10/32", nil, "192.0.2.10/32"},
+		{"192.0.2.10/32", nil, "192.0.2.10/32"},
+		{"2001:db8::10/128", nil, "2001:db8::10/128"},
+	}
+	for _, tt := range tests {
+		resp, err := d.RequestAddress(&api.RequestAddressRequest{PoolID: tt.poolID, Options: tt.options})
+		if err != nil {
+			t.Errorf("RequestAddress(%s) error = %v", tt.poolID, err)
+			continue
+		}
+		if resp.Address != tt.want {
+			t.Errorf("RequestAddress(%s) = %s, want %s", tt.poolID, resp.Address, tt.want)
+		}
+	}
+
+	for _, id := range []string{"192.0.2.0/24", "unknown"} {
+		if _, err := d.RequestAddress(&api.RequestAddressRequest{PoolID: id}); err == nil {
+			t.Errorf("RequestAddress(%s) accepted unknown pool", id)
+		}
+	}
+	if err := d.ReleasePool(&api.ReleasePoolRequest{PoolID: "192.0.2.10/32"}); err != nil || len(d.Pools) != 1 {
+		t.Errorf("ReleasePool() error = %v, pools left %v", err, d.Pools)
+	}
+}
+
+// receivingAnnouncer is BGP backend which has received host routes from other hosts.
+type receivingAnnouncer struct {
+	*fakeAnnouncer
+	received map[string][]string
+}
+
+func (r *receivingAnnouncer) receivedHostRoutes(ctx context.Context) map[string][]string {
+	return r.received
+}
+
+func TestRequestAddressUniquePool(t *testing.T) {
+	stateFile = filepath.Join(t.TempDir(), "bgplb.json")
+	bgpAnnouncer = &receivingAnnouncer{fakeAnnouncer: newFakeAnnouncer(), received: map[string][]string{
+		"10.0.0.1/32": {"192.0.2.1"},
+		"10.0.0.2/32": {"192.0.2.2"},
+	}}
+	defer func() { stateFile, bgpAnnouncer = "/bgplb.json", nil }()
+
+	requestAddress := func(d *bgpLB, poolID, address string) (string, error) {
+		resp, err := d.RequestAddress(&api.RequestAddressRequest{PoolID: poolID, Address: address})
+		if err != nil {
+			return "", err
+		}
+		return resp.Address, nil
+	}
+
+	// Anycast pools give same addresses on every host
+	anycast := &bgpLB{Pools: make(map[string]*addressPool)}
+	pool, err := anycast.RequestPool(&api.RequestPoolRequest{Pool: "10.0.0.0/24"})
+	if err != nil {
+		t.Fatalf("RequestPool() error = %v", err)
+	}
+	if got, err := requestAddress(anycast, pool.PoolID, ""); got != "10.0.0.1/32" {
+		t.Errorf("RequestAddress() from anycast pool = %s, %v, want 10.0.0.1/32", got, err)
+	}
+	if _, err := anycast.RequestPool(&api.RequestPoolRequest{Pool: "10.0.0.0/24", Options: map[string]string{"pool_mode": poolModeUnique}}); err == nil {
+		t.Error("RequestPool() accepted same pool with other pool_mode")
+	}
+
+	// Unique pools skip addresses which other hosts announce
+	unique := &bgpLB{Pools: make(map[string]*addressPool)}
+	pool, err = unique.RequestPool(&api.RequestPoolRequest{Pool: "10.0.0.0/24", Options: map[string]string{"pool_mode": poolModeUnique}})
+	if err != nil {
+		t.Fatalf("RequestPool() error = %v", err)
+	}
+	for _, want := range []string{"10.0.0.3/32", "10.0.0.4/32"} {
+		if got, err := requestAddress(unique, pool.PoolID, ""); got != want {
+			t.Errorf("RequestAddress() from unique pool = %s, %v, want %s", got, err, want)
+		}
+	}
+	if _, err := requestAddress(unique, pool.PoolID, "10.0.0.2"); err == nil {
+		t.Error("RequestAddress() gave address which other host announces")
+	}
+
+	single, err := unique.RequestPool(&api.RequestPoolRequest{Pool: "10.0.0.1/32", Options: map[string]string{"pool_mode": poolModeUnique}})
+	if err != nil {
+		t.Fatalf("RequestPool() error = %v", err)
+	}
+	if _, err := requestAddress(unique, single.PoolID, ""); err == nil {
+		t.Error("RequestAddress() gave single address pool which other host announces")
+	}
+}
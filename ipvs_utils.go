@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/moby/ipvs"
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// ipvsLinkName is dummy interface which has addresses of IPVS virtual services so
+	// that kernel accepts traffic to them locally
+	ipvsLinkName = "bgplb-ipvs"
+	// ipvsWeightLabel is container label which sets weight of container in IPVS scheduling
+	ipvsWeightLabel   = "bgplb_weight"
+	defaultIPVSWeight = 1
+)
+
+// ipvsRealServer is local container which receives connections of IPVS virtual services
+// of its network.
+type ipvsRealServer struct {
+	networkID   string
+	containerID string
+	address     net.IP
+	weight      int
+	healthy     bool
+	options     *networkOptions
+}
+
+// currentWeight returns weight of real server. Unhealthy servers keep their existing
+// connections but do not get new ones.
+func (s *ipvsRealServer) currentWeight() int {
+	if !s.healthy {
+		return 0
+	}
+	return s.weight
+}
+
+type ipvsBalancer struct {
+	handle  *ipvs.Handle
+	servers map[string]*ipvsRealServer
+	sync.Mutex
+}
+
+var localBalancer = &ipvsBalancer{servers: make(map[string]*ipvsRealServer)}
+
+func ipvsFamily(ip net.IP) uint16 {
+	if ip.To4() != nil {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+// ipvsServices returns IPVS virtual services of network.
+func ipvsServices(options *networkOptions) []*ipvs.Service {
+	vip := net.ParseIP(options.IPVSAddress)
+	netmask := uint32(0xFFFFFFFF)
+	if vip.To4() == nil {
+		netmask = 128
+	}
+	services := []*ipvs.Service{}
+	for _, port := range options.IPVSPorts {
+		proto, p, _ := parseL4Port(port)
+		services = append(services, &ipvs.Service{
+			Address:       vip,
+			Protocol:      proto,
+			Port:          p,
+			SchedName:     options.IPVSScheduler,
+			AddressFamily: ipvsFamily(vip),
+			Netmask:       netmask,
+		})
+	}
+	return services
+}
+
+// ipvsServiceName formats service as <protocol>:<address>:<port>.
+func ipvsServiceName(service *ipvs.Service) string {
+	for name, proto := range l4Protocols {
+		if proto == service.Protocol {
+			return fmt.Sprintf("%s:%s", name, net.JoinHostPort(service.Address.String(), strconv.Itoa(int(service.Port))))
+		}
+	}
+	return net.JoinHostPort(service.Address.String(), strconv.Itoa(int(service.Port)))
+}
+
+func (s *ipvsRealServer) destination(service *ipvs.Service) *ipvs.Destination {
+	return &ipvs.Destination{
+		Address:         s.address,
+		Port:            service.Port,
+		Weight:          s.currentWeight(),
+		ConnectionFlags: ipvs.ConnectionFlagMasq,
+		AddressFamily:   ipvsFamily(s.address),
+	}
+}
+
+// containerWeight returns IPVS weight of container from its bgplb_weight label.
+func containerWeight(labels map[string]string) int {
+	value, ok := labels[ipvsWeightLabel]
+	if !ok {
+		return defaultIPVSWeight
+	}
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 0 || weight > 65535 {
+		log.Warnf("Label %s value %s is invalid, using weight %d", ipvsWeightLabel, value, defaultIPVSWeight)
+		return defaultIPVSWeight
+	}
+	return weight
+}
+
+// ipvsEndpointID is the nexthop of local route to IPVS address of network.
+func ipvsEndpointID(networkID string) string {
+	return "ipvs-" + networkID
+}
+
+// ipvsLink returns dummy interface for addresses of virtual services, creating it
+// if needed.
+func ipvsLink() (netlink.Link, error) {
+	if link, err := netlink.LinkByName(ipvsLinkName); err == nil {
+		return link, nil
+	}
+	linkAttrs := netlink.NewLinkAttrs()
+	linkAttrs.Name = ipvsLinkName
+	if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: linkAttrs}); err != nil {
+		return nil, fmt.Errorf("ipvsLink: failed to create %s: %w", ipvsLinkName, err)
+	}
+	link, err := netlink.LinkByName(ipvsLinkName)
+	if err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("ipvsLink: failed to start %s: %w", ipvsLinkName, err)
+	}
+	return link, nil
+}
+
+func vipAddr(vip net.IP) *netlink.Addr {
+	addr, _ := netlink.ParseAddr(hostAddress(vip))
+	return addr
+}
+
+// getHandle opens IPVS netlink handle on first use. Caller must hold lock of balancer.
+func (b *ipvsBalancer) getHandle() (*ipvs.Handle, error) {
+	if b.handle != nil {
+		return b.handle, nil
+	}
+	handle, err := ipvs.New("")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open IPVS, is ip_vs kernel module loaded: %w", err)
+	}
+	b.handle = handle
+	return handle, nil
+}
+
+func (b *ipvsBalancer) networkServers(networkID string) int {
+	count := 0
+	for _, s := range b.servers {
+		if s.networkID == networkID {
+			count++
+		}
+	}
+	return count
+}
+
+// addServer adds container as real server of virtual services of its network. First
+// server of the network creates the virtual services and announces their address.
+func (b *ipvsBalancer) addServer(networkID, endpointID string, addresses []net.IP, options *networkOptions) error {
+	vip := net.ParseIP(options.IPVSAddress)
+	server := &ipvsRealServer{networkID: networkID, healthy: true, weight: defaultIPVSWeight, options: options}
+	for _, ip := range addresses {
+		if ipvsFamily(ip) == ipvsFamily(vip) {
+			server.address = ip
+		}
+	}
+	if server.address == nil {
+		return fmt.Errorf("addServer: endpoint %s does not have address of same family as %s", endpointID, vip)
+	}
+	if container, err := endpointContainer(networkID, endpointID); err == nil {
+		server.containerID = container.ID
+		if container.Config != nil {
+			server.weight = containerWeight(container.Config.Labels)
+		}
+	} else {
+		log.Warnf("Cannot inspect container of endpoint %s, using weight %d: %v", endpointID, defaultIPVSWeight, err)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for _, s := range b.servers {
+		if s.networkID == networkID && s.address.Equal(server.address) {
+			return fmt.Errorf("addServer: address %s is already real server, network needs pool with unique address for each container", server.address)
+		}
+	}
+	handle, err := b.getHandle()
+	if err != nil {
+		return fmt.Errorf("addServer: %w", err)
+	}
+
+	first := b.networkServers(networkID) == 0
+	var link netlink.Link
+	if first {
+		if link, err = ipvsLink(); err != nil {
+			return fmt.Errorf("addServer: %w", err)
+		}
+		if err := netlink.AddrReplace(link, vipAddr(vip)); err != nil {
+			return fmt.Errorf("addServer: failed to add %s to %s: %w", vip, ipvsLinkName, err)
+		}
+	}
+	for _, service := range ipvsServices(options) {
+		if !handle.IsServicePresent(service) {
+			if err := handle.NewService(service); err != nil {
+				return fmt.Errorf("addServer: failed to create virtual service %s:%d: %w", vip, service.Port, err)
+			}
+		}
+		if err := handle.NewDestination(service, server.destination(service)); err != nil {
+			return fmt.Errorf("addServer: failed to add real server %s to %s:%d: %w", server.address, vip, service.Port, err)
+		}
+	}
+	b.servers[endpointID] = server
+	log.Infof("Added %s with weight %d to IPVS virtual service %s", server.address, server.weight, vip)
+
+	if first {
+		// Address is announced like container addresses so drift detection and
+		// ownership election apply to it too
+		family := apiGoBGP.Family_AFI_IP
+		if vip.To4() == nil {
+			family = apiGoBGP.Family_AFI_IP6
+		}
+		_, dst, _ := net.ParseCIDR(hostAddress(vip))
+		addLocalRoute(networkID, ipvsEndpointID(networkID), link, dst, family, options)
+	}
+	return nil
+}
+
+// delServer removes endpoint from virtual services. Virtual services are removed and
+// their address withdrawn together with the last server of the network.
+func (b *ipvsBalancer) delServer(endpointID string) {
+	b.Lock()
+	defer b.Unlock()
+	server, ok := b.servers[endpointID]
+	if !ok {
+		return
+	}
+	delete(b.servers, endpointID)
+
+	vip := net.ParseIP(server.options.IPVSAddress)
+	last := b.networkServers(server.networkID) == 0
+	if last {
+		delLocalRoutes(ipvsEndpointID(server.networkID))
+	}
+	for _, service := range ipvsServices(server.options) {
+		var err error
+		if last {
+			err = b.handle.DelService(service)
+		} else {
+			err = b.handle.DelDestination(service, server.destination(service))
+		}
+		if err != nil {
+			log.Errorf("Cannot remove real server %s from %s:%d: %v", server.address, vip, service.Port, err)
+		}
+	}
+	if last {
+		if link, err := netlink.LinkByName(ipvsLinkName); err == nil {
+			netlink.AddrDel(link, vipAddr(vip))
+		}
+	}
+	log.Infof("Removed %s from IPVS virtual service %s", server.address, vip)
+}
+
+// setHealthy updates weights of real servers of container when its health changes.
+func (b *ipvsBalancer) setHealthy(containerID string, healthy bool) {
+	b.Lock()
+	defer b.Unlock()
+	for _, server := range b.servers {
+		if server.containerID != containerID || server.healthy == healthy {
+			continue
+		}
+		server.healthy = healthy
+		for _, service := range ipvsServices(server.options) {
+			if err := b.handle.UpdateDestination(service, server.destination(service)); err != nil {
+				log.Errorf("Cannot update weight of real server %s: %v", server.address, err)
+			}
+		}
+		log.Infof("Container %s is healthy=%v, weight of %s in IPVS is %d", containerID[:11], healthy, server.address, server.currentWeight())
+	}
+}
+
+type ipvsDestinationStatus struct {
+	Address             string
+	Weight              int
+	ActiveConnections   int
+	InactiveConnections int
+}
+
+type ipvsServiceStatus struct {
+	Service      string
+	Scheduler    string
+	Connections  uint32
+	Destinations []ipvsDestinationStatus
+}
+
+// status returns virtual services which plugin manages with their real servers.
+func (b *ipvsBalancer) status() []ipvsServiceStatus {
+	b.Lock()
+	defer b.Unlock()
+	status := []ipvsServiceStatus{}
+	if b.handle == nil {
+		return status
+	}
+	seen := make(map[string]bool)
+	for _, server := range b.servers {
+		for _, service := range ipvsServices(server.options) {
+			name := ipvsServiceName(service)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			s, err := b.handle.GetService(service)
+			if err != nil {
+				continue
+			}
+			destinations, _ := b.handle.GetDestinations(service)
+			serviceStatus := ipvsServiceStatus{Service: name, Scheduler: s.SchedName, Connections: s.Stats.Connections, Destinations: []ipvsDestinationStatus{}}
+			for _, d := range destinations {
+				serviceStatus.Destinations = append(serviceStatus.Destinations, ipvsDestinationStatus{
+					Address:             d.Address.String(),
+					Weight:              d.Weight,
+					ActiveConnections:   d.ActiveConnections,
+					InactiveConnections: d.InactiveConnections,
+				})
+			}
+			status = append(status, serviceStatus)
+		}
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Service < status[j].Service })
+	return status
+}
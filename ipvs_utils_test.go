@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/moby/ipvs"
+	"github.com/vishvananda/netlink"
+)
+
+func TestIPVSServices(t *testing.T) {
+	for _, options := range []map[string]string{
+		{optIPVSAddress: "192.0.2.100"},
+		{optIPVSPorts: "tcp:80"},
+		{optIPVSAddress: "192.0.2.100", optIPVSPorts: "tcp:80", optIPVSSched: "fifo"},
+	} {
+		if _, err := parseNetworkOptions(testGenericOptions(options)); err == nil {
+			t.Errorf("parseNetworkOptions(%v) accepted incomplete IPVS configuration", options)
+		}
+	}
+	options, err := parseNetworkOptions(testGenericOptions(map[string]string{optIPVSAddress: "2001:db8::100", optIPVSPorts: "tcp:80,udp:53"}))
+	if err != nil {
+		t.Fatalf("parseNetworkOptions() error = %v", err)
+	}
+
+	services := ipvsServices(options)
+	names := []string{}
+	for _, s := range services {
+		names = append(names, ipvsServiceName(s))
+		if s.SchedName != defaultIPVSScheduler || s.AddressFamily != syscall.AF_INET6 || s.Netmask != 128 {
+			t.Errorf("service %s uses scheduler %s, family %d, netmask %d", ipvsServiceName(s), s.SchedName, s.AddressFamily, s.Netmask)
+		}
+	}
+	if len(names) != 2 || names[0] != "tcp:[2001:db8::100]:80" || names[1] != "udp:[2001:db8::100]:53" {
+		t.Errorf("ipvsServices() = %v, want tcp and udp services", names)
+	}
+
+	for labels, want := range map[string]int{"": defaultIPVSWeight, "5": 5, "0": 0, "-1": defaultIPVSWeight, "heavy": defaultIPVSWeight} {
+		l := map[string]string{ipvsWeightLabel: labels}
+		if labels == "" {
+			l = nil
+		}
+		if got := containerWeight(l); got != want {
+			t.Errorf("containerWeight(%v) = %d, want %d", l, got, want)
+		}
+	}
+}
+
+// testIPVSHandle returns IPVS handle. Test is skipped when kernel does not keep
+// virtual services, e.g. without ip_vs module or in sandboxed kernels.
+func testIPVSHandle(t *testing.T) *ipvs.Handle {
+	t.Helper()
+	handle, err := ipvs.New("")
+	if err != nil {
+		t.Skipf("IPVS is not available: %v", err)
+	}
+	probe := &ipvs.Service{Address: net.ParseIP("192.0.2.200"), Protocol: syscall.IPPROTO_TCP, Port: 9, SchedName: defaultIPVSScheduler, AddressFamily: syscall.AF_INET, Netmask: 0xFFFFFFFF}
+	if err := handle.NewService(probe); err != nil {
+		t.Skipf("IPVS is not available: %v", err)
+	}
+	defer handle.DelService(probe)
+	if services, err := handle.GetServices(); err != nil || len(services) == 0 {
+		t.Skipf("IPVS does not keep virtual services: %v", err)
+	}
+	return handle
+}
+
+func TestIPVSBalancer(t *testing.T) {
+	handle := testIPVSHandle(t)
+	// Containers are not inspected without Docker and servers get default weight
+	t.Setenv("DOCKER_HOST", "unix:///nonexistent/docker.sock")
+	fake := setupDriftTest(t)
+	b := &ipvsBalancer{handle: handle, servers: make(map[string]*ipvsRealServer)}
+	// Existing interface is used as is, veth works also where dummy links are not supported
+	link := testRouteLink(t, ipvsLinkName)
+	options, err := parseNetworkOptions(testGenericOptions(map[string]string{optIPVSAddress: "192.0.2.100", optIPVSPorts: "tcp:80"}))
+	if err != nil {
+		t.Fatalf("parseNetworkOptions() error = %v", err)
+	}
+	service := ipvsServices(options)[0]
+	destinations := func() []string {
+		t.Helper()
+		if !handle.IsServicePresent(service) {
+			return nil
+		}
+		list, err := handle.GetDestinations(service)
+		if err != nil {
+			t.Fatalf("GetDestinations() error = %v", err)
+		}
+		addresses := []string{}
+		for _, d := range list {
+			addresses = append(addresses, d.Address.String())
+		}
+		return addresses
+	}
+
+	if err := b.addServer("net1", "ep1", []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}, options); err != nil {
+		t.Fatalf("addServer() error = %v", err)
+	}
+	defer handle.DelService(service)
+	if err := b.addServer("net1", "ep2", []net.IP{net.ParseIP("10.0.0.2")}, options); err != nil {
+		t.Fatalf("addServer() error = %v", err)
+	}
+	if got := destinations(); len(got) != 2 {
+		t.Errorf("virtual service has real servers %v, want 10.0.0.1 and 10.0.0.2", got)
+	}
+	if addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4); len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("192.0.2.100")) {
+		t.Errorf("%s has addresses %v, want virtual service address", ipvsLinkName, addrs)
+	}
+	if fake.announced["192.0.2.100/32"] == nil || !kernelRouteExists(t, &net.IPNet{IP: net.ParseIP("192.0.2.100").To4(), Mask: net.CIDRMask(32, 32)}) {
+		t.Error("addServer() did not route and announce virtual service address")
+	}
+	if err := b.addServer("net1", "ep3", []net.IP{net.ParseIP("10.0.0.2")}, options); err == nil {
+		t.Error("addServer() accepted address which is already real server")
+	}
+	if err := b.addServer("net1", "ep4", []net.IP{net.ParseIP("2001:db8::4")}, options); err == nil {
+		t.Error("addServer() accepted endpoint without address of virtual service family")
+	}
+
+	b.delServer("ep1")
+	if got := destinations(); len(got) != 1 || got[0] != "10.0.0.2" || fake.announced["192.0.2.100/32"] == nil {
+		t.Errorf("delServer() left real servers %v", got)
+	}
+	b.delServer("ep2")
+	if addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4); handle.IsServicePresent(service) || fake.announced["192.0.2.100/32"] != nil || len(addrs) != 0 {
+		t.Error("delServer() of last real server kept virtual service")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Number and interval of gratuitous ARP / unsolicited NA packets sent on takeover
+	l2AnnounceCount    = 3
+	l2AnnounceInterval = 500 * time.Millisecond
+)
+
+func htons(v uint16) uint16 {
+	return (v << 8) | (v >> 8)
+}
+
+func sendRawFrame(iface *net.Interface, frame []byte) error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	addr := &unix.SockaddrLinklayer{
+		Ifindex: iface.Index,
+		Halen:   6,
+	}
+	copy(addr.Addr[:], frame[0:6])
+	return unix.Sendto(fd, frame, 0, addr)
+}
+
+// gratuitousARP builds broadcast ARP request where sender and target address is vip.
+func gratuitousARP(iface *net.Interface, vip net.IP) []byte {
+	frame := make([]byte, 0, 42)
+	frame = append(frame, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = binary.BigEndian.AppendUint16(frame, unix.ETH_P_ARP)
+
+	frame = binary.BigEndian.AppendUint16(frame, 1) // Ethernet
+	frame = binary.BigEndian.AppendUint16(frame, unix.ETH_P_IP)
+	frame = append(frame, 6, 4)
+	frame = binary.BigEndian.AppendUint16(frame, 1) // request
+	frame = append(frame, iface.HardwareAddr...)
+	frame = append(frame, vip.To4()...)
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, vip.To4()...)
+	return frame
+}
+
+// unsolicitedNA builds neighbor advertisement of vip with override flag to all nodes multicast address.
+func unsolicitedNA(iface *net.Interface, src, vip net.IP) []byte {
+	dst := net.ParseIP("ff02::1")
+
+	icmp := make([]byte, 0, 32)
+	icmp = append(icmp, 136, 0, 0, 0)                      // type, code, checksum
+	icmp = binary.BigEndian.AppendUint32(icmp, 0x20000000) // override flag
+	icmp = append(icmp, vip.To16()...)
+	icmp = append(icmp, 2, 1) // target link-layer address option
+	icmp = append(icmp, iface.HardwareAddr...)
+
+	pseudo := make([]byte, 0, 40+len(icmp))
+	pseudo = append(pseudo, src.To16()...)
+	pseudo = append(pseudo, dst.To16()...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(icmp)))
+	pseudo = append(pseudo, 0, 0, 0, unix.IPPROTO_ICMPV6)
+	pseudo = append(pseudo, icmp...)
+	binary.BigEndian.PutUint16(icmp[2:], checksum(pseudo))
+
+	frame := make([]byte, 0, 14+40+len(icmp))
+	frame = append(frame, 0x33, 0x33, 0, 0, 0, 1)
+	frame = append(frame, iface.HardwareAddr...)
+	frame = binary.BigEndian.AppendUint16(frame, unix.ETH_P_IPV6)
+	frame = append(frame, 0x60, 0, 0, 0)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(icmp)))
+	frame = append(frame, unix.IPPROTO_ICMPV6, 255)
+	frame = append(frame, src.To16()...)
+	frame = append(frame, dst.To16()...)
+	frame = append(frame, icmp...)
+	return frame
+}
+
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func linkLocalAddress(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+// defaultRouteInterface returns name of the interface which has IPv4 default route.
+func defaultRouteInterface() (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", err
+	}
+	for _, route := range routes {
+		if route.Dst == nil || route.Dst.String() == "0.0.0.0/0" {
+			link, err := netlink.LinkByIndex(route.LinkIndex)
+			if err != nil {
+				return "", err
+			}
+			return link.Attrs().Name, nil
+		}
+	}
+	return "", fmt.Errorf("default route not found")
+}
+
+func proxyNeigh(link netlink.Link, vip net.IP) *netlink.Neigh {
+	family := netlink.FAMILY_V4
+	if vip.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	return &netlink.Neigh{
+		LinkIndex: link.Attrs().Index,
+		Family:    family,
+		Flags:     netlink.NTF_PROXY,
+		IP:        vip,
+	}
+}
+
+// l2Announce makes this host answer ARP/NDP for vip on interface ifName and informs
+// other hosts in the segment about the new owner with gratuitous ARP / unsolicited NA.
+func l2Announce(ifName string, vip net.IP) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("l2Announce: failed to find interface %s: %w", ifName, err)
+	}
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return fmt.Errorf("l2Announce: failed to find interface %s: %w", ifName, err)
+	}
+
+	if vip.To4() == nil {
+		// Kernel answers neighbor solicitations for proxy entries only when proxy_ndp is enabled
+		if err := setProxyNDP(ifName); err != nil {
+			return fmt.Errorf("l2Announce: %w", err)
+		}
+	}
+	if err := netlink.NeighSet(proxyNeigh(link, vip)); err != nil {
+		return fmt.Errorf("l2Announce: failed to add proxy neighbor %s: %w", vip, err)
+	}
+
+	go func() {
+		for i := 0; i < l2AnnounceCount; i++ {
+			var frame []byte
+			if vip.To4() != nil {
+				frame = gratuitousARP(iface, vip)
+			} else {
+				src := linkLocalAddress(iface)
+				if src == nil {
+					src = vip
+				}
+				frame = unsolicitedNA(iface, src, vip)
+			}
+			if err := sendRawFrame(iface, frame); err != nil {
+				log.Errorf("l2Announce: failed to send announcement of %s to %s: %v", vip, ifName, err)
+			}
+			time.Sleep(l2AnnounceInterval)
+		}
+	}()
+
+	return nil
+}
+
+// l2Release stops answering ARP/NDP for vip on interface ifName.
+func l2Release(ifName string, vip net.IP) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("l2Release: failed to find interface %s: %w", ifName, err)
+	}
+	if err := netlink.NeighDel(proxyNeigh(link, vip)); err != nil {
+		return fmt.Errorf("l2Release: failed to remove proxy neighbor %s: %w", vip, err)
+	}
+	return nil
+}
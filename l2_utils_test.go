@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want uint16
+	}{
+		{[]byte{}, 0xffff},
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0x220d},
+		{[]byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6}, 0x2304},
+		{[]byte{0xff, 0xff, 0xff, 0xff}, 0x0000},
+	}
+	for _, tt := range tests {
+		if got := checksum(tt.data); got != tt.want {
+			t.Errorf("checksum(%x) = %#04x, want %#04x", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestUnsolicitedNA(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	iface := &net.Interface{Index: 1, Name: "eth0", HardwareAddr: mac}
+	src := net.ParseIP("fe80::42:acff:fe11:2")
+	vip := net.ParseIP("2001:db8::10")
+
+	frame := unsolicitedNA(iface, src, vip)
+	if len(frame) != 14+40+32 {
+		t.Fatalf("unsolicitedNA() frame length = %d, want %d", len(frame), 14+40+32)
+	}
+	if !bytes.Equal(frame[0:6], []byte{0x33, 0x33, 0, 0, 0, 1}) || !bytes.Equal(frame[6:12], mac) {
+		t.Errorf("unsolicitedNA() ethernet addresses = %x -> %x", frame[6:12], frame[0:6])
+	}
+	if ethType := binary.BigEndian.Uint16(frame[12:]); ethType != unix.ETH_P_IPV6 {
+		t.Errorf("unsolicitedNA() ethertype = %#04x, want %#04x", ethType, unix.ETH_P_IPV6)
+	}
+
+	ip := frame[14:54]
+	if ip[0]>>4 != 6 || ip[6] != unix.IPPROTO_ICMPV6 || ip[7] != 255 || binary.BigEndian.Uint16(ip[4:]) != 32 {
+		t.Errorf("unsolicitedNA() IPv6 header = %x", ip)
+	}
+	if !net.IP(ip[8:24]).Equal(src) || !net.IP(ip[24:40]).Equal(net.ParseIP("ff02::1")) {
+		t.Errorf("unsolicitedNA() IPv6 addresses = %s -> %s", net.IP(ip[8:24]), net.IP(ip[24:40]))
+	}
+
+	icmp := frame[54:]
+	if icmp[0] != 136 || icmp[4]&0x20 == 0 {
+		t.Errorf("unsolicitedNA() ICMPv6 type %d flags %#02x, want neighbor advertisement with override flag", icmp[0], icmp[4])
+	}
+	if !net.IP(icmp[8:24]).Equal(vip) || !bytes.Equal(icmp[26:32], mac) {
+		t.Errorf("unsolicitedNA() target %s with link-layer address %x", net.IP(icmp[8:24]), icmp[26:32])
+	}
+
+	// Checksum over pseudo header and message including checksum itself is zero
+	pseudo := append([]byte{}, ip[8:40]...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(icmp)))
+	pseudo = append(pseudo, 0, 0, 0, unix.IPPROTO_ICMPV6)
+	pseudo = append(pseudo, icmp...)
+	if sum := checksum(pseudo); sum != 0 {
+		t.Errorf("unsolicitedNA() has invalid ICMPv6 checksum, verification returned %#04x", sum)
+	}
+}
+
+func TestL2AnnounceIPv6(t *testing.T) {
+	link := testVeth(t, "bgplbtest1")
+	hostIPv6Conf = "/proc/sys/net/ipv6/conf"
+	defer func() { hostIPv6Conf = "/host/proc/sys/net/ipv6/conf" }()
+	if _, err := os.Stat(hostIPv6Conf); err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	netlink.LinkSetUp(link)
+	vip := net.ParseIP("2001:db8::10")
+
+	if err := l2Announce(link.Attrs().Name, vip); err != nil {
+		t.Fatalf("l2Announce() error = %v", err)
+	}
+	if v := readSysctl(t, "/proc/sys/net/ipv6/conf/bgplbtest1/proxy_ndp"); v != "1" {
+		t.Errorf("proxy_ndp = %s, want 1", v)
+	}
+	hasProxy := func() bool {
+		neighs, _ := netlink.NeighProxyList(link.Attrs().Index, netlink.FAMILY_V6)
+		for _, n := range neighs {
+			if n.IP.Equal(vip) {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasProxy() {
+		t.Errorf("l2Announce() did not add proxy neighbor %s", vip)
+	}
+	if err := l2Release(link.Attrs().Name, vip); err != nil {
+		t.Fatalf("l2Release() error = %v", err)
+	}
+	if hasProxy() {
+		t.Errorf("l2Release() did not remove proxy neighbor %s", vip)
+	}
+}
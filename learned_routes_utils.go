@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const defaultInstallRoutesTable = 179
+
+var (
+	installRoutesTable = 0
+	importPrefixes     []*net.IPNet
+)
+
+// loadInstallRoutesConfig reads configuration for installing routes received from
+// BGP peers to the kernel. Feature is disabled when INSTALL_ROUTES is not "true".
+func loadInstallRoutesConfig() error {
+	if os.Getenv("INSTALL_ROUTES") != "true" {
+		return nil
+	}
+
+	installRoutesTable = defaultInstallRoutesTable
+	if v := os.Getenv("INSTALL_ROUTES_TABLE"); v != "" {
+		table, err := strconv.Atoi(v)
+		if err != nil || table <= 0 {
+			return fmt.Errorf("Environment variable INSTALL_ROUTES_TABLE value is invalid\r\n")
+		}
+		installRoutesTable = table
+	}
+
+	var err error
+	if importPrefixes, err = parsePrefixList("IMPORT_PREFIXES"); err != nil {
+		return err
+	}
+	return checkInstallRoutesRule()
+}
+
+// checkInstallRoutesRule returns an error if routes would be installed to a table
+// which no routing rule uses, because then they would silently have no effect.
+func checkInstallRoutesRule() error {
+	if installRoutesTable == unix.RT_TABLE_MAIN {
+		return nil
+	}
+	rules, err := netlink.RuleList(netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("Cannot list routing rules: %v\r\n", err)
+	}
+	for _, rule := range rules {
+		if rule.Table == installRoutesTable {
+			return nil
+		}
+	}
+	return fmt.Errorf("Routing table %d of INSTALL_ROUTES_TABLE is not used by any routing rule, add one with e.g. ip rule add to 10.0.0.0/24 lookup %d or set INSTALL_ROUTES_TABLE=%d\r\n", installRoutesTable, installRoutesTable, unix.RT_TABLE_MAIN)
+}
+
+// importStatements generates defined sets and statements which accept only routes
+// inside IMPORT_PREFIXES. Nil statements mean that all routes are accepted.
+func importStatements() ([]*apiGoBGP.DefinedSet, []*apiGoBGP.Statement) {
+	if len(importPrefixes) == 0 {
+		return nil, nil
+	}
+
+	sets := []*apiGoBGP.DefinedSet{}
+	statements := []*apiGoBGP.Statement{}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		prefixSet := &apiGoBGP.DefinedSet{
+			DefinedType: apiGoBGP.DefinedType_PREFIX,
+			Name:        fmt.Sprintf("%s-%s", importPolicyName, family),
+		}
+		for _, prefix := range importPrefixes {
+			ones, bits := prefix.Mask.Size()
+			if (family == "ipv4") != (bits == 32) {
+				continue
+			}
+			prefixSet.Prefixes = append(prefixSet.Prefixes, &apiGoBGP.Prefix{
+				IpPrefix:      prefix.String(),
+				MaskLengthMin: uint32(ones),
+				MaskLengthMax: uint32(bits),
+			})
+		}
+		if len(prefixSet.Prefixes) == 0 {
+			continue
+		}
+		sets = append(sets, prefixSet)
+		statements = append(statements, &apiGoBGP.Statement{
+			Name: prefixSet.Name,
+			Conditions: &apiGoBGP.Conditions{
+				PrefixSet: &apiGoBGP.MatchSet{Type: apiGoBGP.MatchSet_ANY, Name: prefixSet.Name},
+			},
+			Actions: &apiGoBGP.Actions{RouteAction: apiGoBGP.RouteAction_ACCEPT},
+		})
+	}
+
+	return sets, statements
+}
+
+func pathNextHop(path *apiGoBGP.Path) net.IP {
+	for _, attr := range path.Pattrs {
+		nextHop := &apiGoBGP.NextHopAttribute{}
+		if attr.MessageIs(nextHop) && attr.UnmarshalTo(nextHop) == nil {
+			return net.ParseIP(nextHop.NextHop)
+		}
+		mpReach := &apiGoBGP.MpReachNLRIAttribute{}
+		if attr.MessageIs(mpReach) && attr.UnmarshalTo(mpReach) == nil && len(mpReach.NextHops) > 0 {
+			return net.ParseIP(mpReach.NextHops[0])
+		}
+	}
+	return nil
+}
+
+// pathAttributes are the attributes which decide if path is as good as the best
+// path so that both can be used for multipath routing.
+type pathAttributes struct {
+	localPref  uint32
+	asPathLen  int
+	neighborAS uint32
+	origin     uint32
+	med        uint32
+}
+
+func multipathAttributes(path *apiGoBGP.Path) pathAttributes {
+	attrs := pathAttributes{localPref: 100}
+	for _, attr := range path.Pattrs {
+		localPref := &apiGoBGP.LocalPrefAttribute{}
+		asPath := &apiGoBGP.AsPathAttribute{}
+		origin := &apiGoBGP.OriginAttribute{}
+		med := &apiGoBGP.MultiExitDiscAttribute{}
+		switch {
+		case attr.MessageIs(localPref) && attr.UnmarshalTo(localPref) == nil:
+			attrs.localPref = localPref.LocalPref
+		case attr.MessageIs(asPath) && attr.UnmarshalTo(asPath) == nil:
+			for _, segment := range asPath.Segments {
+				if len(segment.Numbers) == 0 {
+					continue
+				}
+				if attrs.asPathLen == 0 {
+					attrs.neighborAS = segment.Numbers[0]
+				}
+				// AS_SET counts as one AS like in best path selection
+				if segment.Type == 1 {
+					attrs.asPathLen++
+				} else {
+					attrs.asPathLen += len(segment.Numbers)
+				}
+			}
+		case attr.MessageIs(origin) && attr.UnmarshalTo(origin) == nil:
+			attrs.origin = origin.Origin
+		case attr.MessageIs(med) && attr.UnmarshalTo(med) == nil:
+			attrs.med = med.Med
+		}
+	}
+	return attrs
+}
+
+// bestNextHops returns next hops of the best path and of paths which are equal to it
+// by multipath rules: same local preference, AS path length, origin, MED and
+// neighboring AS. Nothing is returned when the best path is not received from a peer.
+func bestNextHops(paths []*apiGoBGP.Path) []net.IP {
+	var best *apiGoBGP.Path
+	for _, p := range paths {
+		if p.Best {
+			best = p
+			break
+		}
+	}
+	if best == nil || net.ParseIP(best.NeighborIp) == nil || best.IsNexthopInvalid {
+		return nil
+	}
+
+	bestAttrs := multipathAttributes(best)
+	nextHops := []net.IP{}
+	for _, p := range paths {
+		if net.ParseIP(p.NeighborIp) == nil || p.IsNexthopInvalid || p.IsWithdraw {
+			continue
+		}
+		if p != best && multipathAttributes(p) != bestAttrs {
+			continue
+		}
+		nh := pathNextHop(p)
+		if nh == nil || nh.Equal(net.ParseIP(routerID)) || slices.ContainsFunc(nextHops, nh.Equal) {
+			continue
+		}
+		nextHops = append(nextHops, nh)
+	}
+	return nextHops
+}
+
+// receivedNextHops returns next hops of paths to prefix which were received from peers
+// and which BGP best path selection would use.
+func receivedNextHops(ctx context.Context, prefix *net.IPNet) []net.IP {
+	request := &apiGoBGP.ListPathRequest{
+		TableType: apiGoBGP.TableType_GLOBAL,
+		Family:    &apiGoBGP.Family{Afi: apiGoBGP.Family_AFI_IP, Safi: apiGoBGP.Family_SAFI_UNICAST},
+		Prefixes:  []*apiGoBGP.TableLookupPrefix{{Prefix: prefix.String()}},
+	}
+	if prefix.IP.To4() == nil {
+		request.Family.Afi = apiGoBGP.Family_AFI_IP6
+	}
+
+	nextHops := []net.IP{}
+	callback := func(d *apiGoBGP.Destination) {
+		nextHops = append(nextHops, bestNextHops(d.Paths)...)
+	}
+	if err := bgpServer.ListPath(ctx, request, callback); err != nil {
+		log.Errorf("receivedNextHops: failed to list paths: %v", err)
+	}
+
+	return nextHops
+}
+
+// syncLearnedRoute makes kernel route to prefix in INSTALL_ROUTES_TABLE match paths
+// received from peers. Multiple paths are installed as ECMP route.
+func syncLearnedRoute(ctx context.Context, prefix *net.IPNet) {
+	route := &netlink.Route{
+		Dst:      prefix,
+		Table:    installRoutesTable,
+		Protocol: unix.RTPROT_BGP,
+	}
+
+	nextHops := receivedNextHops(ctx, prefix)
+	if len(nextHops) == 0 {
+		if err := netlink.RouteDel(route); err == nil {
+			log.Infof("Removed learned route %s from table %d", prefix, installRoutesTable)
+		}
+		return
+	}
+
+	if len(nextHops) == 1 {
+		route.Gw = nextHops[0]
+	} else {
+		for _, nh := range nextHops {
+			route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{Gw: nh})
+		}
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		log.Errorf("Cannot install learned route %s via %v to table %d: %v", prefix, nextHops, installRoutesTable, err)
+		return
+	}
+	log.Infof("Installed learned route %s via %v to table %d", prefix, nextHops, installRoutesTable)
+}
+
+// flushLearnedRoutes removes routes left to INSTALL_ROUTES_TABLE by previous run of the plugin.
+func flushLearnedRoutes() {
+	filter := &netlink.Route{Table: installRoutesTable, Protocol: unix.RTPROT_BGP}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		log.Errorf("flushLearnedRoutes: failed to list routes: %v", err)
+		return
+	}
+	for _, route := range routes {
+		netlink.RouteDel(&route)
+	}
+}
+
+// resyncLearnedRoutes syncs every prefix of the BGP table and every route in
+// INSTALL_ROUTES_TABLE. It is used when table events had to be dropped.
+func resyncLearnedRoutes(ctx context.Context) {
+	log.Warn("BGP table events were dropped, syncing all learned routes")
+	prefixes := make(map[string]*net.IPNet)
+	for _, afi := range []apiGoBGP.Family_Afi{apiGoBGP.Family_AFI_IP, apiGoBGP.Family_AFI_IP6} {
+		request := &apiGoBGP.ListPathRequest{
+			TableType: apiGoBGP.TableType_GLOBAL,
+			Family:    &apiGoBGP.Family{Afi: afi, Safi: apiGoBGP.Family_SAFI_UNICAST},
+		}
+		if err := bgpServer.ListPath(ctx, request, func(d *apiGoBGP.Destination) {
+			if _, ipnet, err := net.ParseCIDR(d.Prefix); err == nil {
+				prefixes[ipnet.String()] = ipnet
+			}
+		}); err != nil {
+			log.Errorf("resyncLearnedRoutes: failed to list paths: %v", err)
+		}
+	}
+
+	filter := &netlink.Route{Table: installRoutesTable, Protocol: unix.RTPROT_BGP}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		log.Errorf("resyncLearnedRoutes: failed to list routes: %v", err)
+	}
+	for _, route := range routes {
+		if route.Dst != nil {
+			prefixes[route.Dst.String()] = route.Dst
+		}
+	}
+
+	for _, prefix := range prefixes {
+		syncLearnedRoute(ctx, prefix)
+	}
+}
+
+// installLearnedRoutes follows routes received from BGP peers and installs them to
+// the kernel routing table INSTALL_ROUTES_TABLE.
+func installLearnedRoutes(ctx context.Context) {
+	if installRoutesTable == 0 {
+		return
+	}
+	log.Infof("Installing routes received from BGP peers to table %d", installRoutesTable)
+	flushLearnedRoutes()
+
+	prefixes := make(chan *net.IPNet, 1024)
+	// resync works as a flag which is set when prefixes is full. Callback must not
+	// block because that would stall the BGP server.
+	resync := make(chan struct{}, 1)
+	err := bgpServer.WatchEvent(ctx, &apiGoBGP.WatchEventRequest{
+		Table: &apiGoBGP.WatchEventRequest_Table{
+			Filters: []*apiGoBGP.WatchEventRequest_Table_Filter{
+				{Type: apiGoBGP.WatchEventRequest_Table_Filter_POST_POLICY, Init: true},
+			},
+		},
+	}, func(r *apiGoBGP.WatchEventResponse) {
+		if table := r.GetTable(); table != nil {
+			for _, p := range table.Paths {
+				prefix := &apiGoBGP.IPAddressPrefix{}
+				if p.Nlri == nil || p.Nlri.UnmarshalTo(prefix) != nil {
+					continue
+				}
+				_, ipnet, err := net.ParseCIDR(fmt.Sprintf("%s/%d", prefix.Prefix, prefix.PrefixLen))
+				if err != nil {
+					continue
+				}
+				select {
+				case prefixes <- ipnet:
+				default:
+					select {
+					case resync <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	})
+	if err != nil {
+		log.Errorf("installLearnedRoutes: cannot watch BGP table: %v", err)
+		return
+	}
+
+	for {
+		select {
+		case prefix := <-prefixes:
+			syncLearnedRoute(ctx, prefix)
+		case <-resync:
+			resyncLearnedRoutes(ctx)
+		case <-ctx.Done():
+			flushLearnedRoutes()
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+	apb "google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestImportStatements(t *testing.T) {
+	defer func() { importPrefixes = nil }()
+
+	type want struct {
+		name     string
+		prefixes map[string][2]uint32
+	}
+	tests := []struct {
+		prefixes []string
+		want     []want
+	}{
+		{nil, nil},
+		{[]string{"10.0.0.0/8"}, []want{
+			{importPolicyName + "-ipv4", map[string][2]uint32{"10.0.0.0/8": {8, 32}}},
+		}},
+		{[]string{"10.0.0.0/8", "192.168.0.0/16", "2001:db8::/32"}, []want{
+			{importPolicyName + "-ipv4", map[string][2]uint32{"10.0.0.0/8": {8, 32}, "192.168.0.0/16": {16, 32}}},
+			{importPolicyName + "-ipv6", map[string][2]uint32{"2001:db8::/32": {32, 128}}},
+		}},
+		{[]string{"2001:db8::/32"}, []want{
+			{importPolicyName + "-ipv6", map[string][2]uint32{"2001:db8::/32": {32, 128}}},
+		}},
+	}
+	for _, tt := range tests {
+		importPrefixes = nil
+		for _, p := range tt.prefixes {
+			_, ipnet, _ := net.ParseCIDR(p)
+			importPrefixes = append(importPrefixes, ipnet)
+		}
+		sets, statements := importStatements()
+		if len(statements) != len(tt.want) || len(sets) != len(tt.want) {
+			t.Errorf("importStatements() with %v returned %d sets and %d statements, want %d", tt.prefixes, len(sets), len(statements), len(tt.want))
+			continue
+		}
+		for i, s := range statements {
+			w := tt.want[i]
+			if s.Name != w.name || s.Conditions.PrefixSet.Name != sets[i].Name || s.Actions.RouteAction != apiGoBGP.RouteAction_ACCEPT {
+				t.Errorf("importStatements() with %v statement %d = %v, want accept of %s", tt.prefixes, i, s, w.name)
+			}
+			if len(sets[i].Prefixes) != len(w.prefixes) {
+				t.Errorf("importStatements() with %v set %s has %d prefixes, want %d", tt.prefixes, sets[i].Name, len(sets[i].Prefixes), len(w.prefixes))
+			}
+			for _, p := range sets[i].Prefixes {
+				lengths, ok := w.prefixes[p.IpPrefix]
+				if !ok || p.MaskLengthMin != lengths[0] || p.MaskLengthMax != lengths[1] {
+					t.Errorf("importStatements() with %v set %s has %s %d-%d", tt.prefixes, sets[i].Name, p.IpPrefix, p.MaskLengthMin, p.MaskLengthMax)
+				}
+			}
+		}
+	}
+}
+
+func testPath(t *testing.T, neighbor, nextHop string, best bool, localPref uint32, asPath ...uint32) *apiGoBGP.Path {
+	t.Helper()
+	nh, _ := apb.New(&apiGoBGP.NextHopAttribute{NextHop: nextHop})
+	origin, _ := apb.New(&apiGoBGP.OriginAttribute{Origin: 0})
+	lp, _ := apb.New(&apiGoBGP.LocalPrefAttribute{LocalPref: localPref})
+	as, _ := apb.New(&apiGoBGP.AsPathAttribute{Segments: []*apiGoBGP.AsSegment{{Type: 2, Numbers: asPath}}})
+	return &apiGoBGP.Path{NeighborIp: neighbor, Best: best, Pattrs: []*apb.Any{nh, origin, lp, as}}
+}
+
+func TestBestNextHops(t *testing.T) {
+	routerID = "192.0.2.254"
+	defer func() { routerID = "" }()
+
+	tests := []struct {
+		name  string
+		paths []*apiGoBGP.Path
+		want  []string
+	}{
+		{"no best path", []*apiGoBGP.Path{testPath(t, "192.0.2.1", "192.0.2.1", false, 100, 65001)}, nil},
+		{"best path only", []*apiGoBGP.Path{
+			testPath(t, "192.0.2.1", "192.0.2.1", true, 100, 65001),
+			testPath(t, "192.0.2.2", "192.0.2.2", false, 100, 65002, 65010),
+		}, []string{"192.0.2.1"}},
+		{"equal paths", []*apiGoBGP.Path{
+			testPath(t, "192.0.2.1", "192.0.2.1", true, 100, 65001, 65010),
+			testPath(t, "192.0.2.2", "192.0.2.2", false, 100, 65001, 65011),
+		}, []string{"192.0.2.1", "192.0.2.2"}},
+		{"lower local preference", []*apiGoBGP.Path{
+			testPath(t, "192.0.2.1", "192.0.2.1", true, 200, 65001),
+			testPath(t, "192.0.2.2", "192.0.2.2", false, 100, 65001),
+		}, []string{"192.0.2.1"}},
+		{"other neighboring AS", []*apiGoBGP.Path{
+			testPath(t, "192.0.2.1", "192.0.2.1", true, 100, 65001),
+			testPath(t, "192.0.2.2", "192.0.2.2", false, 100, 65002),
+		}, []string{"192.0.2.1"}},
+		{"same next hop once", []*apiGoBGP.Path{
+			testPath(t, "192.0.2.1", "192.0.2.10", true, 100, 65001),
+			testPath(t, "192.0.2.2", "192.0.2.10", false, 100, 65001),
+		}, []string{"192.0.2.10"}},
+		{"locally originated best path", []*apiGoBGP.Path{
+			testPath(t, "", "0.0.0.0", true, 100),
+			testPath(t, "192.0.2.1", "192.0.2.1", false, 100),
+		}, nil},
+		{"own address as next hop", []*apiGoBGP.Path{
+			testPath(t, "192.0.2.1", "192.0.2.254", true, 100, 65001),
+		}, nil},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, nh := range bestNextHops(tt.paths) {
+			got = append(got, nh.String())
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && !slices.Equal(got, tt.want)) {
+			t.Errorf("%s: bestNextHops() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// originatedPrefix is a prefix which this host announces. Same prefix can be used by
+// multiple endpoints (e.g. shared VIP) and it is counted only once.
+type originatedPrefix struct {
+	networkID string
+	owners    map[string]bool
+}
+
+// prefixLimiter keeps count of prefixes which this host originates so that routers
+// do not tear down BGP sessions because of their max-prefix limit.
+type prefixLimiter struct {
+	max      int
+	prefixes map[string]*originatedPrefix
+	sync.Mutex
+}
+
+var prefixLimits = &prefixLimiter{prefixes: make(map[string]*originatedPrefix)}
+
+// loadPrefixLimit reads global limit of originated prefixes. Zero means unlimited.
+func loadPrefixLimit() error {
+	v := os.Getenv("MAX_PREFIXES")
+	if v == "" {
+		return nil
+	}
+	max, err := strconv.Atoi(v)
+	if err != nil || max < 0 {
+		return fmt.Errorf("Environment variable MAX_PREFIXES value is invalid\r\n")
+	}
+	prefixLimits.max = max
+	return nil
+}
+
+func (l *prefixLimiter) networkCount(networkID string) int {
+	count := 0
+	for _, p := range l.prefixes {
+		if p.networkID == networkID {
+			count++
+		}
+	}
+	return count
+}
+
+// reserve counts prefix for owner (endpoint or advertised network) before it is
+// announced. Error is returned if prefix would exceed global or network limit.
+func (l *prefixLimiter) reserve(prefix, networkID, owner string, networkMax int) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if p, ok := l.prefixes[prefix]; ok {
+		p.owners[owner] = true
+		return nil
+	}
+	if l.max > 0 && len(l.prefixes) >= l.max {
+		log.WithField("prefix", prefix).Warnf("Limit of %d originated prefixes reached", l.max)
+		return fmt.Errorf("cannot announce %s, host already originates maximum %d prefixes", prefix, l.max)
+	}
+	if networkMax > 0 && l.networkCount(networkID) >= networkMax {
+		log.WithField("prefix", prefix).Warnf("Limit of %d originated prefixes reached in network %s", networkMax, networkID)
+		return fmt.Errorf("cannot announce %s, network already originates maximum %d prefixes", prefix, networkMax)
+	}
+	l.prefixes[prefix] = &originatedPrefix{networkID: networkID, owners: map[string]bool{owner: true}}
+	return nil
+}
+
+// release stops counting prefix for owner.
+func (l *prefixLimiter) release(prefix, owner string) {
+	l.Lock()
+	defer l.Unlock()
+	if p, ok := l.prefixes[prefix]; ok {
+		delete(p.owners, owner)
+		if len(p.owners) == 0 {
+			delete(l.prefixes, prefix)
+		}
+	}
+}
+
+// releaseOwner stops counting prefixes which are not used by any other owner.
+func (l *prefixLimiter) releaseOwner(owner string) {
+	l.Lock()
+	defer l.Unlock()
+	for prefix, p := range l.prefixes {
+		delete(p.owners, owner)
+		if len(p.owners) == 0 {
+			delete(l.prefixes, prefix)
+		}
+	}
+}
+
+// reserveEndpointPrefixes checks host routes of endpoint addresses given in CIDR
+// format against prefix lists and reserves them from the limits. Nothing is
+// reserved if any of them is not allowed or would exceed the limits. Addresses
+// announced with L2 are not originated with BGP so they are not counted.
+func reserveEndpointPrefixes(networkID, endpointID, ipv4, ipv6 string, options *networkOptions) error {
+	prefixes := []string{}
+	for _, address := range []string{ipv4, ipv6} {
+		if address == "" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil || ip.IsUnspecified() {
+			continue
+		}
+		if err := checkPrefixAllowed(hostAddress(ip), "CreateEndpoint"); err != nil {
+			return err
+		}
+		prefixes = append(prefixes, hostAddress(ip))
+	}
+	if options.AnnounceMode != announceModeBGP {
+		return nil
+	}
+	for _, prefix := range prefixes {
+		if err := prefixLimits.reserve(prefix, networkID, endpointID, options.MaxPrefixes); err != nil {
+			prefixLimits.releaseOwner(endpointID)
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *prefixLimiter) status() prefixCountStatus {
+	l.Lock()
+	defer l.Unlock()
+	status := prefixCountStatus{Count: len(l.prefixes), Max: l.max, Networks: make(map[string]int)}
+	for _, p := range l.prefixes {
+		status.Networks[p.networkID]++
+	}
+	return status
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPrefixLimiter(t *testing.T) {
+	type step struct {
+		op         string
+		prefix     string
+		networkID  string
+		owner      string
+		networkMax int
+		wantErr    bool
+	}
+	tests := []struct {
+		name      string
+		max       int
+		steps     []step
+		wantCount int
+		networks  map[string]int
+	}{
+		{"unlimited", 0, []step{
+			{"reserve", "10.0.0.1/32", "net1", "ep1", 0, false},
+			{"reserve", "10.0.0.2/32", "net1", "ep2", 0, false},
+		}, 2, map[string]int{"net1": 2}},
+		{"global limit", 2, []step{
+			{"reserve", "10.0.0.1/32", "net1", "ep1", 0, false},
+			{"reserve", "10.0.1.1/32", "net2", "ep2", 0, false},
+			{"reserve", "10.0.1.2/32", "net2", "ep3", 0, true},
+		}, 2, map[string]int{"net1": 1, "net2": 1}},
+		{"network limit", 0, []step{
+			{"reserve", "10.0.0.1/32", "net1", "ep1", 1, false},
+			{"reserve", "10.0.0.2/32", "net1", "ep2", 1, true},
+			{"reserve", "10.0.1.1/32", "net2", "ep3", 1, false},
+		}, 2, map[string]int{"net1": 1, "net2": 1}},
+		{"shared prefix is counted once", 1, []step{
+			{"reserve", "10.0.0.1/32", "net1", "ep1", 1, false},
+			{"reserve", "10.0.0.1/32", "net1", "ep2", 1, false},
+		}, 1, map[string]int{"net1": 1}},
+		{"shared prefix stays until last owner releases it", 1, []step{
+			{"reserve", "10.0.0.1/32", "net1", "ep1", 0, false},
+			{"reserve", "10.0.0.1/32", "net1", "ep2", 0, false},
+			{"release", "10.0.0.1/32", "", "ep1", 0, false},
+			{"reserve", "10.0.0.2/32", "net1", "ep3", 0, true},
+			{"release", "10.0.0.1/32", "", "ep2", 0, false},
+			{"reserve", "10.0.0.2/32", "net1", "ep3", 0, false},
+		}, 1, map[string]int{"net1": 1}},
+		{"release owner", 0, []step{
+			{"reserve", "10.0.0.1/32", "net1", "ep1", 0, false},
+			{"reserve", "2001:db8::1/128", "net1", "ep1", 0, false},
+			{"reserve", "10.0.0.2/32", "net1", "ep2", 0, false},
+			{"reserve", "10.0.0.2/32", "net1", "ep1", 0, false},
+			{"releaseOwner", "", "", "ep1", 0, false},
+		}, 1, map[string]int{"net1": 1}},
+	}
+	for _, tt := range tests {
+		l := &prefixLimiter{max: tt.max, prefixes: make(map[string]*originatedPrefix)}
+		for i, s := range tt.steps {
+			switch s.op {
+			case "reserve":
+				err := l.reserve(s.prefix, s.networkID, s.owner, s.networkMax)
+				if (err != nil) != s.wantErr {
+					t.Errorf("%s: step %d reserve(%s, %s, %s, %d) error = %v, want error %v", tt.name, i, s.prefix, s.networkID, s.owner, s.networkMax, err, s.wantErr)
+				}
+			case "release":
+				l.release(s.prefix, s.owner)
+			case "releaseOwner":
+				l.releaseOwner(s.owner)
+			}
+		}
+		status := l.status()
+		if status.Count != tt.wantCount || status.Max != tt.max {
+			t.Errorf("%s: status count %d max %d, want %d and %d", tt.name, status.Count, status.Max, tt.wantCount, tt.max)
+		}
+		for networkID, count := range tt.networks {
+			if status.Networks[networkID] != count {
+				t.Errorf("%s: network %s has %d prefixes, want %d", tt.name, networkID, status.Networks[networkID], count)
+			}
+		}
+	}
+}
+
+func TestReserveEndpointPrefixes(t *testing.T) {
+	defer func() { prefixLimits = &prefixLimiter{prefixes: make(map[string]*originatedPrefix)} }()
+	prefixLimits = &prefixLimiter{max: 2, prefixes: make(map[string]*originatedPrefix)}
+	options := defaultNetworkOptions()
+
+	if err := reserveEndpointPrefixes("net1", "ep1", "10.0.0.1/24", "", options); err != nil {
+		t.Fatalf("reserveEndpointPrefixes(ep1) error = %v", err)
+	}
+	// Second address would exceed the limit so neither of them is reserved
+	if err := reserveEndpointPrefixes("net1", "ep2", "10.0.0.2/24", "2001:db8::2/64", options); err == nil {
+		t.Fatal("reserveEndpointPrefixes(ep2) exceeded the limit")
+	}
+	if count := prefixLimits.status().Count; count != 1 {
+		t.Errorf("after failed reservation %d prefixes are counted, want 1", count)
+	}
+	// Unspecified address of IPv6 only network is not counted
+	if err := reserveEndpointPrefixes("net1", "ep3", "0.0.0.0/32", "2001:db8::3/64", options); err != nil {
+		t.Errorf("reserveEndpointPrefixes(ep3) error = %v", err)
+	}
+}
+
+func TestReserveEndpointPrefixesChecks(t *testing.T) {
+	defer func() {
+		prefixLimits = &prefixLimiter{prefixes: make(map[string]*originatedPrefix)}
+		allowedPrefixes, deniedPrefixes = nil, nil
+	}()
+	prefixLimits = &prefixLimiter{max: 1, prefixes: make(map[string]*originatedPrefix)}
+	t.Setenv("PREFIX_ALLOWLIST", "10.0.0.0/24")
+	if err := loadPrefixFilter(); err != nil {
+		t.Fatalf("loadPrefixFilter() error = %v", err)
+	}
+
+	// Prefix which allowlist rejects is never reserved
+	if err := reserveEndpointPrefixes("net1", "ep1", "10.0.1.1/24", "", defaultNetworkOptions()); err == nil {
+		t.Error("reserveEndpointPrefixes() accepted prefix outside of allowlist")
+	}
+	if count := prefixLimits.status().Count; count != 0 {
+		t.Errorf("rejected prefix is counted, count %d", count)
+	}
+
+	// L2 announcements are checked against allowlist but not counted
+	l2 := defaultNetworkOptions()
+	l2.AnnounceMode = announceModeL2
+	if err := reserveEndpointPrefixes("net1", "ep2", "10.0.0.2/24", "", l2); err != nil {
+		t.Errorf("reserveEndpointPrefixes() with L2 error = %v", err)
+	}
+	if err := reserveEndpointPrefixes("net1", "ep3", "10.0.1.3/24", "", l2); err == nil {
+		t.Error("reserveEndpointPrefixes() with L2 accepted prefix outside of allowlist")
+	}
+	if count := prefixLimits.status().Count; count != 0 {
+		t.Errorf("L2 prefix is counted, count %d", count)
+	}
+	if err := reserveEndpointPrefixes("net1", "ep4", "10.0.0.4/24", "", defaultNetworkOptions()); err != nil {
+		t.Errorf("reserveEndpointPrefixes() error = %v, limit must not include L2 prefixes", err)
+	}
+}
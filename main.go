@@ -14,6 +14,7 @@ import (
 	"github.com/docker/docker/libnetwork/types"
 	"github.com/olljanat/docker-bgp-lb/api"
 	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 )
 
 var driverScope = "local"
@@ -25,9 +26,16 @@ var stateFile = "/bgplb.json"
 type bgpLBEndpoint struct {
 	vethInside  string
 	vethOutside string
+	ipv4        string
+	ipv6        string
 }
 
 type bgpNetwork struct {
+	Options *networkOptions
+	// SourceRoutingTable is routing table for return traffic inside containers,
+	// zero when source routing is not enabled
+	SourceRoutingTable int `json:",omitempty"`
+
 	endpoints map[string]*bgpLBEndpoint
 }
 
@@ -38,6 +46,7 @@ type advertisedNetwork struct {
 
 type bgpLB struct {
 	Networks map[string]*bgpNetwork
+	Pools    map[string]*addressPool
 
 	advertisedNetworks map[string]*advertisedNetwork
 	scope              string
@@ -70,40 +79,117 @@ func (d *bgpLB) RequestPool(r *api.RequestPoolRequest) (*api.RequestPoolResponse
 		pool = r.Options["v6subnet"]
 	} else {
 		if r.Pool == "" {
-			return &api.RequestPoolResponse{PoolID: "0.0.0.0/32", Pool: "0.0.0.0/32"}, nil
+			return &api.RequestPoolResponse{PoolID: noPoolID, Pool: noPoolID}, nil
 		}
 		pool = r.Pool
 	}
 
-	_, ipnet, err := net.ParseCIDR(pool)
+	d.Lock()
+	defer d.Unlock()
+
+	p, err := newAddressPool(pool, r.Options["pool_mode"])
 	if err != nil {
 		return &api.RequestPoolResponse{}, err
 	}
-	mask, _ := ipnet.Mask.Size()
-	if !r.V6 && mask != 32 {
-		return &api.RequestPoolResponse{}, errors.New("only subnet mask /32 is supported")
+	if err := checkPrefixAllowed(p.Pool, "RequestPool"); err != nil {
+		return &api.RequestPoolResponse{}, err
+	}
+	for _, existing := range d.Pools {
+		if existing.Pool == p.Pool && existing.Mode != p.Mode {
+			return &api.RequestPoolResponse{}, fmt.Errorf("pool %s is already used with pool_mode %s", p.Pool, existing.Mode)
+		}
 	}
-	if r.V6 && mask != 128 {
-		return &api.RequestPoolResponse{}, errors.New("only subnet mask /128 is supported")
+	id := newPoolID(p.Pool)
+	d.Pools[id] = p
+	if err := d.saveState(); err != nil {
+		delete(d.Pools, id)
+		return &api.RequestPoolResponse{}, err
 	}
 
-	return &api.RequestPoolResponse{PoolID: pool, Pool: pool}, nil
+	return &api.RequestPoolResponse{PoolID: id, Pool: p.Pool}, nil
+}
+
+// pool returns address pool with id. Pools of networks created before pools were
+// stored to state are added on first use. Caller must hold the lock.
+func (d *bgpLB) pool(id string) (*addressPool, bool) {
+	if pool, ok := d.Pools[id]; ok {
+		return pool, true
+	}
+	pool := legacyPool(id)
+	if pool == nil {
+		return nil, false
+	}
+	d.Pools[id] = pool
+	return pool, true
 }
 
 func (d *bgpLB) RequestAddress(r *api.RequestAddressRequest) (*api.RequestAddressResponse, error) {
+	if r.PoolID == noPoolID {
+		return &api.RequestAddressResponse{Address: noPoolID}, nil
+	}
+
+	// Routes are queried from BGP daemon only once and before taking the lock
+	// because that can be slow
+	d.Lock()
+	pool, ok := d.pool(r.PoolID)
+	unique := ok && pool.Mode == poolModeUnique
+	d.Unlock()
+	received := map[string][]string{}
+	if unique {
+		received = receivedHostRoutes()
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	pool, ok = d.pool(r.PoolID)
+	if !ok {
+		return nil, fmt.Errorf("unknown pool %s", r.PoolID)
+	}
+
 	if r.Options["RequestAddressType"] == "com.docker.network.gateway" {
-		return &api.RequestAddressResponse{Address: r.PoolID}, nil
+		gateway, err := pool.gateway(r.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &api.RequestAddressResponse{Address: gateway}, nil
+	}
+
+	ip, err := pool.allocate(r.Address, isAddressReceived(received))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.saveState(); err != nil {
+		pool.release(ip.String())
+		return nil, err
 	}
 
-	return &api.RequestAddressResponse{Address: r.PoolID}, nil
+	return &api.RequestAddressResponse{Address: hostAddress(ip)}, nil
 }
 
 func (d *bgpLB) ReleaseAddress(r *api.ReleaseAddressRequest) error {
-	return nil
+	d.Lock()
+	defer d.Unlock()
+
+	pool, ok := d.Pools[r.PoolID]
+	if !ok {
+		return nil
+	}
+	pool.release(r.Address)
+
+	return d.saveState()
 }
 
 func (d *bgpLB) ReleasePool(r *api.ReleasePoolRequest) error {
-	return nil
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.Pools[r.PoolID]; !ok {
+		return nil
+	}
+	delete(d.Pools, r.PoolID)
+
+	return d.saveState()
 }
 
 func (d *bgpLB) CreateNetwork(r *api.CreateNetworkRequest) error {
@@ -114,14 +200,33 @@ func (d *bgpLB) CreateNetwork(r *api.CreateNetworkRequest) error {
 		return types.ForbiddenErrorf("network %s exists", r.NetworkID)
 	}
 
-	err := createBridgeFromNetID(r.NetworkID)
+	options, err := parseNetworkOptions(r.Options)
 	if err != nil {
 		return err
 	}
+	if options.elected() {
+		if err := elections.start(); err != nil {
+			return err
+		}
+	}
+
+	// Routed networks do not have bridge, routes point directly to veth of each container
+	if !options.routed() {
+		err = createBridgeFromNetID(r.NetworkID)
+		if err != nil {
+			return err
+		}
+	}
 
 	bgpNetwork := &bgpNetwork{
+		Options:   options,
 		endpoints: make(map[string]*bgpLBEndpoint),
 	}
+	if options.SourceRouting {
+		if bgpNetwork.SourceRoutingTable, err = d.allocateSourceRoutingTable(); err != nil {
+			return err
+		}
+	}
 
 	d.Networks[r.NetworkID] = bgpNetwork
 	err = d.saveState()
@@ -137,17 +242,28 @@ func (d *bgpLB) DeleteNetwork(r *api.DeleteNetworkRequest) error {
 	defer d.Unlock()
 
 	/* Skip if not in map */
-	if _, ok := d.Networks[r.NetworkID]; !ok {
+	network, ok := d.Networks[r.NetworkID]
+	if !ok {
 		return nil
 	}
 
-	err := deleteBridge(r.NetworkID)
-	if err != nil {
-		return err
+	if !network.Options.routed() {
+		err := deleteBridge(r.NetworkID)
+		if err != nil {
+			return err
+		}
 	}
 
 	delete(d.Networks, r.NetworkID)
-	err = d.saveState()
+	// Endpoints normally remove their routes but withdrawn routes of endpoints
+	// which Docker did not remove must not stay in desired state
+	forgetNetworkRoutes(r.NetworkID)
+	if network.Options.firewalled() {
+		if err := d.syncFirewall(); err != nil {
+			return err
+		}
+	}
+	err := d.saveState()
 	if err != nil {
 		return err
 	}
@@ -172,12 +288,27 @@ func (d *bgpLB) CreateEndpoint(r *api.CreateEndpointRequest) (*api.CreateEndpoin
 		return nil, types.ForbiddenErrorf("%s network does not exist", r.NetworkID)
 	}
 
-	d.Networks[r.NetworkID].endpoints[r.EndpointID] = &bgpLBEndpoint{}
+	options := d.Networks[r.NetworkID].Options
+	if options.AnnounceMode != announceModeNone {
+		ipv4, ipv6 := r.Interface.Address, r.Interface.AddressIPv6
+		if options.IPVSAddress != "" {
+			// Only address of IPVS virtual service is announced
+			ipv4, ipv6 = hostAddress(net.ParseIP(options.IPVSAddress)), ""
+		}
+		if err := reserveEndpointPrefixes(r.NetworkID, r.EndpointID, ipv4, ipv6, options); err != nil {
+			return nil, types.ForbiddenErrorf("%v", err)
+		}
+	}
+
+	d.Networks[r.NetworkID].endpoints[r.EndpointID] = &bgpLBEndpoint{
+		ipv4: r.Interface.Address,
+		ipv6: r.Interface.AddressIPv6,
+	}
 
 	resp := &api.CreateEndpointResponse{}
 
 	// Start Goroutine which will add local and BGP routes after container is up and running
-	go addRoute(r.NetworkID, r.EndpointID, r.Interface.Address, r.Interface.AddressIPv6)
+	go addRoute(r.NetworkID, r.EndpointID, r.Interface.Address, r.Interface.AddressIPv6, d.Networks[r.NetworkID].Options)
 
 	return resp, nil
 }
@@ -196,6 +327,7 @@ func (d *bgpLB) DeleteEndpoint(r *api.DeleteEndpointRequest) error {
 	}
 
 	delete(d.Networks[r.NetworkID].endpoints, r.EndpointID)
+	prefixLimits.releaseOwner(r.EndpointID)
 
 	return nil
 }
@@ -219,6 +351,7 @@ func (d *bgpLB) EndpointInfo(r *api.InfoRequest) (*api.InfoResponse, error) {
 	value["ip_address"] = ""
 	value["mac_address"] = ""
 	value["veth_outside"] = endpointInfo.vethOutside
+	value["bgp_peers"] = peerStates.summary()
 
 	resp := &api.InfoResponse{
 		Value: value,
@@ -240,17 +373,38 @@ func (d *bgpLB) Join(r *api.JoinRequest) (*api.JoinResponse, error) {
 		return nil, types.ForbiddenErrorf("%s endpoint does not exist", r.NetworkID)
 	}
 
+	if d.Networks[r.NetworkID].Options.RequirePeer == requirePeerJoin && !peerStates.established() {
+		log.Errorf("Refusing to join endpoint %s, no BGP session is established: %s", r.EndpointID, peerStates.summary())
+		return nil, types.ForbiddenErrorf("no BGP session is established (%s)", peerStates.summary())
+	}
+
 	vethInside, vethOutside, err := createVethPair()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := attachInterfaceToBridge(getBridgeNameByNetID(r.NetworkID), vethOutside); err != nil {
+	d.Networks[r.NetworkID].endpoints[r.EndpointID].vethInside = vethInside
+	d.Networks[r.NetworkID].endpoints[r.EndpointID].vethOutside = vethOutside
+
+	options := d.Networks[r.NetworkID].Options
+	linkName := getBridgeNameByNetID(r.NetworkID)
+	if options.routed() {
+		link, err := setupRoutedVeth(vethOutside)
+		if err != nil {
+			return nil, err
+		}
+		addRoutedNeighbors(d.Networks[r.NetworkID], r.EndpointID, link)
+		routedLinks.Store(r.EndpointID, vethOutside)
+		linkName = vethOutside
+	} else if err := attachInterfaceToBridge(linkName, vethOutside); err != nil {
 		return nil, err
 	}
 
-	d.Networks[r.NetworkID].endpoints[r.EndpointID].vethInside = vethInside
-	d.Networks[r.NetworkID].endpoints[r.EndpointID].vethOutside = vethOutside
+	if options.firewalled() {
+		if err := d.syncFirewall(); err != nil {
+			return nil, err
+		}
+	}
 
 	resp := &api.JoinResponse{
 		InterfaceName: api.InterfaceName{
@@ -259,6 +413,20 @@ func (d *bgpLB) Join(r *api.JoinRequest) (*api.JoinResponse, error) {
 		},
 	}
 
+	if options.DefaultRoute || len(options.StaticRoutes) > 0 {
+		link, err := netlink.LinkByName(linkName)
+		if err != nil {
+			return nil, err
+		}
+		if err := addReturnGateway(link); err != nil {
+			return nil, err
+		}
+		endpoint := d.Networks[r.NetworkID].endpoints[r.EndpointID]
+		resp.Gateway, resp.GatewayIPv6, resp.StaticRoutes = joinRoutes(options, endpoint.ipv4, endpoint.ipv6)
+		// Container does not need docker_gwbridge when LB network is its default route
+		resp.DisableGatewayService = options.DefaultRoute
+	}
+
 	return resp, nil
 }
 
@@ -278,10 +446,22 @@ func (d *bgpLB) Leave(r *api.LeaveRequest) error {
 	delRoute(r.NetworkID, r.EndpointID)
 
 	endpointInfo := d.Networks[r.NetworkID].endpoints[r.EndpointID]
+	if d.Networks[r.NetworkID].Options.routed() {
+		delRoutedNeighbors(d.Networks[r.NetworkID], r.EndpointID)
+		routedLinks.Delete(r.EndpointID)
+	}
 
 	if err := deleteVethPair(endpointInfo.vethOutside); err != nil {
 		return err
 	}
+	endpointInfo.vethInside = ""
+	endpointInfo.vethOutside = ""
+
+	if d.Networks[r.NetworkID].Options.firewalled() {
+		if err := d.syncFirewall(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -323,7 +503,14 @@ func loadState() (*bgpLB, error) {
 	return &b, nil
 }
 
-func addAdvertisedSubnet(ctx context.Context, netID, subnet string) error {
+func addAdvertisedSubnet(ctx context.Context, netID, subnet string, peers []string) error {
+	if err := checkPrefixAllowed(subnet, "addAdvertisedSubnet"); err != nil {
+		return fmt.Errorf("addAdvertisedSubnet: %w", err)
+	}
+	if err := setPrefixPeers(subnet, peers); err != nil {
+		return fmt.Errorf("addAdvertisedSubnet: failed to select peers: %w", err)
+	}
+
 	net := &advertisedNetwork{}
 
 	lbServer.Lock()
@@ -344,7 +531,13 @@ func addAdvertisedSubnet(ctx context.Context, netID, subnet string) error {
 	net.Unlock()
 
 	if !isPrefixAdvertised(ctx, subnet) {
-		if err := advertisePrefix(ctx, subnet); err != nil {
+		err := prefixLimits.reserve(subnet, netID, netID, 0)
+		if err == nil {
+			if err = advertisePrefix(ctx, subnet); err != nil {
+				prefixLimits.release(subnet, netID)
+			}
+		}
+		if err != nil {
 			net.Lock()
 			// remove the reserved subnet if advertising failed
 			idx := slices.Index(net.subnets, subnet)
@@ -379,8 +572,13 @@ func delAdvertisedNetwork(ctx context.Context, netID string) error {
 				return fmt.Errorf("delAdvertisedNetwork: failed to withdraw the subnet %w", err)
 			}
 		}
+		if err := clearPrefixPeers(subnet); err != nil {
+			return fmt.Errorf("delAdvertisedNetwork: failed to clear peer selection %w", err)
+		}
 	}
 
+	prefixLimits.releaseOwner(netID)
+
 	lbServer.Lock()
 	delete(lbServer.advertisedNetworks, netID)
 	lbServer.Unlock()
@@ -400,22 +598,37 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	peerAddress := os.Getenv("PEER_ADDRESS")
-	if peerAddress == "" {
-		log.Error("Environment variable PEER_ADDRESS is required")
+	if err := loadPrefixFilter(); err != nil {
+		log.Error(err)
 		return
 	}
 
-	if net.ParseIP(peerAddress) == nil {
-		log.Errorf("Value of PEER_ADDRESS is not a valid IP address. Got: %s", peerAddress)
+	if err := loadPrefixLimit(); err != nil {
+		log.Error(err)
 		return
 	}
 
-	if err := startBgpServer(peerAddress); err != nil {
+	if err := startAnnouncer(); err != nil {
 		log.Errorf("Starting BGP server failed: %v", err)
 		return
 	}
 
+	if err := startOverloadDetector(); err != nil {
+		log.Error(err)
+		return
+	}
+
+	if err := loadElectionConfig(ctx); err != nil {
+		log.Error(err)
+		return
+	}
+	// Overloaded host learns from election messages which prefixes other hosts announce
+	if overload != nil && overload.action == overloadActionWithdraw {
+		if err := elections.start(); err != nil {
+			log.Errorf("Starting VIP election failed, overloaded host keeps announcing its prefixes: %v", err)
+		}
+	}
+
 	if os.Getenv("GLOBAL_SCOPE") == "true" {
 		driverScope = "global"
 	}
@@ -428,31 +641,72 @@ func main() {
 	}
 	go advertiseNetworksOnStart(ctx)
 	go watchDockerEvents(ctx)
+	go watchRouteDrift(ctx)
+	go installLearnedRoutes(ctx)
+	go watchMrtFiles(ctx)
+	go watchOverload(ctx)
 	// Load saves networks configuration but only when we are not running in swarm mode.
 	// This is because swarm will automatically create/remove networks when needed.
 	lbServer.Lock()
-	if driverScope == "global" {
-		log.Info("Running in Swarm mode, starting with an empty configuration.")
+	d, err := loadState()
+	if err != nil {
+		log.Info("Failed to load data, starting with an empty configuration.")
 		lbServer.Networks = make(map[string]*bgpNetwork)
+		lbServer.Pools = make(map[string]*addressPool)
+	} else if driverScope == "global" {
+		// Pools keep their allocations and mode, networks are created again by swarm
+		log.Info("Running in Swarm mode, starting with an empty network configuration.")
+		lbServer.Networks = make(map[string]*bgpNetwork)
+		lbServer.Pools = d.Pools
 	} else {
-		d, err := loadState()
-		if err != nil {
-			log.Info("Failed to load data, starting with an empty configuration.")
-			lbServer.Networks = make(map[string]*bgpNetwork)
-		} else {
-			lbServer.Networks = d.Networks
-		}
+		lbServer.Networks = d.Networks
+		lbServer.Pools = d.Pools
+	}
+	if lbServer.Pools == nil {
+		lbServer.Pools = make(map[string]*addressPool)
 	}
 
+	allocated := false
 	for id, network := range lbServer.Networks {
+		network.endpoints = make(map[string]*bgpLBEndpoint)
+		if network.Options == nil {
+			network.Options = defaultNetworkOptions()
+		}
+		if network.Options.elected() {
+			if err := elections.start(); err != nil {
+				log.Errorf("Starting VIP election for network %s failed: %v", id, err)
+			}
+		}
+		// Networks created before tables were stored get one now
+		if network.Options.SourceRouting && network.SourceRoutingTable == 0 {
+			table, err := lbServer.allocateSourceRoutingTable()
+			if err != nil {
+				log.Errorf("Cannot allocate source routing table for network %s: %v", id, err)
+			}
+			network.SourceRoutingTable = table
+			allocated = true
+		}
+		if network.Options.routed() {
+			continue
+		}
 		if err := createBridgeFromNetID(id); err != nil {
 			log.Printf("Failed to create bridge for network %s: %v", id, err)
 		}
-		network.endpoints = make(map[string]*bgpLBEndpoint)
+	}
+	if allocated {
+		if err := lbServer.saveState(); err != nil {
+			log.Errorf("Cannot save state: %v", err)
+		}
+	}
+	// Endpoints are joined again by Docker, until then table left by previous
+	// run must not filter traffic with stale rules
+	if err := lbServer.syncFirewall(); err != nil {
+		log.Errorf("Cannot synchronize firewall: %v", err)
 	}
 	lbServer.Unlock()
 
 	h := api.NewHandler(lbServer)
+	registerStatusHandler(h)
 	if err := h.ServeUnix("bgplb", 0); err != nil {
 		log.Errorf("ServeUnix failed: %v", err)
 		return
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+)
+
+const (
+	defaultMrtDir              = "/mrt"
+	defaultMrtRotationInterval = 3600
+	defaultMrtMaxFiles         = 24
+	// GoBGP does not rotate files more often than this
+	minMrtRotationInterval = 60
+
+	// File names are Go time layouts which GoBGP formats on every rotation
+	mrtUpdatesPrefix = "updates-"
+	mrtTablePrefix   = "table-"
+	mrtTimeLayout    = "20060102-150405"
+	mrtSuffix        = ".mrt"
+)
+
+var (
+	mrtDir      = ""
+	mrtMaxFiles = defaultMrtMaxFiles
+)
+
+func parseMrtInterval(envName string, defaultValue int) (uint64, error) {
+	v := os.Getenv(envName)
+	if v == "" {
+		return uint64(defaultValue), nil
+	}
+	interval, err := strconv.Atoi(v)
+	if err != nil || interval < 0 || (interval > 0 && interval < minMrtRotationInterval) {
+		return 0, fmt.Errorf("Environment variable %s value is invalid, value must be 0 or at least %d seconds\r\n", envName, minMrtRotationInterval)
+	}
+	return uint64(interval), nil
+}
+
+// startMrt enables MRT dumps of the embedded BGP server to MRT_DIR. With MRT_UPDATES
+// all BGP updates are logged to file which is rotated every MRT_ROTATION_INTERVAL
+// seconds and with MRT_TABLE_INTERVAL full table is dumped to new file periodically.
+func startMrt() error {
+	updates := os.Getenv("MRT_UPDATES") == "true"
+	tableInterval, err := parseMrtInterval("MRT_TABLE_INTERVAL", 0)
+	if err != nil {
+		return err
+	}
+	if !updates && tableInterval == 0 {
+		return nil
+	}
+
+	rotationInterval, err := parseMrtInterval("MRT_ROTATION_INTERVAL", defaultMrtRotationInterval)
+	if err != nil {
+		return err
+	}
+	if v := os.Getenv("MRT_MAX_FILES"); v != "" {
+		if mrtMaxFiles, err = strconv.Atoi(v); err != nil || mrtMaxFiles < 0 {
+			return fmt.Errorf("Environment variable MRT_MAX_FILES value is invalid\r\n")
+		}
+	}
+
+	mrtDir = os.Getenv("MRT_DIR")
+	if mrtDir == "" {
+		mrtDir = defaultMrtDir
+	}
+	if time.Now().Format(mrtDir) != mrtDir {
+		return fmt.Errorf("Environment variable MRT_DIR value is invalid, path must not contain digits or Go time layout elements\r\n")
+	}
+	if err := os.MkdirAll(mrtDir, 0755); err != nil {
+		return fmt.Errorf("Cannot create MRT directory %s: %v\r\n", mrtDir, err)
+	}
+
+	ctx := context.Background()
+	if updates {
+		if err := bgpServer.EnableMrt(ctx, &apiGoBGP.EnableMrtRequest{
+			Type:             apiGoBGP.EnableMrtRequest_UPDATES,
+			Filename:         filepath.Join(mrtDir, mrtUpdatesPrefix+mrtTimeLayout+mrtSuffix),
+			RotationInterval: rotationInterval,
+		}); err != nil {
+			return fmt.Errorf("startMrt: failed to enable update dumps: %w", err)
+		}
+		log.Infof("Logging BGP updates to %s", mrtDir)
+	}
+	if tableInterval > 0 {
+		// Table is dumped on every rotation so that each dump goes to its own file
+		if err := bgpServer.EnableMrt(ctx, &apiGoBGP.EnableMrtRequest{
+			Type:             apiGoBGP.EnableMrtRequest_TABLE,
+			Filename:         filepath.Join(mrtDir, mrtTablePrefix+mrtTimeLayout+mrtSuffix),
+			RotationInterval: tableInterval,
+		}); err != nil {
+			return fmt.Errorf("startMrt: failed to enable table dumps: %w", err)
+		}
+		log.Infof("Dumping BGP table to %s every %d seconds", mrtDir, tableInterval)
+	}
+	return nil
+}
+
+// pruneMrtFiles removes oldest MRT files of each dump type so that at most
+// MRT_MAX_FILES of them are kept. Zero keeps all files.
+func pruneMrtFiles() {
+	for _, prefix := range []string{mrtUpdatesPrefix, mrtTablePrefix} {
+		files, err := filepath.Glob(filepath.Join(mrtDir, prefix+"*"+mrtSuffix))
+		if err != nil {
+			log.Errorf("pruneMrtFiles: failed to list files: %v", err)
+			continue
+		}
+		// Timestamps in file names sort in chronological order
+		sort.Strings(files)
+		for len(files) > mrtMaxFiles {
+			if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+				log.Errorf("pruneMrtFiles: failed to remove %s: %v", files[0], err)
+			}
+			files = files[1:]
+		}
+	}
+}
+
+func watchMrtFiles(ctx context.Context) {
+	if mrtDir == "" || mrtMaxFiles == 0 {
+		return
+	}
+	ticker := time.NewTicker(minMrtRotationInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pruneMrtFiles()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
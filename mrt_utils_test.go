@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testMrtDir returns empty directory for MRT files. Temporary directories of tests
+// contain digits which MRT_DIR must not have.
+func testMrtDir(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(os.TempDir(), "bgplb-mrt-test")
+	os.RemoveAll(dir)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		mrtDir, mrtMaxFiles = "", defaultMrtMaxFiles
+	})
+	return dir
+}
+
+func TestStartMrt(t *testing.T) {
+	dir := testMrtDir(t)
+	startTestBgpServer(t)
+	t.Setenv("MRT_DIR", dir)
+	t.Setenv("MRT_UPDATES", "")
+	t.Setenv("MRT_TABLE_INTERVAL", "")
+
+	// Dumps are disabled by default
+	if err := startMrt(); err != nil || mrtDir != "" {
+		t.Fatalf("startMrt() without dumps = %v, MRT_DIR %s", err, mrtDir)
+	}
+
+	t.Setenv("MRT_TABLE_INTERVAL", "30")
+	if err := startMrt(); err == nil {
+		t.Error("startMrt() accepted interval which GoBGP does not support")
+	}
+	t.Setenv("MRT_TABLE_INTERVAL", "60")
+	t.Setenv("MRT_DIR", filepath.Join(dir, "2006"))
+	if err := startMrt(); err == nil {
+		t.Error("startMrt() accepted MRT_DIR with time layout elements")
+	}
+
+	t.Setenv("MRT_DIR", dir)
+	t.Setenv("MRT_UPDATES", "true")
+	if err := startMrt(); err != nil {
+		t.Fatalf("startMrt() error = %v", err)
+	}
+	for _, prefix := range []string{mrtUpdatesPrefix, mrtTablePrefix} {
+		files, _ := filepath.Glob(filepath.Join(dir, prefix+"*"+mrtSuffix))
+		if len(files) != 1 || strings.Contains(files[0], mrtTimeLayout) {
+			t.Errorf("startMrt() created %s files %v, want one file named with current time", prefix, files)
+		}
+	}
+}
+
+func TestPruneMrtFiles(t *testing.T) {
+	mrtDir = testMrtDir(t)
+	mrtMaxFiles = 2
+	if err := os.MkdirAll(mrtDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{
+		"updates-20240101-120000.mrt", "updates-20240101-110000.mrt", "updates-20231231-230000.mrt",
+		"table-20240101-120000.mrt", "table-20240101-110000.mrt",
+		"notes.txt",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(mrtDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneMrtFiles()
+	entries, _ := os.ReadDir(mrtDir)
+	got := []string{}
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	want := []string{"notes.txt", "table-20240101-110000.mrt", "table-20240101-120000.mrt", "updates-20240101-110000.mrt", "updates-20240101-120000.mrt"}
+	if !slices.Equal(got, want) {
+		t.Errorf("pruneMrtFiles() kept %v, want %v", got, want)
+	}
+}
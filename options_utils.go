@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/libnetwork/netlabel"
+	"github.com/moby/ipvs"
+)
+
+// Network driver options given with `docker network create -o key=value`
+const (
+	optHealthMode   = "health_mode"
+	optDrainTimeout = "drain_timeout"
+	optCommunities  = "communities"
+	optMED          = "med"
+	optAnnounceMode = "announce_mode"
+	optNextHop      = "next_hop"
+	optNextHopV6    = "next_hop_v6"
+	optPeers        = "peers"
+	optL2Interface  = "l2_interface"
+	optPriority     = "priority"
+	optOwnership    = "ownership"
+	optMaxPrefixes  = "max_prefixes"
+	optRequirePeer  = "require_peer"
+	optSourceRoute  = "source_routing"
+	optDefaultRoute = "default_route"
+	optStaticRoutes = "static_routes"
+	optDataplane    = "dataplane"
+	optIPVSAddress  = "ipvs_address"
+	optIPVSPorts    = "ipvs_ports"
+	optIPVSSched    = "ipvs_scheduler"
+	optAllowedPorts = "allowed_ports"
+	// Rate limits of traffic to each LB address
+	optPacketRate     = "packet_rate"
+	optNewConnRate    = "new_conn_rate"
+	optMaxConnections = "max_connections"
+)
+
+const (
+	// healthModeHealthy waits container to be healthy, or running if it does not have health check
+	healthModeHealthy = "healthy"
+	// healthModeRunning ignores health check and only waits container to be running
+	healthModeRunning = "running"
+	// healthModeNone adds routes immediately when endpoint is created
+	healthModeNone = "none"
+
+	// announceModeBGP adds local route and announces it with BGP
+	announceModeBGP = "bgp"
+	// announceModeL2 answers ARP/NDP for VIP on host interface of elected owner
+	announceModeL2 = "l2"
+	// announceModeNone only adds local route
+	announceModeNone = "none"
+
+	// ownershipShared announces routes from all hosts which have healthy endpoint (anycast)
+	ownershipShared = "shared"
+	// ownershipSingle announces routes only from the host elected as their owner
+	ownershipSingle = "single"
+
+	// requirePeerNone does not care about state of BGP sessions
+	requirePeerNone = "false"
+	// requirePeerJoin fails container start when no BGP session is established
+	requirePeerJoin = "join"
+	// requirePeerAnnounce delays announcements until some BGP session is established
+	requirePeerAnnounce = "announce"
+
+	// dataplaneBridge attaches containers of the network to bgplb-* bridge
+	dataplaneBridge = "bridge"
+	// dataplaneRouted routes traffic directly to host side veth of each container
+	dataplaneRouted = "routed"
+
+	defaultDrainTimeout  = 5
+	defaultPriority      = 100
+	defaultIPVSScheduler = ipvs.WeightedLeastConnection
+)
+
+var ipvsSchedulers = []string{
+	ipvs.RoundRobin,
+	ipvs.WeightedRoundRobin,
+	ipvs.LeastConnection,
+	ipvs.WeightedLeastConnection,
+	ipvs.SourceHashing,
+	ipvs.DestinationHashing,
+}
+
+var wellKnownCommunities = map[string]uint32{
+	"no-export":           0xFFFFFF01,
+	"no-advertise":        0xFFFFFF02,
+	"no-export-subconfed": 0xFFFFFF03,
+}
+
+// networkOptions is per network configuration of routes and their BGP announcements.
+type networkOptions struct {
+	HealthMode   string
+	DrainTimeout int
+	Communities  []string
+	MED          *uint32
+	AnnounceMode string
+	NextHop      string
+	NextHopV6    string
+	Peers        []string
+	L2Interface  string
+	Priority     int
+	Ownership    string
+	MaxPrefixes  int
+	RequirePeer  string
+	// SourceRouting routes traffic from LB addresses back through LB network inside containers
+	SourceRouting bool
+	// DefaultRoute makes LB network the default route of containers
+	DefaultRoute bool
+	// StaticRoutes are prefixes which containers reach through LB network
+	StaticRoutes []string
+	Dataplane    string
+	// IPVSAddress is address of IPVS virtual service which balances connections
+	// between local containers of the network
+	IPVSAddress   string
+	IPVSPorts     []string
+	IPVSScheduler string
+	// AllowedPorts are the only ports in format <protocol>:<port> which LB addresses
+	// accept traffic to, everything else is dropped
+	AllowedPorts []string
+	// PacketRate is maximum number of packets per second to each LB address
+	PacketRate int
+	// NewConnRate is maximum number of new connections per second to each LB address
+	NewConnRate int
+	// MaxConnections is maximum number of concurrent connections to each LB address
+	MaxConnections int
+}
+
+func defaultNetworkOptions() *networkOptions {
+	return &networkOptions{
+		HealthMode:    healthModeHealthy,
+		DrainTimeout:  defaultDrainTimeout,
+		AnnounceMode:  announceModeBGP,
+		Priority:      defaultPriority,
+		Ownership:     ownershipShared,
+		RequirePeer:   requirePeerNone,
+		Dataplane:     dataplaneBridge,
+		IPVSScheduler: defaultIPVSScheduler,
+	}
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func parseCommunity(community string) (uint32, error) {
+	if v, ok := wellKnownCommunities[community]; ok {
+		return v, nil
+	}
+	parts := strings.Split(community, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid community %s, expected format is <0-65535>:<0-65535>", community)
+	}
+	high, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %s: %v", community, err)
+	}
+	low, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community %s: %v", community, err)
+	}
+	return uint32(high<<16 | low), nil
+}
+
+// communityValues returns communities in format used by BGP community attribute.
+// Values are validated on network creation so errors are ignored here.
+func (o *networkOptions) communityValues() []uint32 {
+	values := []uint32{}
+	for _, c := range o.Communities {
+		if v, err := parseCommunity(c); err == nil {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// nextHop returns next hop for the routes of given IP version.
+func (o *networkOptions) nextHop(ipv6 bool) string {
+	if ipv6 && o.NextHopV6 != "" {
+		return o.NextHopV6
+	}
+	if !ipv6 && o.NextHop != "" {
+		return o.NextHop
+	}
+	return routerID
+}
+
+// parseNetworkOptions validates options given to CreateNetwork and returns them
+// together with defaults for those which were not set.
+func parseNetworkOptions(options map[string]interface{}) (*networkOptions, error) {
+	opts := defaultNetworkOptions()
+
+	generic, ok := options[netlabel.GenericData].(map[string]interface{})
+	if !ok {
+		return opts, nil
+	}
+
+	for key, v := range generic {
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("value of option %s must be a string", key)
+		}
+
+		switch key {
+		case optHealthMode:
+			switch value {
+			case healthModeHealthy, healthModeRunning, healthModeNone:
+				opts.HealthMode = value
+			default:
+				return nil, fmt.Errorf("invalid %s %s, supported values are %s, %s and %s", key, value, healthModeHealthy, healthModeRunning, healthModeNone)
+			}
+		case optDrainTimeout:
+			timeout, err := strconv.Atoi(value)
+			if err != nil || timeout < 0 {
+				return nil, fmt.Errorf("invalid %s %s, value must be number of seconds", key, value)
+			}
+			opts.DrainTimeout = timeout
+		case optCommunities:
+			opts.Communities = splitList(value)
+			for _, c := range opts.Communities {
+				if _, err := parseCommunity(c); err != nil {
+					return nil, err
+				}
+			}
+		case optMED:
+			med, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s: %v", key, value, err)
+			}
+			m := uint32(med)
+			opts.MED = &m
+		case optAnnounceMode:
+			switch value {
+			case announceModeBGP, announceModeL2, announceModeNone:
+				opts.AnnounceMode = value
+			default:
+				return nil, fmt.Errorf("invalid %s %s, supported values are %s, %s and %s", key, value, announceModeBGP, announceModeL2, announceModeNone)
+			}
+		case optNextHop:
+			ip := net.ParseIP(value)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("invalid %s %s, value must be an IPv4 address", key, value)
+			}
+			opts.NextHop = value
+		case optNextHopV6:
+			ip := net.ParseIP(value)
+			if ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("invalid %s %s, value must be an IPv6 address", key, value)
+			}
+			opts.NextHopV6 = value
+		case optPeers:
+			if err := requireEmbeddedBgp(optPeers); err != nil {
+				return nil, err
+			}
+			opts.Peers = splitList(value)
+			for _, peer := range opts.Peers {
+				if !isPeerSelector(peer) {
+					return nil, fmt.Errorf("invalid %s %s, %s is not address or group of any configured peer", key, value, peer)
+				}
+			}
+		case optL2Interface:
+			if _, err := net.InterfaceByName(value); err != nil {
+				return nil, fmt.Errorf("invalid %s %s: %v", key, value, err)
+			}
+			opts.L2Interface = value
+		case optPriority:
+			priority, err := strconv.Atoi(value)
+			if err != nil || priority < 0 || priority > 255 {
+				return nil, fmt.Errorf("invalid %s %s, value must be between 0 and 255", key, value)
+			}
+			opts.Priority = priority
+		case optOwnership:
+			switch value {
+			case ownershipShared, ownershipSingle:
+				opts.Ownership = value
+			default:
+				return nil, fmt.Errorf("invalid %s %s, supported values are %s and %s", key, value, ownershipShared, ownershipSingle)
+			}
+		case optMaxPrefixes:
+			max, err := strconv.Atoi(value)
+			if err != nil || max < 0 {
+				return nil, fmt.Errorf("invalid %s %s, value must be a positive number", key, value)
+			}
+			opts.MaxPrefixes = max
+		case optRequirePeer:
+			switch value {
+			case requirePeerNone:
+			case requirePeerJoin, requirePeerAnnounce:
+				if err := requireEmbeddedBgp(optRequirePeer); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("invalid %s %s, supported values are %s, %s and %s", key, value, requirePeerNone, requirePeerJoin, requirePeerAnnounce)
+			}
+			opts.RequirePeer = value
+		case optSourceRoute:
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s, value must be true or false", key, value)
+			}
+			opts.SourceRouting = enabled
+		case optDefaultRoute:
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s, value must be true or false", key, value)
+			}
+			opts.DefaultRoute = enabled
+		case optStaticRoutes:
+			opts.StaticRoutes = []string{}
+			for _, prefix := range splitList(value) {
+				_, ipnet, err := net.ParseCIDR(prefix)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s %s: %v", key, value, err)
+				}
+				opts.StaticRoutes = append(opts.StaticRoutes, ipnet.String())
+			}
+		case optDataplane:
+			switch value {
+			case dataplaneBridge, dataplaneRouted:
+				opts.Dataplane = value
+			default:
+				return nil, fmt.Errorf("invalid %s %s, supported values are %s and %s", key, value, dataplaneBridge, dataplaneRouted)
+			}
+		case optIPVSAddress:
+			if net.ParseIP(value) == nil {
+				return nil, fmt.Errorf("invalid %s %s, value must be an IP address", key, value)
+			}
+			opts.IPVSAddress = value
+		case optIPVSPorts:
+			opts.IPVSPorts = splitList(value)
+			for _, port := range opts.IPVSPorts {
+				if _, _, err := parseL4Port(port); err != nil {
+					return nil, fmt.Errorf("invalid %s %s: %v", key, value, err)
+				}
+			}
+		case optAllowedPorts:
+			opts.AllowedPorts = splitList(value)
+			for _, port := range opts.AllowedPorts {
+				if _, _, err := parseL4Port(port); err != nil {
+					return nil, fmt.Errorf("invalid %s %s: %v", key, value, err)
+				}
+			}
+		case optPacketRate, optNewConnRate, optMaxConnections:
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit <= 0 {
+				return nil, fmt.Errorf("invalid %s %s, value must be a positive number", key, value)
+			}
+			switch key {
+			case optPacketRate:
+				opts.PacketRate = limit
+			case optNewConnRate:
+				opts.NewConnRate = limit
+			case optMaxConnections:
+				opts.MaxConnections = limit
+			}
+		case optIPVSSched:
+			if !slices.Contains(ipvsSchedulers, value) {
+				return nil, fmt.Errorf("invalid %s %s, supported values are %s", key, value, strings.Join(ipvsSchedulers, ", "))
+			}
+			opts.IPVSScheduler = value
+		default:
+			// Options defined by Docker itself are not for us
+			if strings.HasPrefix(key, "com.docker.") {
+				continue
+			}
+			return nil, fmt.Errorf("unknown option %s, supported options are %s", key, strings.Join(supportedNetworkOptions(), ", "))
+		}
+	}
+
+	if opts.AnnounceMode == announceModeL2 && opts.L2Interface == "" {
+		ifName, err := defaultRouteInterface()
+		if err != nil {
+			return nil, fmt.Errorf("%s is required with %s %s: %v", optL2Interface, optAnnounceMode, announceModeL2, err)
+		}
+		opts.L2Interface = ifName
+	}
+
+	// Policy routing is programmed inside container so it must be running when routes are added
+	if opts.SourceRouting && opts.HealthMode == healthModeNone {
+		return nil, fmt.Errorf("%s cannot be used with %s %s", optSourceRoute, optHealthMode, healthModeNone)
+	}
+
+	if (opts.IPVSAddress == "") != (len(opts.IPVSPorts) == 0) {
+		return nil, fmt.Errorf("%s and %s must be used together", optIPVSAddress, optIPVSPorts)
+	}
+
+	return opts, nil
+}
+
+// elected tells if routes of the network are announced only by the host elected
+// as their owner. L2 announcements always have single owner.
+func (o *networkOptions) elected() bool {
+	return o.AnnounceMode == announceModeL2 || (o.AnnounceMode == announceModeBGP && o.Ownership == ownershipSingle)
+}
+
+func (o *networkOptions) routed() bool {
+	return o.Dataplane == dataplaneRouted
+}
+
+// firewalled tells if traffic to LB addresses of the network is filtered on host.
+func (o *networkOptions) firewalled() bool {
+	return len(o.AllowedPorts) > 0 || o.PacketRate > 0 || o.NewConnRate > 0 || o.MaxConnections > 0
+}
+
+func supportedNetworkOptions() []string {
+	options := []string{optHealthMode, optDrainTimeout, optCommunities, optMED, optAnnounceMode, optNextHop, optNextHopV6, optPeers, optL2Interface, optPriority, optOwnership, optMaxPrefixes, optRequirePeer, optSourceRoute, optDefaultRoute, optStaticRoutes, optDataplane, optIPVSAddress, optIPVSPorts, optIPVSSched, optAllowedPorts, optPacketRate, optNewConnRate, optMaxConnections}
+	sort.Strings(options)
+	return options
+}
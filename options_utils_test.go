@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/libnetwork/netlabel"
+)
+
+// testGenericOptions returns options like Docker passes driver options of network.
+func testGenericOptions(options map[string]string) map[string]interface{} {
+	generic := map[string]interface{}{}
+	for k, v := range options {
+		generic[k] = v
+	}
+	return map[string]interface{}{netlabel.GenericData: generic}
+}
+
+func TestParseNetworkOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		valid   bool
+		check   func(*networkOptions) bool
+	}{
+		{"defaults", map[string]string{}, true, func(o *networkOptions) bool {
+			return o.HealthMode == healthModeHealthy && o.AnnounceMode == announceModeBGP && o.MED == nil && len(o.Communities) == 0
+		}},
+		{"docker options are ignored", map[string]string{"com.docker.network.bridge.name": "br0"}, true, nil},
+		{"unknown option", map[string]string{"foo": "bar"}, false, nil},
+		{"health mode", map[string]string{optHealthMode: healthModeRunning}, true, func(o *networkOptions) bool { return o.HealthMode == healthModeRunning }},
+		{"invalid health mode", map[string]string{optHealthMode: "ready"}, false, nil},
+		{"drain timeout", map[string]string{optDrainTimeout: "0"}, true, func(o *networkOptions) bool { return o.DrainTimeout == 0 }},
+		{"negative drain timeout", map[string]string{optDrainTimeout: "-1"}, false, nil},
+		{"communities", map[string]string{optCommunities: "65000:100, no-export"}, true, func(o *networkOptions) bool {
+			values := o.communityValues()
+			return len(values) == 2 && values[0] == 65000<<16|100 && values[1] == 0xFFFFFF01
+		}},
+		{"invalid community", map[string]string{optCommunities: "65536:1"}, false, nil},
+		{"med", map[string]string{optMED: "50"}, true, func(o *networkOptions) bool { return o.MED != nil && *o.MED == 50 }},
+		{"invalid med", map[string]string{optMED: "-1"}, false, nil},
+		{"next hop", map[string]string{optNextHop: "192.0.2.10"}, true, func(o *networkOptions) bool { return o.nextHop(false) == "192.0.2.10" }},
+		{"ipv6 next hop as ipv4", map[string]string{optNextHop: "2001:db8::1"}, false, nil},
+		{"ipv4 next hop as ipv6", map[string]string{optNextHopV6: "192.0.2.10"}, false, nil},
+	}
+	for _, tt := range tests {
+		opts, err := parseNetworkOptions(testGenericOptions(tt.options))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: parseNetworkOptions(%v) error = %v, want valid %v", tt.name, tt.options, err, tt.valid)
+			continue
+		}
+		if err == nil && tt.check != nil && !tt.check(opts) {
+			t.Errorf("%s: parseNetworkOptions(%v) = %+v", tt.name, tt.options, opts)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	overloadActionWithdraw = "withdraw"
+	overloadActionMED      = "med"
+	overloadActionPrepend  = "prepend"
+
+	defaultOverloadInterval = 10 * time.Second
+	defaultOverloadHoldTime = 60 * time.Second
+	defaultOverloadMED      = 1000000
+	defaultOverloadPrepend  = 3
+	// Host recovers only after all metrics have stayed below this fraction of their
+	// thresholds for the hold time so that announcements do not flap
+	overloadRecoveryRatio = 0.8
+
+	conntrackCountPath = "/proc/sys/net/netfilter/nf_conntrack_count"
+	conntrackMaxPath   = "/proc/sys/net/netfilter/nf_conntrack_max"
+	memoryPressurePath = "/proc/pressure/memory"
+)
+
+// overloadMetrics are the measurements of host load which are compared against
+// thresholds. Zero threshold disables the check.
+type overloadMetrics struct {
+	// Load is 1 minute load average divided by number of CPUs
+	Load float64
+	// Conntrack is percentage of conntrack table in use
+	Conntrack float64
+	// MemoryPressure is percentage of time some tasks were stalled on memory during last 10 seconds
+	MemoryPressure float64
+}
+
+// exceeded returns names of metrics which are at least ratio of their thresholds.
+func (m overloadMetrics) exceeded(thresholds overloadMetrics, ratio float64) []string {
+	names := []string{}
+	check := func(name string, value, threshold float64) {
+		if threshold > 0 && value >= threshold*ratio {
+			names = append(names, fmt.Sprintf("%s %.2f", name, value))
+		}
+	}
+	check("load", m.Load, thresholds.Load)
+	check("conntrack", m.Conntrack, thresholds.Conntrack)
+	check("memory pressure", m.MemoryPressure, thresholds.MemoryPressure)
+	return names
+}
+
+// heldPrefix is a prefix which this host announces, with the options it was announced
+// with, so that it can be announced again when the overload state changes.
+type heldPrefix struct {
+	prefix  *net.IPNet
+	options *networkOptions
+	prepend int
+	// withdrawn is set while prefix is kept back from BGP because of overload
+	withdrawn bool
+}
+
+// prefixUpdate is a change to announcement of prefix which is applied to the BGP
+// backend after state lock has been released.
+type prefixUpdate struct {
+	prefix   *net.IPNet
+	withdraw bool
+	options  *networkOptions
+	prepend  int
+}
+
+// overloadAnnouncer sits between the plugin and the BGP backend. While the host is
+// overloaded it withdraws or de-prefers all announcements of the host. Embedded lock
+// guards the state only and it is never held while calling the BGP backend, updates
+// serializes changes to the backend. Lock order is updates before state.
+type overloadAnnouncer struct {
+	next       announcer
+	action     string
+	med        uint32
+	prepend    int
+	interval   time.Duration
+	holdTime   time.Duration
+	thresholds overloadMetrics
+	metrics    overloadMetrics
+	overloaded bool
+	reason     string
+	lastChange time.Time
+	// calmSince is when metrics dropped below recovery thresholds while overloaded
+	calmSince time.Time
+	// lastWithdraw is when this host last withdrew prefixes because of overload
+	lastWithdraw time.Time
+	prefixes     map[string]*heldPrefix
+	updates      sync.Mutex
+	sync.Mutex
+}
+
+var overload *overloadAnnouncer
+
+// announcingHost is the latest list of prefixes which another host announced in its
+// election message.
+type announcingHost struct {
+	prefixes   map[string]bool
+	overloaded bool
+	lastSeen   time.Time
+}
+
+// remoteAnnouncements tracks which prefixes other hosts announce so that overloaded
+// host withdraws only prefixes which remain reachable through someone else. It has
+// its own lock which is never held while taking other locks.
+type remoteAnnouncements struct {
+	hosts map[string]*announcingHost
+	sync.Mutex
+}
+
+var remoteAnnouncers = &remoteAnnouncements{hosts: make(map[string]*announcingHost)}
+
+func (r *remoteAnnouncements) update(routerID string, prefixes []string, overloaded bool, now time.Time) {
+	h := &announcingHost{prefixes: make(map[string]bool, len(prefixes)), overloaded: overloaded, lastSeen: now}
+	for _, prefix := range prefixes {
+		h.prefixes[prefix] = true
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.hosts[routerID] = h
+}
+
+// announcedElsewhere tells if any host which has been heard after since announces
+// prefix. Overloaded hosts are counted only when includeOverloaded is set.
+func (r *remoteAnnouncements) announcedElsewhere(prefix string, since time.Time, includeOverloaded bool) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, h := range r.hosts {
+		if h.lastSeen.After(since) && (includeOverloaded || !h.overloaded) && h.prefixes[prefix] {
+			return true
+		}
+	}
+	return false
+}
+
+func overloadThreshold(name string) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	threshold, err := strconv.ParseFloat(v, 64)
+	if err != nil || threshold <= 0 {
+		return 0, fmt.Errorf("Environment variable %s value is invalid\r\n", name)
+	}
+	return threshold, nil
+}
+
+func overloadSeconds(name string, value time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return value, nil
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("Environment variable %s value is invalid\r\n", name)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// startOverloadDetector wraps the BGP announcer with overload detection when any
+// of OVERLOAD_LOAD, OVERLOAD_CONNTRACK or OVERLOAD_MEMORY_PRESSURE is set.
+func startOverloadDetector() error {
+	o := &overloadAnnouncer{
+		next:     bgpAnnouncer,
+		action:   overloadActionWithdraw,
+		med:      defaultOverloadMED,
+		prepend:  defaultOverloadPrepend,
+		prefixes: make(map[string]*heldPrefix),
+	}
+
+	var err error
+	if o.thresholds.Load, err = overloadThreshold("OVERLOAD_LOAD"); err != nil {
+		return err
+	}
+	if o.thresholds.Conntrack, err = overloadThreshold("OVERLOAD_CONNTRACK"); err != nil {
+		return err
+	}
+	if o.thresholds.MemoryPressure, err = overloadThreshold("OVERLOAD_MEMORY_PRESSURE"); err != nil {
+		return err
+	}
+	if o.thresholds == (overloadMetrics{}) {
+		return nil
+	}
+
+	if v := os.Getenv("OVERLOAD_ACTION"); v != "" {
+		o.action = v
+	}
+	switch o.action {
+	case overloadActionWithdraw, overloadActionMED, overloadActionPrepend:
+	default:
+		return fmt.Errorf("Environment variable OVERLOAD_ACTION value is invalid, supported values are %s, %s and %s\r\n", overloadActionWithdraw, overloadActionMED, overloadActionPrepend)
+	}
+	if v := os.Getenv("OVERLOAD_MED"); v != "" {
+		med, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("Environment variable OVERLOAD_MED value is invalid\r\n")
+		}
+		o.med = uint32(med)
+	}
+	if v := os.Getenv("OVERLOAD_PREPEND"); v != "" {
+		prepend, err := strconv.Atoi(v)
+		if err != nil || prepend <= 0 || prepend > 10 {
+			return fmt.Errorf("Environment variable OVERLOAD_PREPEND value is invalid, value must be between 1 and 10\r\n")
+		}
+		o.prepend = prepend
+	}
+	if o.interval, err = overloadSeconds("OVERLOAD_CHECK_INTERVAL", defaultOverloadInterval); err != nil {
+		return err
+	}
+	if o.holdTime, err = overloadSeconds("OVERLOAD_HOLD_TIME", defaultOverloadHoldTime); err != nil {
+		return err
+	}
+
+	overload = o
+	bgpAnnouncer = o
+	log.Infof("Overload detection enabled with thresholds %+v, action %s", o.thresholds, o.action)
+	return nil
+}
+
+// isOverloaded tells if this host currently sheds its traffic.
+func isOverloaded() bool {
+	if overload == nil {
+		return false
+	}
+	overload.Lock()
+	defer overload.Unlock()
+	return overload.overloaded
+}
+
+// adjust returns options and AS path prepend which prefix is announced with. Caller
+// must hold the lock.
+func (o *overloadAnnouncer) adjust(options *networkOptions, prepend int) (*networkOptions, int) {
+	if !o.overloaded {
+		return options, prepend
+	}
+	switch o.action {
+	case overloadActionMED:
+		adjusted := *options
+		adjusted.MED = &o.med
+		return &adjusted, prepend
+	case overloadActionPrepend:
+		return options, prepend + o.prepend
+	}
+	return options, prepend
+}
+
+// sheds tells if announcements are withdrawn while overloaded. Caller must hold the lock.
+func (o *overloadAnnouncer) sheds() bool {
+	return o.overloaded && o.action == overloadActionWithdraw
+}
+
+// reachableElsewhere tells if any other alive host announces prefix according to its
+// latest election message.
+func (o *overloadAnnouncer) reachableElsewhere(prefix string) bool {
+	deadline := time.Now().Add(-electionDeadIntervals * elections.interval)
+	return remoteAnnouncers.announcedElsewhere(prefix, deadline, true)
+}
+
+// canWithdraw tells if prefix stays reachable when this host withdraws it. Another
+// host which is not overloaded itself must announce it in a message received after
+// the previous withdraw of this host, so that hosts which get overloaded at the same
+// time do not withdraw based on lists which predate each other's withdrawals.
+// Caller must hold the lock.
+func (o *overloadAnnouncer) canWithdraw(prefix string) bool {
+	since := time.Now().Add(-electionDeadIntervals * elections.interval)
+	if o.lastWithdraw.After(since) {
+		since = o.lastWithdraw
+	}
+	return remoteAnnouncers.announcedElsewhere(prefix, since, false)
+}
+
+// apply sends updates to the BGP backend. Caller must hold updates lock but not
+// the state lock.
+func (o *overloadAnnouncer) apply(ctx context.Context, updates []prefixUpdate) {
+	for _, u := range updates {
+		var err error
+		if u.withdraw {
+			err = o.next.withdraw(ctx, u.prefix)
+		} else {
+			err = o.next.announce(ctx, u.prefix, u.options, u.prepend)
+		}
+		if err != nil {
+			log.Errorf("Cannot update announcement of %s: %v", u.prefix, err)
+		}
+	}
+}
+
+func (o *overloadAnnouncer) announce(ctx context.Context, prefix *net.IPNet, options *networkOptions, prepend int) error {
+	o.updates.Lock()
+	defer o.updates.Unlock()
+	o.Lock()
+	p := &heldPrefix{prefix: prefix, options: options, prepend: prepend}
+	p.withdrawn = o.sheds() && o.canWithdraw(prefix.String())
+	if p.withdrawn {
+		o.lastWithdraw = time.Now()
+	}
+	o.prefixes[prefix.String()] = p
+	options, prepend = o.adjust(options, prepend)
+	o.Unlock()
+
+	if p.withdrawn {
+		log.Infof("Host is overloaded, not announcing %s", prefix)
+		return nil
+	}
+	return o.next.announce(ctx, prefix, options, prepend)
+}
+
+func (o *overloadAnnouncer) withdraw(ctx context.Context, prefix *net.IPNet) error {
+	o.updates.Lock()
+	defer o.updates.Unlock()
+	o.Lock()
+	p, ok := o.prefixes[prefix.String()]
+	delete(o.prefixes, prefix.String())
+	o.Unlock()
+
+	if ok && p.withdrawn {
+		return nil
+	}
+	return o.next.withdraw(ctx, prefix)
+}
+
+// isAnnounced also counts prefixes which are only kept back because of overload so
+// that they are withdrawn normally when no longer needed.
+func (o *overloadAnnouncer) isAnnounced(ctx context.Context, prefix *net.IPNet) bool {
+	o.Lock()
+	p, ok := o.prefixes[prefix.String()]
+	held := ok && p.withdrawn
+	o.Unlock()
+	return held || o.next.isAnnounced(ctx, prefix)
+}
+
+// announced returns prefixes which this host currently announces with BGP.
+func (o *overloadAnnouncer) announced() []string {
+	o.Lock()
+	defer o.Unlock()
+	prefixes := []string{}
+	for prefix, p := range o.prefixes {
+		if !p.withdrawn {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+func (o *overloadAnnouncer) receivedHostRoutes(ctx context.Context) map[string][]string {
+	return o.next.receivedHostRoutes(ctx)
+}
+
+func readProcFloat(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+}
+
+// readLoad returns 1 minute load average per CPU.
+func readLoad() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected content in /proc/loadavg")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return load / float64(runtime.NumCPU()), nil
+}
+
+// readConntrack returns percentage of conntrack table in use.
+func readConntrack() (float64, error) {
+	count, err := readProcFloat(conntrackCountPath)
+	if err != nil {
+		return 0, err
+	}
+	max, err := readProcFloat(conntrackMaxPath)
+	if err != nil {
+		return 0, err
+	}
+	if max == 0 {
+		return 0, fmt.Errorf("%s is zero", conntrackMaxPath)
+	}
+	return 100 * count / max, nil
+}
+
+// readMemoryPressure returns "some avg10" value of memory PSI.
+func readMemoryPressure() (float64, error) {
+	data, err := os.ReadFile(memoryPressurePath)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		value, ok := strings.CutPrefix(fields[1], "avg10=")
+		if !ok {
+			break
+		}
+		return strconv.ParseFloat(value, 64)
+	}
+	return 0, fmt.Errorf("unexpected content in %s", memoryPressurePath)
+}
+
+// measure reads metrics which have threshold. Failed reads are logged and counted as zero.
+func (o *overloadAnnouncer) measure() overloadMetrics {
+	m := overloadMetrics{}
+	read := func(threshold float64, value *float64, name string, fn func() (float64, error)) {
+		if threshold == 0 {
+			return
+		}
+		v, err := fn()
+		if err != nil {
+			log.Warnf("Cannot read %s for overload detection: %v", name, err)
+			return
+		}
+		*value = v
+	}
+	read(o.thresholds.Load, &m.Load, "load average", readLoad)
+	read(o.thresholds.Conntrack, &m.Conntrack, "conntrack table", readConntrack)
+	read(o.thresholds.MemoryPressure, &m.MemoryPressure, "memory pressure", readMemoryPressure)
+	return m
+}
+
+// check updates overload state from metrics and applies the changes to the BGP backend.
+func (o *overloadAnnouncer) check(m overloadMetrics) {
+	o.updates.Lock()
+	defer o.updates.Unlock()
+	o.Lock()
+	updates := o.update(m)
+	o.Unlock()
+	o.apply(context.Background(), updates)
+}
+
+// update records metrics and returns announcements which must change. Host becomes
+// overloaded as soon as any threshold is crossed and recovers after metrics have
+// stayed low for the hold time. Caller must hold the lock.
+func (o *overloadAnnouncer) update(m overloadMetrics) []prefixUpdate {
+	o.metrics = m
+
+	if !o.overloaded {
+		if exceeded := m.exceeded(o.thresholds, 1); len(exceeded) > 0 {
+			return o.setOverloaded(true, strings.Join(exceeded, ", "))
+		}
+		return nil
+	}
+	updates := o.restoreUnreachable()
+	if len(m.exceeded(o.thresholds, overloadRecoveryRatio)) > 0 {
+		o.calmSince = time.Time{}
+		return updates
+	}
+	if o.calmSince.IsZero() {
+		o.calmSince = time.Now()
+	}
+	if time.Since(o.calmSince) >= o.holdTime {
+		return o.setOverloaded(false, "")
+	}
+	return updates
+}
+
+// restoreUnreachable announces again withdrawn prefixes which no other host announces
+// anymore. They stay announced until the host recovers so that hosts do not take
+// turns in withdrawing them. Caller must hold the lock.
+func (o *overloadAnnouncer) restoreUnreachable() []prefixUpdate {
+	updates := []prefixUpdate{}
+	for prefix, p := range o.prefixes {
+		if !p.withdrawn || o.reachableElsewhere(prefix) {
+			continue
+		}
+		log.Warnf("No other host announces %s anymore, announcing it although host is overloaded", prefix)
+		p.withdrawn = false
+		updates = append(updates, prefixUpdate{prefix: p.prefix, options: p.options, prepend: p.prepend})
+	}
+	return updates
+}
+
+// setOverloaded changes overload state and returns updates which announce all
+// prefixes of the host again so that the change takes effect. Caller must hold the lock.
+func (o *overloadAnnouncer) setOverloaded(overloaded bool, reason string) []prefixUpdate {
+	o.overloaded = overloaded
+	o.reason = reason
+	o.lastChange = time.Now()
+	o.calmSince = time.Time{}
+	if overloaded {
+		log.Warnf("Host is overloaded (%s), applying action %s to %d prefixes", reason, o.action, len(o.prefixes))
+	} else {
+		log.Infof("Host recovered from overload, restoring %d prefixes", len(o.prefixes))
+	}
+
+	updates := []prefixUpdate{}
+	withdrawn := false
+	for prefix, p := range o.prefixes {
+		if o.sheds() {
+			if !o.canWithdraw(prefix) {
+				log.Warnf("No other healthy host announces %s, keeping it announced although host is overloaded", prefix)
+				continue
+			}
+			p.withdrawn = true
+			withdrawn = true
+			updates = append(updates, prefixUpdate{prefix: p.prefix, withdraw: true})
+			continue
+		}
+		p.withdrawn = false
+		options, prepend := o.adjust(p.options, p.prepend)
+		updates = append(updates, prefixUpdate{prefix: p.prefix, options: options, prepend: prepend})
+	}
+	if withdrawn {
+		o.lastWithdraw = time.Now()
+	}
+	return updates
+}
+
+// watchOverload measures host load periodically when overload detection is enabled.
+func watchOverload(ctx context.Context) {
+	if overload == nil {
+		return
+	}
+	ticker := time.NewTicker(overload.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			overload.check(overload.measure())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type overloadStatus struct {
+	Overloaded bool
+	Reason     string
+	Action     string
+	Metrics    overloadMetrics
+	Thresholds overloadMetrics
+	LastChange time.Time
+}
+
+func (o *overloadAnnouncer) status() *overloadStatus {
+	if o == nil {
+		return nil
+	}
+	o.Lock()
+	defer o.Unlock()
+	return &overloadStatus{
+		Overloaded: o.overloaded,
+		Reason:     o.reason,
+		Action:     o.action,
+		Metrics:    o.metrics,
+		Thresholds: o.thresholds,
+		LastChange: o.lastChange,
+	}
+}
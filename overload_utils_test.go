@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeAnnouncer records what overloadAnnouncer passes to the BGP backend.
+type fakeAnnouncer struct {
+	announced map[string]*networkOptions
+	prepends  map[string]int
+}
+
+func newFakeAnnouncer() *fakeAnnouncer {
+	return &fakeAnnouncer{announced: make(map[string]*networkOptions), prepends: make(map[string]int)}
+}
+
+func (f *fakeAnnouncer) announce(ctx context.Context, prefix *net.IPNet, options *networkOptions, prepend int) error {
+	f.announced[prefix.String()] = options
+	f.prepends[prefix.String()] = prepend
+	return nil
+}
+
+func (f *fakeAnnouncer) withdraw(ctx context.Context, prefix *net.IPNet) error {
+	delete(f.announced, prefix.String())
+	delete(f.prepends, prefix.String())
+	return nil
+}
+
+func (f *fakeAnnouncer) isAnnounced(ctx context.Context, prefix *net.IPNet) bool {
+	_, ok := f.announced[prefix.String()]
+	return ok
+}
+
+func (f *fakeAnnouncer) receivedHostRoutes(ctx context.Context) map[string][]string {
+	return nil
+}
+
+func newTestOverloadAnnouncer(action string, holdTime time.Duration) (*overloadAnnouncer, *fakeAnnouncer) {
+	next := newFakeAnnouncer()
+	return &overloadAnnouncer{
+		next:       next,
+		action:     action,
+		med:        defaultOverloadMED,
+		prepend:    defaultOverloadPrepend,
+		holdTime:   holdTime,
+		thresholds: overloadMetrics{Load: 2, Conntrack: 80},
+		prefixes:   make(map[string]*heldPrefix),
+	}, next
+}
+
+func TestOverloadCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		holdTime time.Duration
+		metrics  []overloadMetrics
+		want     bool
+	}{
+		{"below thresholds", 0, []overloadMetrics{{Load: 1.9, Conntrack: 79}}, false},
+		{"load crosses threshold", 0, []overloadMetrics{{Load: 2}}, true},
+		{"conntrack crosses threshold", 0, []overloadMetrics{{Conntrack: 90}}, true},
+		{"stays overloaded above recovery ratio", 0, []overloadMetrics{{Load: 3}, {Load: 1.7}}, true},
+		{"recovers below recovery ratio", 0, []overloadMetrics{{Load: 3}, {Load: 1.5}}, false},
+		{"recovers only after hold time", time.Hour, []overloadMetrics{{Load: 3}, {Load: 1}, {Load: 1}}, true},
+		{"recovers when load drops after staying high", 0, []overloadMetrics{{Load: 3}, {Load: 1.7}, {Load: 1}}, false},
+	}
+	for _, tt := range tests {
+		o, _ := newTestOverloadAnnouncer(overloadActionMED, tt.holdTime)
+		for _, m := range tt.metrics {
+			o.check(m)
+		}
+		if status := o.status(); status.Overloaded != tt.want {
+			t.Errorf("%s: overloaded = %v, want %v", tt.name, status.Overloaded, tt.want)
+		}
+	}
+}
+
+func TestOverloadActions(t *testing.T) {
+	ctx := context.Background()
+	_, prefix, _ := net.ParseCIDR("10.0.0.1/32")
+	med := uint32(10)
+	options := defaultNetworkOptions()
+	options.MED = &med
+
+	tests := []struct {
+		action      string
+		wantMED     uint32
+		wantPrepend int
+	}{
+		{overloadActionMED, defaultOverloadMED, 1},
+		{overloadActionPrepend, 10, 1 + defaultOverloadPrepend},
+	}
+	for _, tt := range tests {
+		o, next := newTestOverloadAnnouncer(tt.action, 0)
+		o.announce(ctx, prefix, options, 1)
+		o.check(overloadMetrics{Load: 3})
+		if got := next.announced[prefix.String()]; got == nil || *got.MED != tt.wantMED || next.prepends[prefix.String()] != tt.wantPrepend {
+			t.Errorf("%s: overloaded host announces %s with %+v and prepend %d", tt.action, prefix, got, next.prepends[prefix.String()])
+		}
+		if *options.MED != 10 {
+			t.Errorf("%s: MED of network options was changed to %d", tt.action, *options.MED)
+		}
+		o.check(overloadMetrics{Load: 1})
+		if got := next.announced[prefix.String()]; got == nil || *got.MED != 10 || next.prepends[prefix.String()] != 1 {
+			t.Errorf("%s: recovered host announces %s with %+v and prepend %d", tt.action, prefix, got, next.prepends[prefix.String()])
+		}
+	}
+}
+
+func TestOverloadWithdraw(t *testing.T) {
+	ctx := context.Background()
+	defer func() { remoteAnnouncers = &remoteAnnouncements{hosts: make(map[string]*announcingHost)} }()
+	remoteAnnouncers = &remoteAnnouncements{hosts: make(map[string]*announcingHost)}
+	elections.interval = time.Second
+	defer func() { elections.interval = 0 }()
+
+	_, shared, _ := net.ParseCIDR("10.0.0.1/32")
+	_, local, _ := net.ParseCIDR("10.0.0.2/32")
+	o, next := newTestOverloadAnnouncer(overloadActionWithdraw, 0)
+	o.announce(ctx, shared, defaultNetworkOptions(), 0)
+	o.announce(ctx, local, defaultNetworkOptions(), 0)
+	remoteAnnouncers.update("192.0.2.1", []string{shared.String()}, false, time.Now())
+
+	// Only prefix which another host announces is withdrawn
+	o.check(overloadMetrics{Load: 3})
+	if next.isAnnounced(ctx, shared) || !o.isAnnounced(ctx, shared) {
+		t.Errorf("overloaded host did not withdraw %s which other host announces", shared)
+	}
+	if !next.isAnnounced(ctx, local) {
+		t.Errorf("overloaded host withdrew %s which no other host announces", local)
+	}
+	if announced := o.announced(); len(announced) != 1 || announced[0] != local.String() {
+		t.Errorf("announced() = %v, want %s", announced, local)
+	}
+
+	// Prefix is announced again when other host stops announcing it
+	remoteAnnouncers.update("192.0.2.1", nil, false, time.Now())
+	o.check(overloadMetrics{Load: 3})
+	if !next.isAnnounced(ctx, shared) {
+		t.Errorf("overloaded host did not announce %s after other host withdrew it", shared)
+	}
+
+	// and it stays announced until the host recovers
+	remoteAnnouncers.update("192.0.2.1", []string{shared.String()}, false, time.Now())
+	o.check(overloadMetrics{Load: 3})
+	if !next.isAnnounced(ctx, shared) {
+		t.Errorf("overloaded host withdrew %s again", shared)
+	}
+
+	// New prefix is kept back only when someone else announces it
+	_, added, _ := net.ParseCIDR("10.0.0.3/32")
+	remoteAnnouncers.update("192.0.2.3", []string{added.String()}, false, time.Now().Add(-4*time.Second))
+	o.announce(ctx, added, defaultNetworkOptions(), 0)
+	if !next.isAnnounced(ctx, added) {
+		t.Errorf("overloaded host did not announce %s which is announced only by dead host", added)
+	}
+	remoteAnnouncers.update("192.0.2.3", []string{added.String()}, false, time.Now())
+	o.withdraw(ctx, added)
+	o.announce(ctx, added, defaultNetworkOptions(), 0)
+	if next.isAnnounced(ctx, added) {
+		t.Errorf("overloaded host announced %s which other host announces", added)
+	}
+	if err := o.withdraw(ctx, added); err != nil || o.isAnnounced(ctx, added) {
+		t.Errorf("withdraw of kept back %s error = %v", added, err)
+	}
+
+	o.check(overloadMetrics{Load: 1})
+	for _, prefix := range []*net.IPNet{shared, local} {
+		if !next.isAnnounced(ctx, prefix) {
+			t.Errorf("recovered host does not announce %s", prefix)
+		}
+	}
+}
+
+func TestOverloadWithdrawNeedsHealthyAnnouncer(t *testing.T) {
+	ctx := context.Background()
+	defer func() { remoteAnnouncers = &remoteAnnouncements{hosts: make(map[string]*announcingHost)} }()
+	remoteAnnouncers = &remoteAnnouncements{hosts: make(map[string]*announcingHost)}
+	elections.interval = time.Second
+	defer func() { elections.interval = 0 }()
+
+	_, first, _ := net.ParseCIDR("10.0.0.1/32")
+	_, second, _ := net.ParseCIDR("10.0.0.2/32")
+	o, next := newTestOverloadAnnouncer(overloadActionWithdraw, 0)
+	o.announce(ctx, first, defaultNetworkOptions(), 0)
+
+	// Other host which is overloaded too may withdraw at the same time
+	remoteAnnouncers.update("192.0.2.1", []string{first.String(), second.String()}, true, time.Now())
+	o.check(overloadMetrics{Load: 3})
+	if !next.isAnnounced(ctx, first) {
+		t.Errorf("overloaded host withdrew %s which only overloaded host announces", first)
+	}
+	o.check(overloadMetrics{Load: 1})
+
+	remoteAnnouncers.update("192.0.2.1", []string{first.String(), second.String()}, false, time.Now())
+	o.check(overloadMetrics{Load: 3})
+	if next.isAnnounced(ctx, first) {
+		t.Errorf("overloaded host did not withdraw %s which healthy host announces", first)
+	}
+
+	// Message which was received before the withdraw does not count
+	o.announce(ctx, second, defaultNetworkOptions(), 0)
+	if !next.isAnnounced(ctx, second) {
+		t.Errorf("overloaded host withdrew %s based on message older than its previous withdraw", second)
+	}
+	o.withdraw(ctx, second)
+	remoteAnnouncers.update("192.0.2.1", []string{first.String(), second.String()}, false, time.Now())
+	o.announce(ctx, second, defaultNetworkOptions(), 0)
+	if next.isAnnounced(ctx, second) {
+		t.Errorf("overloaded host announced %s which healthy host announces", second)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+)
+
+type peerState struct {
+	State      apiGoBGP.PeerState_SessionState
+	LastChange time.Time
+}
+
+// peerStateTable holds session state of every BGP peer of the embedded server.
+type peerStateTable struct {
+	peers map[string]*peerState
+	sync.Mutex
+}
+
+var peerStates = &peerStateTable{peers: make(map[string]*peerState)}
+
+func (t *peerStateTable) set(address string, state apiGoBGP.PeerState_SessionState) {
+	t.Lock()
+	defer t.Unlock()
+	p, ok := t.peers[address]
+	if ok && p.State == state {
+		return
+	}
+	if ok && p.State == apiGoBGP.PeerState_ESTABLISHED {
+		log.Warnf("BGP session with %s went down, state is %s", address, state)
+	} else {
+		log.Infof("BGP session with %s is %s", address, state)
+	}
+	t.peers[address] = &peerState{State: state, LastChange: time.Now()}
+}
+
+// established tells if session with at least one peer is established.
+func (t *peerStateTable) established() bool {
+	t.Lock()
+	defer t.Unlock()
+	for _, p := range t.peers {
+		if p.State == apiGoBGP.PeerState_ESTABLISHED {
+			return true
+		}
+	}
+	return false
+}
+
+// summary returns states of all peers in format address=STATE,address=STATE
+func (t *peerStateTable) summary() string {
+	t.Lock()
+	defer t.Unlock()
+	states := []string{}
+	for address, p := range t.peers {
+		states = append(states, fmt.Sprintf("%s=%s", address, p.State))
+	}
+	sort.Strings(states)
+	return strings.Join(states, ",")
+}
+
+func (t *peerStateTable) status() []peerStatus {
+	t.Lock()
+	defer t.Unlock()
+	peers := []peerStatus{}
+	for address, p := range t.peers {
+		peers = append(peers, peerStatus{Address: address, State: p.State.String(), LastChange: p.LastChange})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers
+}
+
+// watchPeerState follows session state changes of BGP peers. It must be started before
+// peers are added so that no state change is missed.
+func watchPeerState() error {
+	return bgpServer.WatchEvent(context.Background(), &apiGoBGP.WatchEventRequest{
+		Peer: &apiGoBGP.WatchEventRequest_Peer{},
+	}, func(r *apiGoBGP.WatchEventResponse) {
+		p := r.GetPeer()
+		if p == nil || p.Type != apiGoBGP.WatchEventResponse_PeerEvent_STATE || p.Peer == nil || p.Peer.State == nil {
+			return
+		}
+		peerStates.set(p.Peer.State.NeighborAddress, p.Peer.State.SessionState)
+	})
+}
+
+// waitPeerEstablished blocks until session with at least one BGP peer is established.
+// False is returned if endpoint was removed while waiting.
+func waitPeerEstablished(networkID, endpointID string) bool {
+	logged := false
+	for !peerStates.established() {
+		if !logged {
+			log.Warnf("No BGP session is established, delaying announcement of endpoint %s", endpointID)
+			logged = true
+		}
+		time.Sleep(1 * time.Second)
+
+		lbServer.Lock()
+		network, ok := lbServer.Networks[networkID]
+		if ok {
+			_, ok = network.endpoints[endpointID]
+		}
+		lbServer.Unlock()
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
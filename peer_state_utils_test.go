@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/libnetwork/types"
+	"github.com/olljanat/docker-bgp-lb/api"
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+)
+
+// resetPeerStates forgets states of all peers. Table is cleared instead of replaced
+// because watcher of the test server keeps updating it.
+func resetPeerStates() {
+	peerStates.Lock()
+	defer peerStates.Unlock()
+	peerStates.peers = make(map[string]*peerState)
+}
+
+func TestWatchPeerState(t *testing.T) {
+	resetPeerStates()
+	defer resetPeerStates()
+	startTestBgpServer(t)
+	if err := watchPeerState(); err != nil {
+		t.Fatalf("watchPeerState() error = %v", err)
+	}
+
+	// Session with unreachable peer is never established
+	if err := bgpServer.AddPeer(context.Background(), &apiGoBGP.AddPeerRequest{Peer: &apiGoBGP.Peer{
+		Conf: &apiGoBGP.PeerConf{NeighborAddress: "192.0.2.1", PeerAsn: 65001},
+	}}); err != nil {
+		t.Fatalf("AddPeer() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(peerStates.status()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := peerStates.status()
+	if len(status) != 1 || status[0].Address != "192.0.2.1" || peerStates.established() {
+		t.Errorf("peer states = %+v, want 192.0.2.1 which is not established", status)
+	}
+}
+
+func TestRequirePeer(t *testing.T) {
+	resetPeerStates()
+	defer func() {
+		resetPeerStates()
+		lbServer = nil
+	}()
+	if _, err := parseNetworkOptions(testGenericOptions(map[string]string{optRequirePeer: "true"})); err == nil {
+		t.Error("parseNetworkOptions() accepted require_peer true")
+	}
+	options, err := parseNetworkOptions(testGenericOptions(map[string]string{optRequirePeer: requirePeerJoin}))
+	if err != nil {
+		t.Fatalf("parseNetworkOptions() error = %v", err)
+	}
+	lbServer = &bgpLB{Networks: map[string]*bgpNetwork{
+		"net1": {Options: options, endpoints: map[string]*bgpLBEndpoint{"ep1": {}, "ep2": {}}},
+	}}
+
+	peerStates.set("192.0.2.11", apiGoBGP.PeerState_ACTIVE)
+	peerStates.set("192.0.2.12", apiGoBGP.PeerState_CONNECT)
+	_, err = lbServer.Join(&api.JoinRequest{NetworkID: "net1", EndpointID: "ep1"})
+	if _, ok := err.(types.ForbiddenError); !ok {
+		t.Errorf("Join() without established session error = %v, want forbidden", err)
+	}
+	if want := "192.0.2.11=ACTIVE,192.0.2.12=CONNECT"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Join() error = %v, want peer states %s", err, want)
+	}
+
+	// Announcement waits for session and is dropped when endpoint leaves meanwhile
+	result := make(chan bool, 2)
+	go func() { result <- waitPeerEstablished("net1", "ep1") }()
+	go func() { result <- waitPeerEstablished("net1", "ep2") }()
+	lbServer.Lock()
+	delete(lbServer.Networks["net1"].endpoints, "ep2")
+	lbServer.Unlock()
+	if got := <-result; got {
+		t.Error("waitPeerEstablished() returned true for removed endpoint")
+	}
+	peerStates.set("192.0.2.12", apiGoBGP.PeerState_ESTABLISHED)
+	select {
+	case got := <-result:
+		if !got {
+			t.Error("waitPeerEstablished() returned false after session was established")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("waitPeerEstablished() did not return after session was established")
+	}
+	if !peerStates.established() {
+		t.Error("established() = false with established session")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+)
+
+// bgpPeerConfig is a BGP neighbor of the embedded BGP server.
+type bgpPeerConfig struct {
+	Address      string
+	AS           uint32
+	Group        string
+	Password     string
+	LocalAddress string
+	// Multihop is TTL of packets sent to eBGP peer which is not directly connected
+	Multihop uint32
+	// TTLSecurity is maximum number of hops to peer with GTSM (RFC 5082)
+	TTLSecurity uint32
+}
+
+// dynamicNeighborConfig accepts BGP sessions from any address inside Prefix. Sessions
+// are only accepted, never initiated.
+type dynamicNeighborConfig struct {
+	Prefix      string
+	AS          uint32
+	Group       string
+	Password    string
+	TTLSecurity uint32
+}
+
+var (
+	bgpPeers         = []*bgpPeerConfig{}
+	dynamicNeighbors = []*dynamicNeighborConfig{}
+)
+
+func parsePeerHops(name, value string) (uint32, error) {
+	hops, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || hops == 0 {
+		return 0, fmt.Errorf("%s value is invalid, value must be between 1 and 255\r\n", name)
+	}
+	return uint32(hops), nil
+}
+
+func parsePeerAS(name, value string) (uint32, error) {
+	as, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s value is invalid\r\n", name)
+	}
+	return uint32(as), nil
+}
+
+// parsePeers reads peer configuration from PEER_ADDRESS, PEER_AS, PEER_PASSWORD and
+// PEER_GROUP plus any additional peers from PEERS. Format of PEERS is semicolon
+// separated list of peers, each of them comma separated list of key=value pairs, e.g.
+// PEERS="address=10.1.1.1,as=65501,group=fabric;address=10.1.1.2,as=65501,group=fabric"
+func parsePeers() ([]*bgpPeerConfig, error) {
+	peers := []*bgpPeerConfig{}
+
+	if peerAddress := os.Getenv("PEER_ADDRESS"); peerAddress != "" {
+		if net.ParseIP(peerAddress) == nil {
+			return nil, fmt.Errorf("Value of PEER_ADDRESS is not a valid IP address. Got: %s\r\n", peerAddress)
+		}
+		peerAs, err := parsePeerAS("Environment variable PEER_AS", os.Getenv("PEER_AS"))
+		if err != nil {
+			return nil, err
+		}
+		peer := &bgpPeerConfig{
+			Address:      peerAddress,
+			AS:           peerAs,
+			Group:        os.Getenv("PEER_GROUP"),
+			Password:     os.Getenv("PEER_PASSWORD"),
+			LocalAddress: os.Getenv("PEER_LOCAL_ADDRESS"),
+		}
+		if peer.LocalAddress != "" && net.ParseIP(peer.LocalAddress) == nil {
+			return nil, fmt.Errorf("Environment variable PEER_LOCAL_ADDRESS value is invalid\r\n")
+		}
+		if v := os.Getenv("PEER_MULTIHOP"); v != "" {
+			if peer.Multihop, err = parsePeerHops("Environment variable PEER_MULTIHOP", v); err != nil {
+				return nil, err
+			}
+		}
+		if v := os.Getenv("PEER_TTL_SECURITY"); v != "" {
+			if peer.TTLSecurity, err = parsePeerHops("Environment variable PEER_TTL_SECURITY", v); err != nil {
+				return nil, err
+			}
+		}
+		if err := peer.validate(); err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+
+	for _, entry := range strings.Split(os.Getenv("PEERS"), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		peer := &bgpPeerConfig{}
+		for _, kv := range strings.Split(entry, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			switch key {
+			case "address":
+				if net.ParseIP(value) == nil {
+					return nil, fmt.Errorf("Environment variable PEERS has invalid address %s\r\n", value)
+				}
+				peer.Address = value
+			case "as":
+				as, err := parsePeerAS("Environment variable PEERS as", value)
+				if err != nil {
+					return nil, err
+				}
+				peer.AS = as
+			case "group":
+				peer.Group = value
+			case "password":
+				peer.Password = value
+			case "local_address":
+				if net.ParseIP(value) == nil {
+					return nil, fmt.Errorf("Environment variable PEERS has invalid local_address %s\r\n", value)
+				}
+				peer.LocalAddress = value
+			case "multihop":
+				hops, err := parsePeerHops("Environment variable PEERS multihop", value)
+				if err != nil {
+					return nil, err
+				}
+				peer.Multihop = hops
+			case "ttl_security":
+				hops, err := parsePeerHops("Environment variable PEERS ttl_security", value)
+				if err != nil {
+					return nil, err
+				}
+				peer.TTLSecurity = hops
+			default:
+				return nil, fmt.Errorf("Environment variable PEERS has unknown key %s\r\n", key)
+			}
+		}
+		if peer.Address == "" || peer.AS == 0 {
+			return nil, fmt.Errorf("Environment variable PEERS entry '%s' must have address and as\r\n", entry)
+		}
+		if err := peer.validate(); err != nil {
+			return nil, err
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+// parseDynamicNeighbors reads DYNAMIC_NEIGHBORS which has same format as PEERS but
+// with prefix instead of address, e.g.
+// DYNAMIC_NEIGHBORS="prefix=10.1.0.0/24,as=65501,group=reflectors"
+func parseDynamicNeighbors() ([]*dynamicNeighborConfig, error) {
+	neighbors := []*dynamicNeighborConfig{}
+	for i, entry := range strings.Split(os.Getenv("DYNAMIC_NEIGHBORS"), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		neighbor := &dynamicNeighborConfig{Group: fmt.Sprintf("bgplb-dynamic-%d", i)}
+		for _, kv := range strings.Split(entry, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			switch key {
+			case "prefix":
+				_, ipnet, err := net.ParseCIDR(value)
+				if err != nil {
+					return nil, fmt.Errorf("Environment variable DYNAMIC_NEIGHBORS has invalid prefix %s\r\n", value)
+				}
+				neighbor.Prefix = ipnet.String()
+			case "as":
+				as, err := parsePeerAS("Environment variable DYNAMIC_NEIGHBORS as", value)
+				if err != nil {
+					return nil, err
+				}
+				neighbor.AS = as
+			case "group":
+				neighbor.Group = value
+			case "password":
+				neighbor.Password = value
+			case "ttl_security":
+				hops, err := parsePeerHops("Environment variable DYNAMIC_NEIGHBORS ttl_security", value)
+				if err != nil {
+					return nil, err
+				}
+				neighbor.TTLSecurity = hops
+			default:
+				return nil, fmt.Errorf("Environment variable DYNAMIC_NEIGHBORS has unknown key %s\r\n", key)
+			}
+		}
+		if neighbor.Prefix == "" || neighbor.AS == 0 {
+			return nil, fmt.Errorf("Environment variable DYNAMIC_NEIGHBORS entry '%s' must have prefix and as\r\n", entry)
+		}
+		neighbors = append(neighbors, neighbor)
+	}
+	return neighbors, nil
+}
+
+func (d *dynamicNeighborConfig) apiPeerGroup() *apiGoBGP.PeerGroup {
+	g := &apiGoBGP.PeerGroup{
+		Conf: &apiGoBGP.PeerGroupConf{
+			PeerGroupName: d.Group,
+			PeerAsn:       d.AS,
+			AuthPassword:  d.Password,
+		},
+	}
+	if d.TTLSecurity > 0 {
+		g.TtlSecurity = &apiGoBGP.TtlSecurity{Enabled: true, TtlMin: 256 - d.TTLSecurity}
+	}
+	return g
+}
+
+// addDynamicNeighbors makes the embedded BGP server accept sessions from prefixes
+// configured with DYNAMIC_NEIGHBORS.
+func addDynamicNeighbors(neighbors []*dynamicNeighborConfig) error {
+	ctx := context.Background()
+	for _, d := range neighbors {
+		if err := bgpServer.AddPeerGroup(ctx, &apiGoBGP.AddPeerGroupRequest{
+			PeerGroup: d.apiPeerGroup(),
+		}); err != nil {
+			return fmt.Errorf("addDynamicNeighbors: failed to add peer group %s: %w", d.Group, err)
+		}
+		if err := bgpServer.AddDynamicNeighbor(ctx, &apiGoBGP.AddDynamicNeighborRequest{
+			DynamicNeighbor: &apiGoBGP.DynamicNeighbor{Prefix: d.Prefix, PeerGroup: d.Group},
+		}); err != nil {
+			return fmt.Errorf("addDynamicNeighbors: failed to add dynamic neighbor %s: %w", d.Prefix, err)
+		}
+		log.Infof("Accepting BGP sessions from %s (AS %d)", d.Prefix, d.AS)
+	}
+	dynamicNeighbors = neighbors
+	return nil
+}
+
+func (p *bgpPeerConfig) apiPeer() *apiGoBGP.Peer {
+	n := &apiGoBGP.Peer{
+		Conf: &apiGoBGP.PeerConf{
+			NeighborAddress: p.Address,
+			PeerAsn:         p.AS,
+		},
+	}
+	if p.Password != "" {
+		n.Conf.AuthPassword = p.Password
+	}
+	if p.LocalAddress != "" {
+		n.Transport = &apiGoBGP.Transport{LocalAddress: p.LocalAddress}
+	}
+	if p.Multihop > 0 {
+		n.EbgpMultihop = &apiGoBGP.EbgpMultihop{Enabled: true, MultihopTtl: p.Multihop}
+	}
+	if p.TTLSecurity > 0 {
+		// Packets are sent with TTL 255 so peer N hops away must be received with TTL 256-N or more
+		n.TtlSecurity = &apiGoBGP.TtlSecurity{Enabled: true, TtlMin: 256 - p.TTLSecurity}
+	}
+	return n
+}
+
+// validate checks that session protection settings of peer can be used together.
+func (p *bgpPeerConfig) validate() error {
+	if p.Multihop > 0 && p.TTLSecurity > 0 {
+		return fmt.Errorf("Peer %s cannot have both multihop and ttl_security, ttl_security allows multiple hops already\r\n", p.Address)
+	}
+	return nil
+}
+
+func isPeerSelector(selector string) bool {
+	for _, p := range bgpPeers {
+		if p.Address == selector || (p.Group != "" && p.Group == selector) {
+			return true
+		}
+	}
+	for _, d := range dynamicNeighbors {
+		if d.Group == selector {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePeerSelectors returns addresses of peers matching given peer addresses or group
+// names. Groups of dynamic neighbors are resolved to their prefixes.
+func resolvePeerSelectors(selectors []string) []string {
+	addresses := []string{}
+	for _, p := range bgpPeers {
+		if slices.Contains(selectors, p.Address) || (p.Group != "" && slices.Contains(selectors, p.Group)) {
+			addresses = append(addresses, p.Address)
+		}
+	}
+	for _, d := range dynamicNeighbors {
+		if slices.Contains(selectors, d.Group) {
+			addresses = append(addresses, d.Prefix)
+		}
+	}
+	return addresses
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParsePeers(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		want  []bgpPeerConfig
+		valid bool
+	}{
+		{"no peers", map[string]string{}, nil, true},
+		{"single peer", map[string]string{"PEER_ADDRESS": "192.0.2.1", "PEER_AS": "65001", "PEER_GROUP": "spines"}, []bgpPeerConfig{
+			{Address: "192.0.2.1", AS: 65001, Group: "spines"},
+		}, true},
+		{"single peer with invalid address", map[string]string{"PEER_ADDRESS": "spine1", "PEER_AS": "65001"}, nil, false},
+		{"single peer without as", map[string]string{"PEER_ADDRESS": "192.0.2.1"}, nil, false},
+		{"single peer with invalid local address", map[string]string{"PEER_ADDRESS": "192.0.2.1", "PEER_AS": "65001", "PEER_LOCAL_ADDRESS": "eth0"}, nil, false},
+		{"peers list", map[string]string{
+			"PEER_ADDRESS": "192.0.2.1", "PEER_AS": "65001",
+			"PEERS": "address=192.0.2.2, as=65002, group=spines, password=secret; address=2001:db8::1,as=65003,local_address=2001:db8::10;",
+		}, []bgpPeerConfig{
+			{Address: "192.0.2.1", AS: 65001},
+			{Address: "192.0.2.2", AS: 65002, Group: "spines", Password: "secret"},
+			{Address: "2001:db8::1", AS: 65003, LocalAddress: "2001:db8::10"},
+		}, true},
+		{"peers list without as", map[string]string{"PEERS": "address=192.0.2.2"}, nil, false},
+		{"peers list with unknown key", map[string]string{"PEERS": "address=192.0.2.2,as=65002,port=179"}, nil, false},
+		{"peers list with invalid address", map[string]string{"PEERS": "address=spine2,as=65002"}, nil, false},
+	}
+	for _, tt := range tests {
+		for _, name := range []string{"PEER_ADDRESS", "PEER_AS", "PEER_GROUP", "PEER_PASSWORD", "PEER_LOCAL_ADDRESS", "PEERS"} {
+			t.Setenv(name, tt.env[name])
+		}
+		peers, err := parsePeers()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: parsePeers() error = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if len(peers) != len(tt.want) {
+			t.Errorf("%s: parsePeers() returned %d peers, want %d", tt.name, len(peers), len(tt.want))
+			continue
+		}
+		for i, p := range peers {
+			if *p != tt.want[i] {
+				t.Errorf("%s: parsePeers() peer %d = %+v, want %+v", tt.name, i, *p, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestParseDynamicNeighbors(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []dynamicNeighborConfig
+		valid bool
+	}{
+		{"", nil, true},
+		{"prefix=10.1.0.1/24,as=65501", []dynamicNeighborConfig{
+			{Prefix: "10.1.0.0/24", AS: 65501, Group: "bgplb-dynamic-0"},
+		}, true},
+		{"prefix=10.1.0.0/24,as=65501,group=reflectors,password=secret,ttl_security=1;prefix=2001:db8::/64,as=65502", []dynamicNeighborConfig{
+			{Prefix: "10.1.0.0/24", AS: 65501, Group: "reflectors", Password: "secret", TTLSecurity: 1},
+			{Prefix: "2001:db8::/64", AS: 65502, Group: "bgplb-dynamic-1"},
+		}, true},
+		{"prefix=10.1.0.0,as=65501", nil, false},
+		{"prefix=10.1.0.0/24", nil, false},
+		{"as=65501", nil, false},
+		{"prefix=10.1.0.0/24,as=65501,multihop=2", nil, false},
+		{"prefix=10.1.0.0/24,as=65501,ttl_security=0", nil, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("DYNAMIC_NEIGHBORS", tt.value)
+		neighbors, err := parseDynamicNeighbors()
+		if (err == nil) != tt.valid {
+			t.Errorf("parseDynamicNeighbors() with %q error = %v, want valid %v", tt.value, err, tt.valid)
+			continue
+		}
+		if len(neighbors) != len(tt.want) {
+			t.Errorf("parseDynamicNeighbors() with %q returned %d neighbors, want %d", tt.value, len(neighbors), len(tt.want))
+			continue
+		}
+		for i, n := range neighbors {
+			if *n != tt.want[i] {
+				t.Errorf("parseDynamicNeighbors() with %q neighbor %d = %+v, want %+v", tt.value, i, *n, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestPeerSessionProtection(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		multihopTTL []uint32
+		ttlMin      []uint32
+		valid       bool
+	}{
+		{"directly connected", map[string]string{"PEER_ADDRESS": "192.0.2.1", "PEER_AS": "65001"}, []uint32{0}, []uint32{0}, true},
+		{"multihop", map[string]string{"PEER_ADDRESS": "192.0.2.1", "PEER_AS": "65001", "PEER_MULTIHOP": "2"}, []uint32{2}, []uint32{0}, true},
+		{"ttl security of directly connected peer", map[string]string{"PEER_ADDRESS": "192.0.2.1", "PEER_AS": "65001", "PEER_TTL_SECURITY": "1"}, []uint32{0}, []uint32{255}, true},
+		{"peers list", map[string]string{"PEERS": "address=192.0.2.2,as=65002,multihop=3;address=192.0.2.3,as=65002,ttl_security=2"}, []uint32{3, 0}, []uint32{0, 254}, true},
+		{"multihop and ttl security", map[string]string{"PEER_ADDRESS": "192.0.2.1", "PEER_AS": "65001", "PEER_MULTIHOP": "2", "PEER_TTL_SECURITY": "1"}, nil, nil, false},
+		{"zero hops", map[string]string{"PEER_ADDRESS": "192.0.2.1", "PEER_AS": "65001", "PEER_TTL_SECURITY": "0"}, nil, nil, false},
+		{"too many hops", map[string]string{"PEERS": "address=192.0.2.2,as=65002,multihop=256"}, nil, nil, false},
+	}
+	for _, tt := range tests {
+		for _, name := range []string{"PEER_ADDRESS", "PEER_AS", "PEER_MULTIHOP", "PEER_TTL_SECURITY", "PEERS"} {
+			t.Setenv(name, tt.env[name])
+		}
+		peers, err := parsePeers()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: parsePeers() error = %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for i, p := range peers {
+			n := p.apiPeer()
+			multihopTTL, ttlMin := uint32(0), uint32(0)
+			if n.EbgpMultihop != nil && n.EbgpMultihop.Enabled {
+				multihopTTL = n.EbgpMultihop.MultihopTtl
+			}
+			if n.TtlSecurity != nil && n.TtlSecurity.Enabled {
+				ttlMin = n.TtlSecurity.TtlMin
+			}
+			if multihopTTL != tt.multihopTTL[i] || ttlMin != tt.ttlMin[i] {
+				t.Errorf("%s: peer %s has multihop TTL %d and minimum TTL %d, want %d and %d", tt.name, p.Address, multihopTTL, ttlMin, tt.multihopTTL[i], tt.ttlMin[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+)
+
+const (
+	exportPolicyName = "bgplb-export"
+	importPolicyName = "bgplb-import"
+)
+
+// prefixPeerTable holds which peers (addresses or peer groups) may receive each prefix.
+// Prefixes which are not in the table are sent to all peers.
+type prefixPeerTable struct {
+	prefixes map[string][]string
+	sync.Mutex
+}
+
+var prefixPeers = &prefixPeerTable{prefixes: make(map[string][]string)}
+
+func setPrefixPeers(prefix string, selectors []string) error {
+	if len(selectors) == 0 {
+		return nil
+	}
+	if err := requireEmbeddedBgp("peer selection"); err != nil {
+		return err
+	}
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+
+	prefixPeers.Lock()
+	defer prefixPeers.Unlock()
+	prefixPeers.prefixes[ipnet.String()] = selectors
+	return applyPolicies()
+}
+
+func clearPrefixPeers(prefix string) error {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+
+	prefixPeers.Lock()
+	defer prefixPeers.Unlock()
+	if _, ok := prefixPeers.prefixes[ipnet.String()]; !ok {
+		return nil
+	}
+	delete(prefixPeers.prefixes, ipnet.String())
+	return applyPolicies()
+}
+
+// exportStatements generates defined sets and statements which reject prefixes
+// towards peers which were not selected for them. Prefixes with same peer selection
+// and address family share one prefix set.
+func exportStatements() ([]*apiGoBGP.DefinedSet, []*apiGoBGP.Statement) {
+	groups := make(map[string][]string)
+	for prefix, selectors := range prefixPeers.prefixes {
+		family := "ipv4"
+		if strings.Contains(prefix, ":") {
+			family = "ipv6"
+		}
+		sorted := append([]string(nil), selectors...)
+		sort.Strings(sorted)
+		key := family + "|" + strings.Join(sorted, ",")
+		groups[key] = append(groups[key], prefix)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sets := []*apiGoBGP.DefinedSet{}
+	statements := []*apiGoBGP.Statement{}
+	for i, key := range keys {
+		_, selectors, _ := strings.Cut(key, "|")
+
+		prefixSet := &apiGoBGP.DefinedSet{
+			DefinedType: apiGoBGP.DefinedType_PREFIX,
+			Name:        fmt.Sprintf("%s-prefixes-%d", exportPolicyName, i),
+		}
+		for _, prefix := range groups[key] {
+			_, ipnet, _ := net.ParseCIDR(prefix)
+			ones, _ := ipnet.Mask.Size()
+			prefixSet.Prefixes = append(prefixSet.Prefixes, &apiGoBGP.Prefix{
+				IpPrefix:      prefix,
+				MaskLengthMin: uint32(ones),
+				MaskLengthMax: uint32(ones),
+			})
+		}
+		sets = append(sets, prefixSet)
+
+		statement := &apiGoBGP.Statement{
+			Name: fmt.Sprintf("%s-%d", exportPolicyName, i),
+			Conditions: &apiGoBGP.Conditions{
+				PrefixSet: &apiGoBGP.MatchSet{Type: apiGoBGP.MatchSet_ANY, Name: prefixSet.Name},
+			},
+			Actions: &apiGoBGP.Actions{RouteAction: apiGoBGP.RouteAction_REJECT},
+		}
+
+		// Without any matching peer prefix is rejected towards everyone
+		if addresses := resolvePeerSelectors(strings.Split(selectors, ",")); len(addresses) > 0 {
+			neighborSet := &apiGoBGP.DefinedSet{
+				DefinedType: apiGoBGP.DefinedType_NEIGHBOR,
+				Name:        fmt.Sprintf("%s-peers-%d", exportPolicyName, i),
+				List:        addresses,
+			}
+			sets = append(sets, neighborSet)
+			statement.Conditions.NeighborSet = &apiGoBGP.MatchSet{Type: apiGoBGP.MatchSet_INVERT, Name: neighborSet.Name}
+		}
+		statements = append(statements, statement)
+	}
+
+	return sets, statements
+}
+
+// applyPolicies replaces GoBGP routing policies with ones generated from the current
+// state of the plugin and re-sends routes to peers so that changes take effect.
+func applyPolicies() error {
+	ctx := context.Background()
+	exportSets, exportRules := exportStatements()
+	importSets, importRules := importStatements()
+
+	if err := bgpServer.SetPolicies(ctx, &apiGoBGP.SetPoliciesRequest{
+		DefinedSets: append(exportSets, importSets...),
+		Policies: []*apiGoBGP.Policy{
+			{Name: exportPolicyName, Statements: exportRules},
+			{Name: importPolicyName, Statements: importRules},
+		},
+	}); err != nil {
+		return fmt.Errorf("applyPolicies: failed to set policies: %w", err)
+	}
+
+	if err := bgpServer.SetPolicyAssignment(ctx, &apiGoBGP.SetPolicyAssignmentRequest{
+		Assignment: &apiGoBGP.PolicyAssignment{
+			Name:          "global",
+			Direction:     apiGoBGP.PolicyDirection_EXPORT,
+			Policies:      []*apiGoBGP.Policy{{Name: exportPolicyName}},
+			DefaultAction: apiGoBGP.RouteAction_ACCEPT,
+		},
+	}); err != nil {
+		return fmt.Errorf("applyPolicies: failed to assign export policy: %w", err)
+	}
+
+	// Without IMPORT_PREFIXES import policy is empty and all routes are accepted
+	importDefault := apiGoBGP.RouteAction_ACCEPT
+	if len(importRules) > 0 {
+		importDefault = apiGoBGP.RouteAction_REJECT
+	}
+	if err := bgpServer.SetPolicyAssignment(ctx, &apiGoBGP.SetPolicyAssignmentRequest{
+		Assignment: &apiGoBGP.PolicyAssignment{
+			Name:          "global",
+			Direction:     apiGoBGP.PolicyDirection_IMPORT,
+			Policies:      []*apiGoBGP.Policy{{Name: importPolicyName}},
+			DefaultAction: importDefault,
+		},
+	}); err != nil {
+		return fmt.Errorf("applyPolicies: failed to assign import policy: %w", err)
+	}
+
+	if err := bgpServer.ResetPeer(ctx, &apiGoBGP.ResetPeerRequest{
+		Address:   "all",
+		Soft:      true,
+		Direction: apiGoBGP.ResetPeerRequest_OUT,
+	}); err != nil {
+		log.Warnf("applyPolicies: failed to re-send routes to peers: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/libnetwork/netlabel"
+	apiGoBGP "github.com/osrg/gobgp/v3/api"
+	serverGoBGP "github.com/osrg/gobgp/v3/pkg/server"
+)
+
+func TestExportStatements(t *testing.T) {
+	bgpPeers = []*bgpPeerConfig{
+		{Address: "192.0.2.1", Group: "spines"},
+		{Address: "192.0.2.2", Group: "spines"},
+		{Address: "192.0.2.3"},
+	}
+	dynamicNeighbors = []*dynamicNeighborConfig{{Prefix: "198.51.100.0/24", Group: "tenants"}}
+	defer func() {
+		bgpPeers, dynamicNeighbors = nil, nil
+		prefixPeers.prefixes = make(map[string][]string)
+	}()
+
+	type want struct {
+		prefixes []string
+		peers    []string
+	}
+	tests := []struct {
+		name     string
+		prefixes map[string][]string
+		want     []want
+	}{
+		{"no selections", map[string][]string{}, nil},
+		{"group", map[string][]string{"10.0.0.1/32": {"spines"}}, []want{
+			{[]string{"10.0.0.1/32"}, []string{"192.0.2.1", "192.0.2.2"}},
+		}},
+		{"same selection shares prefix set", map[string][]string{
+			"10.0.0.1/32": {"192.0.2.3", "spines"},
+			"10.0.0.2/32": {"spines", "192.0.2.3"},
+		}, []want{
+			{[]string{"10.0.0.1/32", "10.0.0.2/32"}, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}},
+		}},
+		{"families have own prefix sets", map[string][]string{
+			"10.0.0.1/32":     {"192.0.2.3"},
+			"2001:db8::1/128": {"192.0.2.3"},
+		}, []want{
+			{[]string{"10.0.0.1/32"}, []string{"192.0.2.3"}},
+			{[]string{"2001:db8::1/128"}, []string{"192.0.2.3"}},
+		}},
+		{"dynamic neighbors", map[string][]string{"10.0.0.1/32": {"tenants"}}, []want{
+			{[]string{"10.0.0.1/32"}, []string{"198.51.100.0/24"}},
+		}},
+		{"no matching peer rejects towards everyone", map[string][]string{"10.0.0.1/32": {"leaves"}}, []want{
+			{[]string{"10.0.0.1/32"}, nil},
+		}},
+	}
+	for _, tt := range tests {
+		prefixPeers.prefixes = tt.prefixes
+		sets, statements := exportStatements()
+		if len(statements) != len(tt.want) {
+			t.Errorf("%s: got %d statements, want %d", tt.name, len(statements), len(tt.want))
+			continue
+		}
+		definedSets := make(map[string]*apiGoBGP.DefinedSet)
+		for _, s := range sets {
+			definedSets[s.Name] = s
+		}
+		for i, s := range statements {
+			if s.Actions.RouteAction != apiGoBGP.RouteAction_REJECT {
+				t.Errorf("%s: statement %s action = %v, want reject", tt.name, s.Name, s.Actions.RouteAction)
+			}
+			prefixSet := definedSets[s.Conditions.PrefixSet.Name]
+			if prefixSet == nil {
+				t.Errorf("%s: statement %s refers to missing prefix set", tt.name, s.Name)
+				continue
+			}
+			prefixes := []string{}
+			for _, p := range prefixSet.Prefixes {
+				prefixes = append(prefixes, p.IpPrefix)
+				if p.MaskLengthMin != p.MaskLengthMax {
+					t.Errorf("%s: prefix %s matches mask lengths %d-%d, want exact match", tt.name, p.IpPrefix, p.MaskLengthMin, p.MaskLengthMax)
+				}
+			}
+			slices.Sort(prefixes)
+			if !slices.Equal(prefixes, tt.want[i].prefixes) {
+				t.Errorf("%s: statement %s prefixes = %v, want %v", tt.name, s.Name, prefixes, tt.want[i].prefixes)
+			}
+
+			if tt.want[i].peers == nil {
+				if s.Conditions.NeighborSet != nil {
+					t.Errorf("%s: statement %s has neighbor condition, want rejection towards all peers", tt.name, s.Name)
+				}
+				continue
+			}
+			if s.Conditions.NeighborSet == nil || s.Conditions.NeighborSet.Type != apiGoBGP.MatchSet_INVERT {
+				t.Errorf("%s: statement %s neighbor condition = %v, want inverted match", tt.name, s.Name, s.Conditions.NeighborSet)
+				continue
+			}
+			peers := slices.Clone(definedSets[s.Conditions.NeighborSet.Name].List)
+			slices.Sort(peers)
+			if !slices.Equal(peers, tt.want[i].peers) {
+				t.Errorf("%s: statement %s peers = %v, want %v", tt.name, s.Name, peers, tt.want[i].peers)
+			}
+		}
+	}
+}
+
+// testBgpServerOnce creates the embedded server once because Serve of the global
+// server never returns and replacing the server under it is a data race.
+var testBgpServerOnce sync.Once
+
+// startTestBgpServer starts embedded GoBGP server which does not listen for peers.
+// Server is stopped after the test which clears its peers, RIB and policies.
+func startTestBgpServer(t *testing.T) {
+	t.Helper()
+	testBgpServerOnce.Do(func() {
+		bgpServer = *serverGoBGP.NewBgpServer()
+		go bgpServer.Serve()
+	})
+	routerID = "192.0.2.254"
+	if err := bgpServer.StartBgp(context.Background(), &apiGoBGP.StartBgpRequest{
+		Global: &apiGoBGP.Global{RouterId: routerID, Asn: 65000, ListenPort: -1},
+	}); err != nil {
+		t.Fatalf("StartBgp() error = %v", err)
+	}
+	t.Cleanup(func() { bgpServer.StopBgp(context.Background(), &apiGoBGP.StopBgpRequest{}) })
+}
+
+func exportPolicyStatements(t *testing.T) int {
+	t.Helper()
+	count := -1
+	if err := bgpServer.ListPolicy(context.Background(), &apiGoBGP.ListPolicyRequest{Name: exportPolicyName}, func(p *apiGoBGP.Policy) {
+		count = len(p.Statements)
+	}); err != nil {
+		t.Fatalf("ListPolicy() error = %v", err)
+	}
+	return count
+}
+
+func TestPrefixPeersPolicy(t *testing.T) {
+	bgpPeers = []*bgpPeerConfig{{Address: "192.0.2.1", Group: "spines"}, {Address: "192.0.2.2"}}
+	defer func() {
+		bgpPeers = nil
+		prefixPeers.prefixes = make(map[string][]string)
+	}()
+	startTestBgpServer(t)
+
+	generic := map[string]interface{}{optPeers: "192.0.2.3"}
+	if _, err := parseNetworkOptions(map[string]interface{}{netlabel.GenericData: generic}); err == nil {
+		t.Error("parseNetworkOptions() accepted peer which is not configured")
+	}
+	generic[optPeers] = "spines, 192.0.2.2"
+	options, err := parseNetworkOptions(map[string]interface{}{netlabel.GenericData: generic})
+	if err != nil {
+		t.Fatalf("parseNetworkOptions() error = %v", err)
+	}
+
+	if err := setPrefixPeers("10.0.0.1/32", options.Peers); err != nil {
+		t.Fatalf("setPrefixPeers() error = %v", err)
+	}
+	if got := exportPolicyStatements(t); got != 1 {
+		t.Errorf("export policy has %d statements after setPrefixPeers(), want 1", got)
+	}
+	var assigned []*apiGoBGP.PolicyAssignment
+	bgpServer.ListPolicyAssignment(context.Background(), &apiGoBGP.ListPolicyAssignmentRequest{
+		Name: "global", Direction: apiGoBGP.PolicyDirection_EXPORT,
+	}, func(a *apiGoBGP.PolicyAssignment) { assigned = append(assigned, a) })
+	if len(assigned) != 1 || len(assigned[0].Policies) != 1 || assigned[0].Policies[0].Name != exportPolicyName {
+		t.Errorf("export policy assignment = %v, want %s", assigned, exportPolicyName)
+	}
+
+	// Networks without peer selection do not change policies
+	if err := setPrefixPeers("10.0.0.2/32", nil); err != nil || len(prefixPeers.prefixes) != 1 {
+		t.Errorf("setPrefixPeers() without peers = %v, selections %v", err, prefixPeers.prefixes)
+	}
+
+	if err := clearPrefixPeers("10.0.0.1/32"); err != nil {
+		t.Fatalf("clearPrefixPeers() error = %v", err)
+	}
+	if got := exportPolicyStatements(t); got != 0 {
+		t.Errorf("export policy has %d statements after clearPrefixPeers(), want 0", got)
+	}
+}
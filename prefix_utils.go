@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	allowedPrefixes []*net.IPNet
+	deniedPrefixes  []*net.IPNet
+)
+
+func parsePrefixList(name string) ([]*net.IPNet, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	prefixes := []*net.IPNet{}
+	for _, p := range strings.Split(value, ",") {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("Environment variable %s value is invalid: %v\r\n", name, err)
+		}
+		prefixes = append(prefixes, ipnet)
+	}
+	return prefixes, nil
+}
+
+func loadPrefixFilter() error {
+	var err error
+	if allowedPrefixes, err = parsePrefixList("PREFIX_ALLOWLIST"); err != nil {
+		return err
+	}
+	if deniedPrefixes, err = parsePrefixList("PREFIX_DENYLIST"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func prefixContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+func prefixOverlaps(a, b *net.IPNet) bool {
+	return prefixContains(a, b) || prefixContains(b, a)
+}
+
+// checkPrefixAllowed returns an error if prefix must not be announced by this host.
+// Prefix must be inside one of PREFIX_ALLOWLIST entries (when set) and must not
+// overlap with any of PREFIX_DENYLIST entries. Rejected attempts are logged for auditing.
+func checkPrefixAllowed(prefix, source string) error {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, denied := range deniedPrefixes {
+		if prefixOverlaps(denied, ipnet) {
+			log.WithField("prefix", ipnet.String()).WithField("source", source).Warnf("Rejected prefix which overlaps with denied prefix %s", denied)
+			return fmt.Errorf("prefix %s overlaps with %s which is denied by PREFIX_DENYLIST", ipnet, denied)
+		}
+	}
+
+	if len(allowedPrefixes) == 0 {
+		return nil
+	}
+	for _, allowed := range allowedPrefixes {
+		if prefixContains(allowed, ipnet) {
+			return nil
+		}
+	}
+	log.WithField("prefix", ipnet.String()).WithField("source", source).Warn("Rejected prefix which is not part of any allowed prefix")
+	return fmt.Errorf("prefix %s is not allowed by PREFIX_ALLOWLIST", ipnet)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckPrefixAllowed(t *testing.T) {
+	defer func() { allowedPrefixes, deniedPrefixes = nil, nil }()
+
+	tests := []struct {
+		allowlist string
+		denylist  string
+		prefix    string
+		allowed   bool
+	}{
+		{"", "", "10.0.0.1/32", true},
+		{"10.0.0.0/24", "", "10.0.0.1/32", true},
+		{"10.0.0.0/24", "", "10.0.0.0/24", true},
+		{"10.0.0.0/24", "", "10.0.0.0/16", false},
+		{"10.0.0.0/24", "", "10.0.1.1/32", false},
+		{"10.0.0.0/24", "", "2001:db8::1/128", false},
+		{"10.0.0.0/24, 2001:db8::/32", "", "2001:db8::1/128", true},
+		{"", "10.0.0.128/25", "10.0.0.200/32", false},
+		{"", "10.0.0.128/25", "10.0.0.0/24", false},
+		{"", "10.0.0.128/25", "10.0.0.1/32", true},
+		{"10.0.0.0/24", "10.0.0.128/25", "10.0.0.200/32", false},
+		{"", "0.0.0.0/0", "2001:db8::1/128", true},
+		{"", "", "10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("PREFIX_ALLOWLIST", tt.allowlist)
+		t.Setenv("PREFIX_DENYLIST", tt.denylist)
+		if err := loadPrefixFilter(); err != nil {
+			t.Fatalf("loadPrefixFilter() error = %v", err)
+		}
+		err := checkPrefixAllowed(tt.prefix, "test")
+		if (err == nil) != tt.allowed {
+			t.Errorf("checkPrefixAllowed(%s) with allowlist %q and denylist %q error = %v, want allowed %v", tt.prefix, tt.allowlist, tt.denylist, err, tt.allowed)
+		}
+	}
+}
+
+func TestLoadPrefixFilterInvalid(t *testing.T) {
+	defer func() { allowedPrefixes, deniedPrefixes = nil, nil }()
+
+	t.Setenv("PREFIX_ALLOWLIST", "10.0.0.0/24,10.0.1.0")
+	if err := loadPrefixFilter(); err == nil {
+		t.Error("loadPrefixFilter() accepted prefix without length")
+	}
+}
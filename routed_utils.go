@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// ipv4DevconfProxyARP is IPV4_DEVCONF_PROXY_ARP of linux/ip.h
+const ipv4DevconfProxyARP = 3
+
+// hostIPv6Conf is /proc/sys/net/ipv6/conf of host, writable unlike /proc/sys of
+// plugin. Whole /proc/sys/net is mounted (see config.json) because ipv6 directory
+// is missing when IPv6 is disabled and missing mount source fails plugin start.
+var hostIPv6Conf = "/host/proc/sys/net/ipv6/conf"
+
+// routedLinks maps endpoints of routed networks to their host side veth. It is kept
+// outside of lbServer so that routes can be found without holding its lock.
+var routedLinks sync.Map
+
+// routeLinkName returns name of the link which has local routes of endpoint. Endpoints
+// of routed networks use their own veth, others the bridge of their network.
+func routeLinkName(networkID, endpointID string) string {
+	if name, ok := routedLinks.Load(endpointID); ok {
+		return name.(string)
+	}
+	return getBridgeNameByNetID(networkID)
+}
+
+// setupRoutedVeth prepares host side veth of routed network for point-to-point routing.
+// Host answers ARP of container for every address which it has route to so container
+// reaches other endpoints of its subnet through the host without shared L2 segment.
+func setupRoutedVeth(name string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("setupRoutedVeth: failed to find interface %s: %w", name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("setupRoutedVeth: failed to start link %s: %w", name, err)
+	}
+	if err := setProxyARP(link); err != nil {
+		return nil, fmt.Errorf("setupRoutedVeth: %w", err)
+	}
+	if err := setProxyNDP(name); err != nil {
+		return nil, fmt.Errorf("setupRoutedVeth: %w", err)
+	}
+	return link, nil
+}
+
+// setProxyARP enables proxy ARP on link. It is set over netlink (IFLA_INET_CONF)
+// because /proc/sys is read-only inside plugin.
+func setProxyARP(link netlink.Link) error {
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	spec := nl.NewRtAttr(unix.IFLA_AF_SPEC, nil)
+	conf := spec.AddRtAttr(unix.AF_INET, nil).AddRtAttr(unix.IFLA_INET_CONF, nil)
+	conf.AddRtAttr(ipv4DevconfProxyARP, nl.Uint32Attr(1))
+	req.AddData(spec)
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to enable proxy_arp on %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// setProxyNDP enables proxy NDP on interface name. Kernel does not allow changing
+// IPv6 interface configuration over netlink so it is written to host /proc/sys.
+func setProxyNDP(name string) error {
+	path := filepath.Join(hostIPv6Conf, name, "proxy_ndp")
+	if err := os.WriteFile(path, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable proxy_ndp on %s: %w", name, err)
+	}
+	return nil
+}
+
+func endpointIPv6(endpoint *bgpLBEndpoint) net.IP {
+	if endpoint.ipv6 == "" {
+		return nil
+	}
+	ip, _, err := net.ParseCIDR(endpoint.ipv6)
+	if err != nil {
+		return nil
+	}
+	return ip
+}
+
+// addRoutedNeighbors adds proxy NDP entries between endpoint and other joined endpoints
+// of the routed network. Unlike proxy ARP, kernel only proxies NDP for listed addresses.
+// Caller must hold lock of lbServer.
+func addRoutedNeighbors(network *bgpNetwork, endpointID string, link netlink.Link) {
+	endpoint := network.endpoints[endpointID]
+	ip := endpointIPv6(endpoint)
+	for id, other := range network.endpoints {
+		if id == endpointID || other.vethOutside == "" {
+			continue
+		}
+		otherLink, err := netlink.LinkByName(other.vethOutside)
+		if err != nil {
+			continue
+		}
+		if ip != nil {
+			if err := netlink.NeighSet(proxyNeigh(otherLink, ip)); err != nil {
+				log.Warnf("Cannot add proxy neighbor %s to %s: %v", ip, other.vethOutside, err)
+			}
+		}
+		if otherIP := endpointIPv6(other); otherIP != nil {
+			if err := netlink.NeighSet(proxyNeigh(link, otherIP)); err != nil {
+				log.Warnf("Cannot add proxy neighbor %s to %s: %v", otherIP, endpoint.vethOutside, err)
+			}
+		}
+	}
+}
+
+// delRoutedNeighbors removes proxy NDP entries of endpoint from other endpoints of the
+// routed network. Caller must hold lock of lbServer.
+func delRoutedNeighbors(network *bgpNetwork, endpointID string) {
+	ip := endpointIPv6(network.endpoints[endpointID])
+	if ip == nil {
+		return
+	}
+	for id, other := range network.endpoints {
+		if id == endpointID || other.vethOutside == "" {
+			continue
+		}
+		if otherLink, err := netlink.LinkByName(other.vethOutside); err == nil {
+			netlink.NeighDel(proxyNeigh(otherLink, ip))
+		}
+	}
+}
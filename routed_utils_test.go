@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// testVeth creates veth pair for tests which need real interface. Test is skipped
+// when it cannot be created, e.g. when not running as root.
+func testVeth(t *testing.T, name string) netlink.Link {
+	t.Helper()
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		t.Skipf("cannot create veth %s: %v", name, err)
+	}
+	t.Cleanup(func() { netlink.LinkDel(veth) })
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatalf("LinkByName(%s) error = %v", name, err)
+	}
+	return link
+}
+
+func readSysctl(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read %s: %v", path, err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func TestSetupRoutedVeth(t *testing.T) {
+	link := testVeth(t, "bgplbtest0")
+	hostIPv6Conf = "/proc/sys/net/ipv6/conf"
+	defer func() { hostIPv6Conf = "/host/proc/sys/net/ipv6/conf" }()
+	if _, err := os.Stat(hostIPv6Conf); err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+
+	if _, err := setupRoutedVeth(link.Attrs().Name); err != nil {
+		t.Fatalf("setupRoutedVeth() error = %v", err)
+	}
+	if v := readSysctl(t, "/proc/sys/net/ipv4/conf/bgplbtest0/proxy_arp"); v != "1" {
+		t.Errorf("proxy_arp = %s, want 1", v)
+	}
+	if v := readSysctl(t, "/proc/sys/net/ipv6/conf/bgplbtest0/proxy_ndp"); v != "1" {
+		t.Errorf("proxy_ndp = %s, want 1", v)
+	}
+	up, _ := netlink.LinkByName(link.Attrs().Name)
+	if up.Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("setupRoutedVeth() did not set %s up", link.Attrs().Name)
+	}
+}
+
+func TestSetProxyNDPWithoutMount(t *testing.T) {
+	hostIPv6Conf = t.TempDir()
+	defer func() { hostIPv6Conf = "/host/proc/sys/net/ipv6/conf" }()
+	if err := setProxyNDP("missing0"); err == nil {
+		t.Error("setProxyNDP() succeeded without interface configuration directory")
+	}
+}
+
+func hasProxyNeigh(link netlink.Link, ip string) bool {
+	neighs, _ := netlink.NeighProxyList(link.Attrs().Index, netlink.FAMILY_V6)
+	for _, n := range neighs {
+		if n.IP.Equal(net.ParseIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRoutedNeighbors(t *testing.T) {
+	if _, err := parseNetworkOptions(testGenericOptions(map[string]string{optDataplane: "overlay"})); err == nil {
+		t.Error("parseNetworkOptions() accepted dataplane overlay")
+	}
+	options, err := parseNetworkOptions(testGenericOptions(map[string]string{optDataplane: dataplaneRouted}))
+	if err != nil || !options.routed() {
+		t.Fatalf("parseNetworkOptions() = %+v, %v, want routed dataplane", options, err)
+	}
+	if _, err := os.Stat("/proc/sys/net/ipv6"); err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	link1 := testVeth(t, "bgplbtest1")
+	link2 := testVeth(t, "bgplbtest2")
+	network := &bgpNetwork{Options: options, endpoints: map[string]*bgpLBEndpoint{
+		"ep1": {vethOutside: "bgplbtest1", ipv4: "10.0.0.1/24", ipv6: "2001:db8::1/64"},
+		"ep2": {vethOutside: "bgplbtest2", ipv4: "10.0.0.2/24", ipv6: "2001:db8::2/64"},
+		// Endpoint which has not joined yet has no veth
+		"ep3": {ipv6: "2001:db8::3/64"},
+	}}
+
+	addRoutedNeighbors(network, "ep2", link2)
+	if !hasProxyNeigh(link1, "2001:db8::2") || !hasProxyNeigh(link2, "2001:db8::1") {
+		t.Error("addRoutedNeighbors() did not make endpoints reachable from each other")
+	}
+	if hasProxyNeigh(link2, "2001:db8::3") {
+		t.Error("addRoutedNeighbors() added endpoint which has not joined")
+	}
+
+	delRoutedNeighbors(network, "ep2")
+	if hasProxyNeigh(link1, "2001:db8::2") {
+		t.Error("delRoutedNeighbors() left proxy neighbor of removed endpoint")
+	}
+
+	routedLinks.Store("ep2", "bgplbtest2")
+	defer routedLinks.Delete("ep2")
+	if name := routeLinkName("net1", "ep2"); name != "bgplbtest2" {
+		t.Errorf("routeLinkName() = %s, want veth of routed endpoint", name)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	lntypes "github.com/docker/docker/libnetwork/types"
+	"github.com/olljanat/docker-bgp-lb/api"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// Link local gateway addresses which every LB bridge has for return traffic
+	returnGatewayV4 = "169.254.0.1"
+	returnGatewayV6 = "fe80::1"
+
+	sourceRoutingTableBase  = 1000
+	sourceRoutingTableCount = 10000
+	sourceRoutingPriority   = 100
+)
+
+// allocateSourceRoutingTable returns lowest routing table which no other network
+// uses. Container can join multiple networks so each of them needs own table for
+// return traffic. Caller must hold the lock.
+func (d *bgpLB) allocateSourceRoutingTable() (int, error) {
+	used := make(map[int]bool)
+	for _, n := range d.Networks {
+		used[n.SourceRoutingTable] = true
+	}
+	for table := sourceRoutingTableBase; table < sourceRoutingTableBase+sourceRoutingTableCount; table++ {
+		if !used[table] {
+			return table, nil
+		}
+	}
+	return 0, fmt.Errorf("allocateSourceRoutingTable: all %d routing tables are in use", sourceRoutingTableCount)
+}
+
+// sourceRoutingTable returns routing table which is used for return traffic of the
+// network inside containers.
+func (d *bgpLB) sourceRoutingTable(networkID string) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	n, ok := d.Networks[networkID]
+	if !ok || n.SourceRoutingTable == 0 {
+		return 0, fmt.Errorf("network %s has no source routing table", networkID)
+	}
+	return n.SourceRoutingTable, nil
+}
+
+// checkTableFree returns an error if table already has default route through other
+// link in the container, which means that something else uses the same table.
+func checkTableFree(handle *netlink.Handle, table int, family int, link netlink.Link) error {
+	routes, err := handle.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if route.LinkIndex != link.Attrs().Index {
+			return fmt.Errorf("routing table %d is already used for other interface in container", table)
+		}
+	}
+	return nil
+}
+
+// addReturnGateway adds link local gateway addresses to LB bridge, or host side veth of
+// routed network, so that containers can send traffic back through it.
+func addReturnGateway(bridge netlink.Link) error {
+	for _, gw := range []string{returnGatewayV4 + "/32", returnGatewayV6 + "/64"} {
+		addr, _ := netlink.ParseAddr(gw)
+		if err := netlink.AddrReplace(bridge, addr); err != nil {
+			return fmt.Errorf("addReturnGateway: failed to add %s to %s: %w", gw, bridge.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// joinRoutes returns gateways and static routes which make containers to use LB network
+// for their default route and/or static routes of the network. Link local gateways are
+// owned by the LB bridge so containers can reach them without addresses from same subnet.
+func joinRoutes(options *networkOptions, ipv4, ipv6 string) (string, string, []*api.StaticRoute) {
+	hasIPv4, hasIPv6 := false, ipv6 != ""
+	if ip, _, err := net.ParseCIDR(ipv4); err == nil && !ip.IsUnspecified() {
+		hasIPv4 = true
+	}
+
+	gateway, gatewayV6 := "", ""
+	routes := []*api.StaticRoute{}
+	if hasIPv4 && (options.DefaultRoute || len(options.StaticRoutes) > 0) {
+		// Gateway is outside of container subnet so it needs connected route first
+		routes = append(routes, &api.StaticRoute{Destination: returnGatewayV4 + "/32", RouteType: lntypes.CONNECTED})
+	}
+	if options.DefaultRoute {
+		if hasIPv4 {
+			gateway = returnGatewayV4
+		}
+		if hasIPv6 {
+			gatewayV6 = returnGatewayV6
+		}
+	}
+	for _, prefix := range options.StaticRoutes {
+		_, ipnet, _ := net.ParseCIDR(prefix)
+		if ipnet.IP.To4() != nil && hasIPv4 {
+			routes = append(routes, &api.StaticRoute{Destination: prefix, RouteType: lntypes.NEXTHOP, NextHop: returnGatewayV4})
+		}
+		if ipnet.IP.To4() == nil && hasIPv6 {
+			routes = append(routes, &api.StaticRoute{Destination: prefix, RouteType: lntypes.NEXTHOP, NextHop: returnGatewayV6})
+		}
+	}
+	return gateway, gatewayV6, routes
+}
+
+// containerPid returns PID of the container which has endpoint in network.
+func containerPid(networkID, endpointID string) (int, error) {
+	container, err := endpointContainer(networkID, endpointID)
+	if err != nil {
+		return 0, err
+	}
+	if container.State == nil || container.State.Pid == 0 {
+		return 0, fmt.Errorf("container %s is not running", container.Name)
+	}
+	return container.State.Pid, nil
+}
+
+// findLinkByAddress returns link which has ip configured inside network namespace of handle.
+func findLinkByAddress(handle *netlink.Handle, ip net.IP) (netlink.Link, error) {
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		addrs, err := handle.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return link, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface has address %s", ip)
+}
+
+// addSourceRouting makes container to send traffic from its LB addresses back through
+// the LB network instead of its default route. Policy rule "from <address>" selects
+// per network routing table which has default route to the link local gateway of LB bridge.
+func addSourceRouting(networkID, endpointID string, table int, addresses []net.IP) error {
+	pid, err := containerPid(networkID, endpointID)
+	if err != nil {
+		return fmt.Errorf("addSourceRouting: %w", err)
+	}
+	ns, err := netns.GetFromPid(pid)
+	if err != nil {
+		return fmt.Errorf("addSourceRouting: failed to open network namespace of PID %d: %w", pid, err)
+	}
+	defer ns.Close()
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("addSourceRouting: failed to open netlink handle: %w", err)
+	}
+	defer handle.Close()
+
+	if err := programSourceRouting(handle, table, addresses); err != nil {
+		return fmt.Errorf("addSourceRouting: %w", err)
+	}
+	return nil
+}
+
+// programSourceRouting adds rules and routes of source routing with handle to
+// network namespace of container.
+func programSourceRouting(handle *netlink.Handle, table int, addresses []net.IP) error {
+	for _, ip := range addresses {
+		link, err := findLinkByAddress(handle, ip)
+		if err != nil {
+			return err
+		}
+
+		family, gw, mask := netlink.FAMILY_V4, net.ParseIP(returnGatewayV4), net.CIDRMask(32, 32)
+		if ip.To4() == nil {
+			family, gw, mask = netlink.FAMILY_V6, net.ParseIP(returnGatewayV6), net.CIDRMask(128, 128)
+		}
+		if err := checkTableFree(handle, table, family, link); err != nil {
+			return err
+		}
+
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Gw:        gw,
+			Table:     table,
+			Flags:     int(netlink.FLAG_ONLINK),
+		}
+		if err := handle.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add default route to table %d: %w", table, err)
+		}
+
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Src = &net.IPNet{IP: ip, Mask: mask}
+		rule.Table = table
+		rule.Priority = sourceRoutingPriority
+		if err := handle.RuleAdd(rule); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("failed to add rule from %s: %w", ip, err)
+		}
+		log.Infof("Traffic from %s is routed back through %s in container", ip, link.Attrs().Name)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"testing"
+
+	lntypes "github.com/docker/docker/libnetwork/types"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestAllocateSourceRoutingTable(t *testing.T) {
+	// Return traffic is routed to LB network only while endpoint is healthy
+	if _, err := parseNetworkOptions(testGenericOptions(map[string]string{optSourceRoute: "true", optHealthMode: healthModeNone})); err == nil {
+		t.Error("parseNetworkOptions() accepted source routing without health check")
+	}
+	if options, err := parseNetworkOptions(testGenericOptions(map[string]string{optSourceRoute: "true"})); err != nil || !options.SourceRouting {
+		t.Fatalf("parseNetworkOptions() = %+v, %v, want source routing", options, err)
+	}
+
+	tests := []struct {
+		name   string
+		tables []int
+		want   int
+	}{
+		{"first network", nil, sourceRoutingTableBase},
+		{"networks without source routing", []int{0, 0}, sourceRoutingTableBase},
+		{"lowest free table", []int{sourceRoutingTableBase, sourceRoutingTableBase + 2, 0}, sourceRoutingTableBase + 1},
+		{"after used tables", []int{sourceRoutingTableBase, sourceRoutingTableBase + 1}, sourceRoutingTableBase + 2},
+	}
+	for _, tt := range tests {
+		d := &bgpLB{Networks: make(map[string]*bgpNetwork)}
+		for i, table := range tt.tables {
+			d.Networks[string(rune('a'+i))] = &bgpNetwork{Options: defaultNetworkOptions(), SourceRoutingTable: table}
+		}
+		got, err := d.allocateSourceRoutingTable()
+		if err != nil || got != tt.want {
+			t.Errorf("%s: allocateSourceRoutingTable() = %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+	}
+
+	d := &bgpLB{Networks: make(map[string]*bgpNetwork)}
+	for i := 0; i < sourceRoutingTableCount; i++ {
+		d.Networks[net.IPv4(10, 0, byte(i>>8), byte(i)).String()] = &bgpNetwork{SourceRoutingTable: sourceRoutingTableBase + i}
+	}
+	if table, err := d.allocateSourceRoutingTable(); err == nil {
+		t.Errorf("allocateSourceRoutingTable() = %d when all tables are in use", table)
+	}
+}
+
+// testNetns returns handle to new network namespace which has veth bgplbtest0
+// with address 10.0.0.1/32 and 2001:db8::1/128 and veth bgplbtest1 with 10.0.0.2/32.
+func testNetns(t *testing.T) *netlink.Handle {
+	t.Helper()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		t.Skipf("cannot open network namespace: %v", err)
+	}
+	defer orig.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("cannot create network namespace: %v", err)
+	}
+	if err := netns.Set(orig); err != nil {
+		t.Fatalf("cannot return to original network namespace: %v", err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatalf("NewHandleAt() error = %v", err)
+	}
+	t.Cleanup(handle.Close)
+
+	for name, addresses := range map[string][]string{"bgplbtest0": {"10.0.0.1/32", "2001:db8::1/128"}, "bgplbtest1": {"10.0.0.2/32"}} {
+		if err := handle.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}); err != nil {
+			t.Skipf("cannot create veth %s: %v", name, err)
+		}
+		link, _ := handle.LinkByName(name)
+		handle.LinkSetUp(link)
+		for _, a := range addresses {
+			addr, _ := netlink.ParseAddr(a)
+			addr.Flags = unix.IFA_F_NODAD
+			if err := handle.AddrAdd(link, addr); err != nil {
+				t.Fatalf("AddrAdd(%s) error = %v", a, err)
+			}
+		}
+	}
+	return handle
+}
+
+func TestProgramSourceRouting(t *testing.T) {
+	handle := testNetns(t)
+	table := sourceRoutingTableBase
+	addresses := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}
+
+	// Programming is repeated when routes of endpoint are added again
+	for i := 0; i < 2; i++ {
+		if err := programSourceRouting(handle, table, addresses); err != nil {
+			t.Fatalf("programSourceRouting() error = %v", err)
+		}
+	}
+
+	link, _ := handle.LinkByName("bgplbtest0")
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := handle.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil || len(routes) != 1 || routes[0].LinkIndex != link.Attrs().Index || routes[0].Dst != nil {
+			t.Errorf("family %d routes in table %d = %v, %v, want default route through bgplbtest0", family, table, routes, err)
+		}
+		rules, err := handle.RuleList(family)
+		if err != nil {
+			t.Fatalf("RuleList() error = %v", err)
+		}
+		found := 0
+		for _, rule := range rules {
+			if rule.Table == table && rule.Priority == sourceRoutingPriority && rule.Src != nil {
+				found++
+			}
+		}
+		if found != 1 {
+			t.Errorf("family %d has %d source rules to table %d, want 1", family, found, table)
+		}
+	}
+
+	// Other network of the container must not share the table
+	other := []net.IP{net.ParseIP("10.0.0.2")}
+	if err := programSourceRouting(handle, table, other); err == nil {
+		t.Error("programSourceRouting() shared table with other interface")
+	}
+	if err := programSourceRouting(handle, table+1, other); err != nil {
+		t.Errorf("programSourceRouting() with own table error = %v", err)
+	}
+
+	if err := programSourceRouting(handle, table, []net.IP{net.ParseIP("10.0.0.3")}); err == nil {
+		t.Error("programSourceRouting() accepted address which container does not have")
+	}
+}
+
+func TestJoinRoutes(t *testing.T) {
+	if _, err := parseNetworkOptions(testGenericOptions(map[string]string{optStaticRoutes: "10.0.0.0"})); err == nil {
+		t.Error("parseNetworkOptions() accepted static route without prefix length")
+	}
+	options, err := parseNetworkOptions(testGenericOptions(map[string]string{optStaticRoutes: "10.0.0.1/8, 2001:db8::/32"}))
+	if err != nil {
+		t.Fatalf("parseNetworkOptions() error = %v", err)
+	}
+	gateway, gatewayV6, routes := joinRoutes(options, "192.0.2.10/24", "2001:db8:1::10/64")
+	if gateway != "" || gatewayV6 != "" {
+		t.Errorf("joinRoutes() with static routes changed default gateway to %s, %s", gateway, gatewayV6)
+	}
+	got := []string{}
+	for _, r := range routes {
+		got = append(got, fmt.Sprintf("%s via %s type %d", r.Destination, r.NextHop, r.RouteType))
+	}
+	want := []string{
+		fmt.Sprintf("%s/32 via  type %d", returnGatewayV4, lntypes.CONNECTED),
+		fmt.Sprintf("10.0.0.0/8 via %s type %d", returnGatewayV4, lntypes.NEXTHOP),
+		fmt.Sprintf("2001:db8::/32 via %s type %d", returnGatewayV6, lntypes.NEXTHOP),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("joinRoutes() routes = %q, want %q", got, want)
+	}
+
+	// Routes of missing address family are left out
+	if _, _, routes := joinRoutes(options, "0.0.0.0/0", "2001:db8:1::10/64"); len(routes) != 1 || routes[0].NextHop != returnGatewayV6 {
+		t.Errorf("joinRoutes() for IPv6 only endpoint = %v", routes)
+	}
+
+	options, err = parseNetworkOptions(testGenericOptions(map[string]string{optDefaultRoute: "true"}))
+	if err != nil {
+		t.Fatalf("parseNetworkOptions() error = %v", err)
+	}
+	gateway, gatewayV6, routes = joinRoutes(options, "192.0.2.10/24", "")
+	if gateway != returnGatewayV4 || gatewayV6 != "" || len(routes) != 1 || routes[0].RouteType != lntypes.CONNECTED {
+		t.Errorf("joinRoutes() with default route = %s, %s, %v", gateway, gatewayV6, routes)
+	}
+}
+
+func TestAddReturnGateway(t *testing.T) {
+	if _, err := os.Stat("/proc/sys/net/ipv6"); err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	link := testVeth(t, "bgplbtest1")
+	// Every endpoint of the network adds gateway again
+	for i := 0; i < 2; i++ {
+		if err := addReturnGateway(link); err != nil {
+			t.Fatalf("addReturnGateway() error = %v", err)
+		}
+	}
+	for _, gw := range []string{returnGatewayV4, returnGatewayV6} {
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			t.Fatalf("AddrList() error = %v", err)
+		}
+		found := 0
+		for _, a := range addrs {
+			if a.IP.Equal(net.ParseIP(gw)) {
+				found++
+			}
+		}
+		if found != 1 {
+			t.Errorf("bgplbtest1 has gateway %s %d times, want once", gw, found)
+		}
+	}
+}
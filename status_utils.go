@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/olljanat/docker-bgp-lb/api"
+)
+
+// statusPath is served on the plugin socket next to the Docker driver API, e.g.
+// curl --unix-socket /run/docker/plugins/<plugin id>/bgplb.sock http://localhost/BgpLB.Status
+const statusPath = "/BgpLB.Status"
+
+type routeStatus struct {
+	Prefix     string
+	NetworkID  string
+	Endpoints  []string
+	Links      []string
+	Announced  bool
+	Owner      string
+	Repairs    int
+	LastChange time.Time
+}
+
+// prefixCountStatus tells how many prefixes this host originates in total and per network.
+type prefixCountStatus struct {
+	Count    int
+	Max      int
+	Networks map[string]int
+}
+
+type peerStatus struct {
+	Address    string
+	State      string
+	LastChange time.Time
+}
+
+type pluginStatus struct {
+	Routes   []routeStatus
+	Prefixes prefixCountStatus
+	Peers    []peerStatus
+	IPVS     []ipvsServiceStatus
+	Firewall []firewallCounterStatus
+	Overload *overloadStatus
+}
+
+func getStatus() *pluginStatus {
+	status := &pluginStatus{Routes: []routeStatus{}}
+
+	desiredRoutes.Lock()
+	for _, r := range desiredRoutes.routes {
+		owner := ""
+		if r.options.elected() {
+			owner = elections.leader(r.dst.String())
+		}
+		status.Routes = append(status.Routes, routeStatus{
+			Prefix:     r.dst.String(),
+			NetworkID:  r.networkID,
+			Endpoints:  r.endpointIDs(),
+			Links:      r.linkNames(),
+			Announced:  !r.withdrawn,
+			Owner:      owner,
+			Repairs:    r.repairs,
+			LastChange: r.lastChange,
+		})
+	}
+	desiredRoutes.Unlock()
+
+	status.Prefixes = prefixLimits.status()
+	status.Peers = peerStates.status()
+	status.IPVS = localBalancer.status()
+	status.Firewall = firewallStatus()
+	status.Overload = overload.status()
+
+	return status
+}
+
+func registerStatusHandler(h *api.Handler) {
+	h.HandleFunc(statusPath, func(w http.ResponseWriter, r *http.Request) {
+		sdk.EncodeResponse(w, getStatus(), false)
+	})
+}